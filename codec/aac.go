@@ -0,0 +1,29 @@
+package codec
+
+// ADTSHeader the adts header of an aac frame, from the mpeg4 audio specific config,
+// aac lc is assumed when the config is missing
+func ADTSHeader(config []byte, frameSize int) []byte {
+
+	var objectType, frequencyIndex, channels byte
+	if len(config) >= 2 {
+		objectType = config[0] >> 3
+		frequencyIndex = (config[0]&0x07)<<1 | config[1]>>7
+		channels = (config[1] >> 3) & 0x0f
+	}
+	if objectType == 0 {
+		objectType = 2
+	}
+
+	length := frameSize + 7
+
+	header := make([]byte, 7)
+	header[0] = 0xff
+	header[1] = 0xf1
+	header[2] = (objectType-1)&0x03<<6 | frequencyIndex<<2 | channels>>2&0x01
+	header[3] = channels&0x03<<6 | byte(length>>11)&0x03
+	header[4] = byte(length >> 3)
+	header[5] = byte(length&0x07)<<5 | 0x1f
+	header[6] = 0xfc
+
+	return header
+}
@@ -0,0 +1,18 @@
+// Package codec the h264 and aac helpers shared by the rtmp bridge, the transcoders, http-flv and hls
+package codec
+
+// H264CodecData the sps and pps of a h264 stream, as the rtmp demuxer gives them
+type H264CodecData interface {
+	SPS() []byte
+	PPS() []byte
+}
+
+// AVCCodecData the avc decoder configuration record of a h264 stream
+type AVCCodecData interface {
+	AVCDecoderConfRecordBytes() []byte
+}
+
+// AACCodecData the mpeg4 audio specific config of an aac stream
+type AACCodecData interface {
+	MPEG4AudioConfigBytes() []byte
+}
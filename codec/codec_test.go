@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitAVCC(t *testing.T) {
+
+	data := []byte{
+		0, 0, 0, 2, 0x09, 0xf0,
+		0, 0, 0, 3, 0x65, 0x01, 0x02,
+	}
+
+	nalus := SplitAVCC(data)
+	if len(nalus) != 2 {
+		t.Fatalf("nalus = %d, want 2", len(nalus))
+	}
+	if !bytes.Equal(nalus[0], []byte{0x09, 0xf0}) || !bytes.Equal(nalus[1], []byte{0x65, 0x01, 0x02}) {
+		t.Errorf("nalus = %x", nalus)
+	}
+
+	// a truncated nalu is dropped
+	if nalus := SplitAVCC([]byte{0, 0, 0, 9, 0x65}); len(nalus) != 0 {
+		t.Errorf("truncated nalus = %d, want 0", len(nalus))
+	}
+}
+
+func TestSplitH264(t *testing.T) {
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+
+	annexb := append([]byte{0, 0, 0, 1}, sps...)
+	annexb = append(annexb, 0, 0, 1)
+	annexb = append(annexb, pps...)
+	annexb = append(annexb, 0, 0, 0, 1)
+	annexb = append(annexb, idr...)
+
+	var avcc []byte
+	for _, nalu := range [][]byte{sps, pps, idr} {
+		avcc = append(avcc, 0, 0, 0, byte(len(nalu)))
+		avcc = append(avcc, nalu...)
+	}
+
+	for name, data := range map[string][]byte{"annexb": annexb, "avcc": avcc} {
+		nalus := SplitH264(data)
+		if len(nalus) != 3 {
+			t.Errorf("%s nalus = %d, want 3", name, len(nalus))
+			continue
+		}
+		for i, want := range [][]byte{sps, pps, idr} {
+			if !bytes.Equal(nalus[i], want) {
+				t.Errorf("%s nalu %d = %x, want %x", name, i, nalus[i], want)
+			}
+		}
+	}
+}
+
+func TestADTSHeader(t *testing.T) {
+
+	// aac lc, 44100hz, stereo
+	want := []byte{0xff, 0xf1, 0x50, 0x80, 0x0d, 0x7f, 0xfc}
+	if header := ADTSHeader([]byte{0x12, 0x10}, 100); !bytes.Equal(header, want) {
+		t.Errorf("adts header % x", header)
+	}
+
+	// without config the header is still valid
+	if header := ADTSHeader(nil, 100); header[0] != 0xff || header[2]>>6 != 1 {
+		t.Errorf("adts header without config % x", header)
+	}
+}
@@ -0,0 +1,59 @@
+package codec
+
+import "encoding/binary"
+
+// SplitAVCC split the length prefixed nalus of an avcc sample
+func SplitAVCC(data []byte) [][]byte {
+
+	var nalus [][]byte
+
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			break
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+
+	return nalus
+}
+
+// SplitAnnexB split the start code prefixed nalus of an annex b frame
+func SplitAnnexB(data []byte) [][]byte {
+
+	var nalus [][]byte
+
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// the zero of a 4 bytes start code
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+
+	return nalus
+}
+
+// SplitH264 split the nalus of a frame, annex b if it starts with a start code, else avcc
+func SplitH264(data []byte) [][]byte {
+
+	if len(data) >= 3 && data[0] == 0 && data[1] == 0 && (data[2] == 1 || len(data) >= 4 && data[2] == 0 && data[3] == 1) {
+		return SplitAnnexB(data)
+	}
+	return SplitAVCC(data)
+}
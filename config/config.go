@@ -2,21 +2,82 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
 
 	"github.com/notedit/sdp"
 	"gopkg.in/yaml.v2"
 )
 
+// auth modes
+const (
+	AuthToken   = "token"
+	AuthWebhook = "webhook"
+)
+
+// ffmpeg pipeline video and audio modes
+const (
+	VideoCopy = "copy"
+	VideoX264 = "x264"
+	AudioOpus = "opus"
+	AudioCopy = "copy"
+	MediaNone = "none"
+)
+
+// DefaultProfile the ffmpeg profile used when none is configured, copy h264 and transcode audio to opus
+const DefaultProfile = "default"
+
+var x264Presets = map[string]bool{
+	"ultrafast": true, "superfast": true, "veryfast": true, "faster": true, "fast": true,
+	"medium": true, "slow": true, "slower": true, "veryslow": true,
+}
+
+var bitratePattern = regexp.MustCompile(`^[0-9]+[kKmM]?$`)
+
+// publish policies when a stream id is already published, backup is for rtmp pushes only,
+// a backup push waits and takes over once the active one ends
+const (
+	DuplicateReject   = "reject"
+	DuplicateTakeover = "takeover"
+	DuplicateBackup   = "backup"
+)
+
 type serverstruct struct {
-	Port int    `yaml:"port"`
-	Host string `yaml:"host"`
+	Port           int          `yaml:"port"`
+	Host           string       `yaml:"host"`
+	TrustedProxies []string     `yaml:"trustedproxies,flow"`
+	Proxies        []*net.IPNet `yaml:"-"`
+}
+
+// TrustedProxy true if the ip is in the trusted proxies, their forwarded headers tell the client ip
+func (s *serverstruct) TrustedProxy(ip string) bool {
+
+	if s == nil {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, proxy := range s.Proxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 type mediastruct struct {
-	Endpoint string `yaml:"endpoint"`
-	Minport  int    `yaml:"minport"`
-	Maxport  int    `yaml:"maxport"`
+	Endpoint    string `yaml:"endpoint"`
+	Minport     int    `yaml:"minport"`
+	Maxport     int    `yaml:"maxport"`
+	ICETimeout  int    `yaml:"icetimeout"`
+	IdleTimeout int    `yaml:"idletimeout"`
 }
 
 type relaystruct struct {
@@ -26,16 +87,131 @@ type relaystruct struct {
 }
 
 type rtmpstruct struct {
-	Host string `yaml:"host"`
-	Port int    `yaml:"port"`
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+	Bridge bool   `yaml:"bridge"`
+}
+
+type publishstruct struct {
+	Duplicate string `yaml:"duplicate"`
+}
+
+type authstruct struct {
+	Mode    string `yaml:"mode"`
+	Secret  string `yaml:"secret"`
+	Webhook string `yaml:"webhook"`
+	Timeout int    `yaml:"timeout"`
+}
+
+type webhookstruct struct {
+	URL     string `yaml:"url"`
+	Queue   int    `yaml:"queue"`
+	Retries int    `yaml:"retries"`
+	Timeout int    `yaml:"timeout"`
+}
+
+type profilestruct struct {
+	Input   []string `yaml:"input,flow"`
+	Video   string   `yaml:"video"`
+	Bitrate string   `yaml:"bitrate"`
+	Preset  string   `yaml:"preset"`
+	Bsfs    []string `yaml:"bsfs,flow"`
+	Audio   string   `yaml:"audio"`
+}
+
+type rulestruct struct {
+	Match   string         `yaml:"match"`
+	Profile string         `yaml:"profile"`
+	Pattern *regexp.Regexp `yaml:"-"`
+}
+
+type ffmpegstruct struct {
+	Restarts     int                       `yaml:"restarts"`
+	StopTimeout  int                       `yaml:"stoptimeout"`
+	ProbeTimeout int                       `yaml:"probetimeout"`
+	Profile      string                    `yaml:"profile"`
+	Profiles     map[string]*profilestruct `yaml:"profiles"`
+	Rules        []*rulestruct             `yaml:"rules"`
+}
+
+type adminstruct struct {
+	Token string `yaml:"token"`
+}
+
+type forwardrule struct {
+	App     string   `yaml:"app"`
+	Targets []string `yaml:"targets"`
+}
+
+type forwardstruct struct {
+	Reconnect int           `yaml:"reconnect"`
+	Rules     []forwardrule `yaml:"rules"`
+}
+
+// Targets the forward targets of the rules of the app, {stream} is replaced with the stream name
+func (f *forwardstruct) Targets(app string, stream string) []string {
+
+	var targets []string
+	for _, rule := range f.Rules {
+		if rule.App != app {
+			continue
+		}
+		for _, target := range rule.Targets {
+			targets = append(targets, strings.Replace(target, "{stream}", stream, -1))
+		}
+	}
+	return targets
+}
+
+type hlsstruct struct {
+	Segment int `yaml:"segment"`
+	Window  int `yaml:"window"`
+	Part    int `yaml:"part"`
+}
+
+type appstruct struct {
+	Publish  bool `yaml:"publish"`
+	Play     bool `yaml:"play"`
+	Auth     bool `yaml:"auth"`
+	GopCache bool `yaml:"gopcache"`
+}
+
+// UnmarshalYAML publish, play, auth and gopcache are enabled unless they are set to false
+func (a *appstruct) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain appstruct
+	app := plain{Publish: true, Play: true, Auth: true, GopCache: true}
+	if err := unmarshal(&app); err != nil {
+		return err
+	}
+	*a = appstruct(app)
+	return nil
+}
+
+// the config of the apps which are not configured
+var defaultApp = &appstruct{Publish: true, Play: true, Auth: true, GopCache: true}
+
+type clusterstruct struct {
+	Origins         []string `yaml:"origins"`
+	Timeout         int      `yaml:"timeout"`
+	UpstreamTimeout int      `yaml:"upstreamtimeout"`
+	Secret          string   `yaml:"secret"`
 }
 
 // Config struct
 type Config struct {
-	Server     *serverstruct `yaml:"server"`
-	Media      *mediastruct  `yaml:"media"`
-	Relay      bool          `yaml:"relay"`
-	Rtmp       *rtmpstruct   `yaml:"rtmp"`
+	Server     *serverstruct         `yaml:"server"`
+	Media      *mediastruct          `yaml:"media"`
+	Relay      bool                  `yaml:"relay"`
+	Rtmp       *rtmpstruct           `yaml:"rtmp"`
+	Cluster    *clusterstruct        `yaml:"cluster"`
+	Publish    *publishstruct        `yaml:"publish"`
+	Auth       *authstruct           `yaml:"auth"`
+	Webhook    *webhookstruct        `yaml:"webhook"`
+	Admin      *adminstruct          `yaml:"admin"`
+	Forward    *forwardstruct        `yaml:"forward"`
+	FFmpeg     *ffmpegstruct         `yaml:"ffmpeg"`
+	HLS        *hlsstruct            `yaml:"hls"`
+	Apps       map[string]*appstruct `yaml:"apps"`
 	Capability struct {
 		Audio struct {
 			Codecs     []string `yaml:"codecs,flow"`
@@ -71,6 +247,148 @@ func LoadConfig(filePath string) (*Config, error) {
 		return nil, errors.New("capability can not be empty")
 	}
 
+	if config.Server != nil {
+		for _, proxy := range config.Server.TrustedProxies {
+			network, err := parseNetwork(proxy)
+			if err != nil {
+				return nil, err
+			}
+			config.Server.Proxies = append(config.Server.Proxies, network)
+		}
+	}
+
+	if config.Media != nil {
+		if config.Media.ICETimeout == 0 {
+			config.Media.ICETimeout = 30
+		}
+		if config.Media.IdleTimeout == 0 {
+			config.Media.IdleTimeout = 10
+		}
+	}
+
+	if config.Cluster != nil {
+		for _, origin := range config.Cluster.Origins {
+			if origin == "" {
+				return nil, errors.New("cluster origin can not be empty")
+			}
+		}
+		if config.Cluster.Timeout <= 0 {
+			config.Cluster.Timeout = 3
+		}
+		if config.Cluster.UpstreamTimeout <= 0 {
+			config.Cluster.UpstreamTimeout = 15
+		}
+	}
+
+	if config.Publish == nil {
+		config.Publish = &publishstruct{}
+	}
+
+	switch config.Publish.Duplicate {
+	case "":
+		config.Publish.Duplicate = DuplicateReject
+	case DuplicateReject, DuplicateTakeover, DuplicateBackup:
+	default:
+		return nil, errors.New("publish duplicate should be reject, takeover or backup")
+	}
+
+	if config.Auth != nil {
+		switch config.Auth.Mode {
+		case AuthToken:
+			if config.Auth.Secret == "" {
+				return nil, errors.New("auth secret can not be empty")
+			}
+		case AuthWebhook:
+			if config.Auth.Webhook == "" {
+				return nil, errors.New("auth webhook can not be empty")
+			}
+		default:
+			return nil, errors.New("auth mode should be token or webhook")
+		}
+		if config.Auth.Timeout <= 0 {
+			config.Auth.Timeout = 3
+		}
+	}
+
+	if config.Webhook != nil {
+		if config.Webhook.URL == "" {
+			return nil, errors.New("webhook url can not be empty")
+		}
+		if config.Webhook.Queue <= 0 {
+			config.Webhook.Queue = 1024
+		}
+		if config.Webhook.Retries < 0 {
+			config.Webhook.Retries = 0
+		}
+		if config.Webhook.Timeout <= 0 {
+			config.Webhook.Timeout = 3
+		}
+	}
+
+	if config.FFmpeg == nil {
+		config.FFmpeg = &ffmpegstruct{}
+	}
+	if config.FFmpeg.Restarts == 0 {
+		config.FFmpeg.Restarts = 5
+	} else if config.FFmpeg.Restarts < 0 {
+		config.FFmpeg.Restarts = 0
+	}
+	if config.FFmpeg.StopTimeout <= 0 {
+		config.FFmpeg.StopTimeout = 5
+	}
+	if config.FFmpeg.ProbeTimeout == 0 {
+		config.FFmpeg.ProbeTimeout = 5
+	}
+	if err := config.FFmpeg.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Admin != nil && config.Admin.Token == "" {
+		return nil, errors.New("admin token can not be empty")
+	}
+
+	if config.Forward == nil {
+		config.Forward = &forwardstruct{}
+	}
+	if config.Forward.Reconnect <= 0 {
+		config.Forward.Reconnect = 3
+	}
+	for _, rule := range config.Forward.Rules {
+		if rule.App == "" {
+			return nil, errors.New("forward rule app can not be empty")
+		}
+		for _, target := range rule.Targets {
+			if !strings.HasPrefix(target, "rtmp://") {
+				return nil, fmt.Errorf("forward target %s is not a rtmp url", target)
+			}
+		}
+	}
+
+	if config.HLS != nil {
+		if config.HLS.Segment <= 0 {
+			config.HLS.Segment = 2
+		}
+		if config.HLS.Window <= 0 {
+			config.HLS.Window = 6
+		}
+		if config.HLS.Part < 0 {
+			config.HLS.Part = 0
+		}
+		if config.HLS.Part >= config.HLS.Segment*1000 {
+			return nil, errors.New("hls part should be shorter than the segment")
+		}
+	}
+
+	for name, app := range config.Apps {
+		parts := strings.Split(name, "/")
+		if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			return nil, fmt.Errorf("app %s should be app or vhost/app", name)
+		}
+		if app == nil {
+			config.Apps[name] = defaultApp
+		}
+	}
+
 	config.Capabilities = make(map[string]*sdp.Capability)
 
 	if config.Capability.Audio.Codecs != nil {
@@ -100,3 +418,127 @@ func LoadConfig(filePath string) (*Config, error) {
 
 	return &config, nil
 }
+
+// parseNetwork parse a cidr, or an ip as the network of the ip alone
+func parseNetwork(s string) (*net.IPNet, error) {
+
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("trusted proxy %s is not an ip or a cidr", s)
+	}
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// App the config of the app on the vhost, an app is configured as vhost/app or as app for all the vhosts
+func (c *Config) App(vhost string, app string) *appstruct {
+
+	if config := c.Apps[vhost+"/"+app]; config != nil {
+		return config
+	}
+	if config := c.Apps[app]; config != nil {
+		return config
+	}
+	return defaultApp
+}
+
+// validate the profiles and the rules, the default profile is added if there is none
+func (f *ffmpegstruct) validate() error {
+
+	if f.Profiles == nil {
+		f.Profiles = make(map[string]*profilestruct)
+	}
+
+	if _, ok := f.Profiles[DefaultProfile]; !ok {
+		f.Profiles[DefaultProfile] = &profilestruct{
+			Input: []string{"-fflags", "nobuffer"},
+			Video: VideoCopy,
+			Bsfs:  []string{"h264_mp4toannexb"},
+			Audio: AudioOpus,
+		}
+	}
+
+	if f.Profile == "" {
+		f.Profile = DefaultProfile
+	}
+
+	if _, ok := f.Profiles[f.Profile]; !ok {
+		return fmt.Errorf("ffmpeg profile %s is not defined", f.Profile)
+	}
+
+	for name, profile := range f.Profiles {
+		if profile == nil {
+			return fmt.Errorf("ffmpeg profile %s is empty", name)
+		}
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("ffmpeg profile %s: %s", name, err)
+		}
+	}
+
+	for _, rule := range f.Rules {
+		pattern, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("ffmpeg rule %s: %s", rule.Match, err)
+		}
+		if _, ok := f.Profiles[rule.Profile]; !ok {
+			return fmt.Errorf("ffmpeg rule %s: profile %s is not defined", rule.Match, rule.Profile)
+		}
+		rule.Pattern = pattern
+	}
+
+	return nil
+}
+
+func (p *profilestruct) validate() error {
+
+	if p.Video == "" {
+		p.Video = VideoCopy
+	}
+	if p.Audio == "" {
+		p.Audio = AudioOpus
+	}
+
+	switch p.Video {
+	case VideoCopy, MediaNone:
+		if p.Bitrate != "" || p.Preset != "" {
+			return errors.New("bitrate and preset need video x264")
+		}
+	case VideoX264:
+		if p.Bitrate != "" && !bitratePattern.MatchString(p.Bitrate) {
+			return fmt.Errorf("bitrate %s is invalid", p.Bitrate)
+		}
+		if p.Preset != "" && !x264Presets[p.Preset] {
+			return fmt.Errorf("preset %s is invalid", p.Preset)
+		}
+	default:
+		return fmt.Errorf("video should be copy, x264 or none, got %s", p.Video)
+	}
+
+	switch p.Audio {
+	case AudioOpus, AudioCopy, MediaNone:
+	default:
+		return fmt.Errorf("audio should be opus, copy or none, got %s", p.Audio)
+	}
+
+	if p.Video == MediaNone && p.Audio == MediaNone {
+		return errors.New("video and audio can not both be none")
+	}
+
+	if p.Video == MediaNone && len(p.Bsfs) > 0 {
+		return errors.New("bsfs need video")
+	}
+
+	for _, flag := range p.Input {
+		if flag == "-i" {
+			return errors.New("input flags can not contain -i")
+		}
+	}
+
+	return nil
+}
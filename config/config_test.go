@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"gopkg.in/yaml.v2"
@@ -31,3 +32,247 @@ func TestConfig(t *testing.T) {
 	}
 
 }
+
+func TestLoadClusterConfig(t *testing.T) {
+
+	data := []byte(`
+server:
+  port: 5000
+media:
+  endpoint: 127.0.0.1
+cluster:
+  origins:
+    - 127.0.0.1:5001
+    - 127.0.0.1:5002
+  timeout: 2
+capability:
+  audio:
+    codecs:
+      - opus
+`)
+
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(data)
+	file.Close()
+
+	config, err := LoadConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Cluster.Origins) != 2 || config.Cluster.Origins[1] != "127.0.0.1:5002" {
+		t.Error("parse origins error")
+	}
+
+	if config.Cluster.Timeout != 2 {
+		t.Error("parse timeout error")
+	}
+
+	if config.Cluster.UpstreamTimeout != 15 {
+		t.Error("upstream timeout should have a default value")
+	}
+
+	if config.Publish.Duplicate != DuplicateReject {
+		t.Error("publish duplicate should default to reject")
+	}
+
+	if config.Media.ICETimeout != 30 || config.Media.IdleTimeout != 10 {
+		t.Error("ice and idle timeout should have default values")
+	}
+
+	if config.FFmpeg.Restarts != 5 || config.FFmpeg.StopTimeout != 5 {
+		t.Error("ffmpeg should have default values")
+	}
+}
+
+func loadConfigData(t *testing.T, data string) (*Config, error) {
+
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(data)
+	file.Close()
+
+	return LoadConfig(file.Name())
+}
+
+func TestLoadFFmpegProfiles(t *testing.T) {
+
+	config, err := loadConfigData(t, `
+capability:
+  audio:
+    codecs: [opus]
+ffmpeg:
+  profiles:
+    transcode:
+      video: x264
+      bitrate: 1500k
+      preset: veryfast
+    audioonly:
+      video: none
+  rules:
+    - match: ^rtmp://hevc\.
+      profile: transcode
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.FFmpeg.Profile != DefaultProfile || config.FFmpeg.Profiles[DefaultProfile] == nil {
+		t.Error("default profile should be added")
+	}
+
+	if config.FFmpeg.Profiles["transcode"].Audio != AudioOpus {
+		t.Error("profile audio should default to opus")
+	}
+
+	if !config.FFmpeg.Rules[0].Pattern.MatchString("rtmp://hevc.example.com/live/test") {
+		t.Error("rule pattern should be compiled")
+	}
+
+	invalid := []string{
+		"ffmpeg:\n  profile: unknown\n",
+		"ffmpeg:\n  profiles:\n    p:\n      video: vp8\n",
+		"ffmpeg:\n  profiles:\n    p:\n      audio: aac\n",
+		"ffmpeg:\n  profiles:\n    p:\n      video: copy\n      bitrate: 1000k\n",
+		"ffmpeg:\n  profiles:\n    p:\n      video: x264\n      bitrate: fast\n",
+		"ffmpeg:\n  profiles:\n    p:\n      video: x264\n      preset: quick\n",
+		"ffmpeg:\n  profiles:\n    p:\n      video: none\n      audio: none\n",
+		"ffmpeg:\n  profiles:\n    p:\n      input: [-i, rtmp://127.0.0.1/live/test]\n",
+		"ffmpeg:\n  rules:\n    - match: \"[\"\n      profile: default\n",
+		"ffmpeg:\n  rules:\n    - match: rtmp\n      profile: unknown\n",
+	}
+
+	for _, data := range invalid {
+		if _, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\n"+data); err == nil {
+			t.Errorf("config should be invalid:\n%s", data)
+		}
+	}
+}
+
+func TestLoadForwardRules(t *testing.T) {
+
+	config, err := loadConfigData(t, `
+capability:
+  audio:
+    codecs: [opus]
+forward:
+  rules:
+    - app: live
+      targets:
+        - rtmp://a.example.com/live2/{stream}
+        - rtmp://b.example.com/app/key
+    - app: other
+      targets:
+        - rtmp://c.example.com/other/{stream}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Forward.Reconnect != 3 {
+		t.Errorf("forward reconnect should default to 3, got %d", config.Forward.Reconnect)
+	}
+
+	targets := config.Forward.Targets("live", "test")
+	if len(targets) != 2 || targets[0] != "rtmp://a.example.com/live2/test" || targets[1] != "rtmp://b.example.com/app/key" {
+		t.Errorf("wrong targets of app live %v", targets)
+	}
+
+	if targets := config.Forward.Targets("unknown", "test"); len(targets) != 0 {
+		t.Errorf("unknown app should have no targets, got %v", targets)
+	}
+
+	_, err = loadConfigData(t, `
+capability:
+  audio:
+    codecs: [opus]
+forward:
+  rules:
+    - app: live
+      targets:
+        - http://a.example.com/live
+`)
+	if err == nil {
+		t.Error("a forward target which is not rtmp should be rejected")
+	}
+}
+
+func TestLoadApps(t *testing.T) {
+
+	config, err := loadConfigData(t, `
+capability:
+  audio:
+    codecs: [opus]
+apps:
+  live:
+  private:
+    play: false
+    gopcache: false
+  example.com/live:
+    auth: false
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app := config.App("__defaultVhost__", "live"); !app.Publish || !app.Play || !app.Auth || !app.GopCache {
+		t.Errorf("an empty app should allow everything, got %+v", app)
+	}
+
+	if app := config.App("__defaultVhost__", "private"); !app.Publish || app.Play || !app.Auth || app.GopCache {
+		t.Errorf("private app should deny play without gop cache, got %+v", app)
+	}
+
+	if app := config.App("example.com", "live"); app.Auth {
+		t.Error("the vhost app should win over the app")
+	}
+
+	if app := config.App("example.com", "unknown"); !app.Publish || !app.Play || !app.Auth {
+		t.Errorf("an unknown app should allow everything, got %+v", app)
+	}
+
+	if _, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\napps:\n  a/b/c:\n    play: false\n"); err == nil {
+		t.Error("app a/b/c should be rejected")
+	}
+}
+
+func TestLoadHLS(t *testing.T) {
+
+	config, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\nhls:\n  part: 200\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HLS.Segment != 2 || config.HLS.Window != 6 || config.HLS.Part != 200 {
+		t.Errorf("hls should have the defaults, got %+v", config.HLS)
+	}
+
+	if _, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\nhls:\n  segment: 1\n  part: 1000\n"); err == nil {
+		t.Error("a part as long as the segment should be rejected")
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+
+	config, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\nserver:\n  trustedproxies: [10.0.0.0/8, 127.0.0.1, \"::1\"]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, trusted := range map[string]bool{"10.1.2.3": true, "127.0.0.1": true, "::1": true, "127.0.0.2": false, "192.168.1.1": false, "": false} {
+		if config.Server.TrustedProxy(ip) != trusted {
+			t.Errorf("trusted proxy %s should be %v", ip, trusted)
+		}
+	}
+
+	if _, err := loadConfigData(t, "capability:\n  audio:\n    codecs: [opus]\nserver:\n  trustedproxies: [proxy]\n"); err == nil {
+		t.Error("a trusted proxy which is not an ip should be rejected")
+	}
+}
@@ -2,6 +2,7 @@ module github.com/notedit/rtclive
 
 require (
 	github.com/akamensky/argparse v0.0.0-20190115094700-b33e05fb8d69
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/gin-contrib/cors v0.0.0-20190101123304-5e7acb10687f
 	github.com/gin-gonic/gin v1.3.0
 	github.com/gofrs/uuid v3.2.0+incompatible
@@ -9,6 +10,7 @@ require (
 	github.com/notedit/media-server-go v0.1.12
 	github.com/notedit/rtmp-lib v0.0.2
 	github.com/notedit/sdp v0.0.1
+	github.com/prometheus/client_golang v0.9.2
 	gopkg.in/yaml.v2 v2.2.2
 )
 
@@ -0,0 +1,48 @@
+package hls
+
+import "github.com/notedit/rtclive/codec"
+
+var (
+	startCode       = []byte{0x00, 0x00, 0x00, 0x01}
+	accessUnitDelim = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+)
+
+// h264 nalu types
+const (
+	naluSPS = 7
+	naluPPS = 8
+	naluAUD = 9
+)
+
+// annexB convert the avcc nalus of a packet to annex-b, with an access unit delimiter first,
+// and the sps and pps before a keyframe which does not carry them
+func annexB(avcc []byte, sps []byte, pps []byte, keyframe bool) []byte {
+
+	var nalus [][]byte
+	hasParams := false
+	for _, nalu := range codec.SplitAVCC(avcc) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluAUD:
+			continue
+		case naluSPS, naluPPS:
+			hasParams = true
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	out := append([]byte{}, accessUnitDelim...)
+	if keyframe && !hasParams && len(sps) > 0 && len(pps) > 0 {
+		out = append(out, startCode...)
+		out = append(out, sps...)
+		out = append(out, startCode...)
+		out = append(out, pps...)
+	}
+	for _, nalu := range nalus {
+		out = append(out, startCode...)
+		out = append(out, nalu...)
+	}
+	return out
+}
@@ -0,0 +1,442 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtclive/codec"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// ErrNoStreams the source has neither h264 nor aac
+var ErrNoStreams = errors.New("hls: the source has no h264 or aac stream")
+
+// the segments of the playlist which still list their parts
+const partSegments = 2
+
+// Config of a packager
+type Config struct {
+	// Segment the target duration of the segments, a segment is cut on the first keyframe after it
+	Segment time.Duration
+	// Window the number of segments in the playlist
+	Window int
+	// Part the target duration of the ll-hls parts, 0 disables ll-hls
+	Part time.Duration
+}
+
+// part a byte range of its segment
+type part struct {
+	start       int
+	end         int
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	msn           int
+	start         time.Duration
+	duration      time.Duration
+	data          []byte
+	parts         []*part
+	discontinuity bool
+
+	// the part being written
+	partOffset      int
+	partStart       time.Duration
+	partIndependent bool
+}
+
+func (s *segment) Write(b []byte) (int, error) {
+	s.data = append(s.data, b...)
+	return len(b), nil
+}
+
+// Packager segment h264 and aac packets into mpeg-ts, it keeps a sliding playlist of the segments
+// in memory, with ll-hls parts when they are enabled
+type Packager struct {
+	sync.Mutex
+	cfg Config
+	id  string
+
+	video       int
+	audio       int
+	sps         []byte
+	pps         []byte
+	audioConfig []byte
+	ts          *tsWriter
+
+	segments        []*segment
+	current         *segment
+	next            int
+	discontinuities int
+	discontinuity   bool
+	lastTime        time.Duration
+	ended           bool
+	update          chan struct{}
+}
+
+// NewPackager create a packager, the uris of its segments are random and unique to it so they can be cached
+func NewPackager(cfg Config) *Packager {
+	if cfg.Window <= 0 {
+		cfg.Window = 1
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Packager{
+		cfg:    cfg,
+		id:     hex.EncodeToString(id),
+		video:  -1,
+		audio:  -1,
+		update: make(chan struct{}),
+	}
+}
+
+// WriteHeader set the streams of the source, a new source after the first one starts a discontinuity
+func (p *Packager) WriteHeader(streams []av.CodecData) error {
+
+	video, audio := -1, -1
+	var sps, pps, audioConfig []byte
+	for i, stream := range streams {
+		switch data := stream.(type) {
+		case codec.H264CodecData:
+			if video < 0 && stream.Type() == av.H264 {
+				video, sps, pps = i, data.SPS(), data.PPS()
+			}
+		case codec.AACCodecData:
+			if audio < 0 && stream.Type() == av.AAC {
+				audio, audioConfig = i, data.MPEG4AudioConfigBytes()
+			}
+		}
+	}
+	if video < 0 && audio < 0 {
+		return ErrNoStreams
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current != nil {
+		p.finishSegment(p.lastTime)
+	}
+	p.discontinuity = p.ts != nil
+
+	p.video, p.audio = video, audio
+	p.sps, p.pps, p.audioConfig = sps, pps, audioConfig
+	p.ts = newTSWriter(nil, video >= 0, audio >= 0)
+	return nil
+}
+
+// WritePacket add the packet to the current segment, the video before the first keyframe is dropped
+func (p *Packager) WritePacket(packet av.Packet) error {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ts == nil || p.ended {
+		return nil
+	}
+
+	idx := int(packet.Idx)
+	isVideo := idx == p.video
+	if !isVideo && idx != p.audio {
+		return nil
+	}
+
+	// segments and independent parts start on a keyframe, or on any packet without video
+	boundary := p.video < 0 || isVideo && packet.IsKeyFrame
+
+	switch {
+	case p.current == nil:
+		if !boundary {
+			return nil
+		}
+		p.startSegment(packet.Time)
+	case boundary && packet.Time-p.current.start >= p.cfg.Segment:
+		p.finishSegment(packet.Time)
+		p.startSegment(packet.Time)
+	case p.cfg.Part > 0 && packet.Time-p.current.partStart >= p.cfg.Part:
+		p.finishPart(packet.Time, boundary)
+	}
+
+	p.lastTime = packet.Time
+
+	dts := timestamp(packet.Time)
+	if isVideo {
+		pts := timestamp(packet.Time + packet.CompositionTime)
+		data := annexB(packet.Data, p.sps, p.pps, packet.IsKeyFrame)
+		return p.ts.WritePES(pidVideo, streamIDVideo, pts, dts, data, true, packet.IsKeyFrame)
+	}
+	return p.ts.WritePES(pidAudio, streamIDAudio, dts, dts, append(codec.ADTSHeader(p.audioConfig, len(packet.Data)), packet.Data...), p.video < 0, false)
+}
+
+// timestamp the time in 90khz
+func timestamp(t time.Duration) uint64 {
+	return uint64(t * 9 / 100000)
+}
+
+// Close end the playlist, the waiting requests are released
+func (p *Packager) Close() {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ended {
+		return
+	}
+	if p.current != nil {
+		p.finishSegment(p.lastTime)
+	}
+	p.ended = true
+	p.notify()
+}
+
+func (p *Packager) startSegment(start time.Duration) {
+
+	p.current = &segment{
+		msn:             p.next,
+		start:           start,
+		discontinuity:   p.discontinuity,
+		partStart:       start,
+		partIndependent: true,
+	}
+	p.discontinuity = false
+
+	p.ts.w = p.current
+	p.ts.WriteTables()
+	p.notify()
+}
+
+// finishPart close the part being written at end, independent is true if the next part starts on a keyframe
+func (p *Packager) finishPart(end time.Duration, independent bool) {
+
+	seg := p.current
+	seg.parts = append(seg.parts, &part{
+		start:       seg.partOffset,
+		end:         len(seg.data),
+		duration:    end - seg.partStart,
+		independent: seg.partIndependent,
+	})
+	seg.partOffset = len(seg.data)
+	seg.partStart = end
+	seg.partIndependent = independent
+	p.notify()
+}
+
+// finishSegment close the current segment at end, the oldest segments slide out of the window
+func (p *Packager) finishSegment(end time.Duration) {
+
+	seg := p.current
+	if p.cfg.Part > 0 && len(seg.data) > seg.partOffset {
+		p.finishPart(end, false)
+	}
+	seg.duration = end - seg.start
+
+	p.segments = append(p.segments, seg)
+	p.current = nil
+	p.next++
+
+	for len(p.segments) > p.cfg.Window {
+		if p.segments[0].discontinuity {
+			p.discontinuities++
+		}
+		p.segments = p.segments[1:]
+	}
+	p.notify()
+}
+
+// notify wake up the waiting requests, must be called with the lock held
+func (p *Packager) notify() {
+	close(p.update)
+	p.update = make(chan struct{})
+}
+
+// Next the media sequence number of the segment being written
+func (p *Packager) Next() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.next
+}
+
+// Wait block until the segment msn is complete, or has the part when part is not -1,
+// false if it times out or the playlist ends first
+func (p *Packager) Wait(msn int, part int, timeout time.Duration) bool {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p.Lock()
+		ready := msn < p.next || part >= 0 && p.current != nil && p.current.msn == msn && part < len(p.current.parts)
+		ended := p.ended
+		update := p.update
+		p.Unlock()
+
+		if ready {
+			return true
+		}
+		if ended {
+			return false
+		}
+
+		select {
+		case <-update:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Playlist the media playlist, query is appended to the uris
+func (p *Packager) Playlist(query string) []byte {
+
+	p.Lock()
+	defer p.Unlock()
+
+	lowLatency := p.cfg.Part > 0
+
+	target := p.cfg.Segment
+	for _, seg := range p.segments {
+		if seg.duration > target {
+			target = seg.duration
+		}
+	}
+
+	sequence := p.next
+	if len(p.segments) > 0 {
+		sequence = p.segments[0].msn
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		b.WriteString("#EXT-X-VERSION:6\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	if p.discontinuities > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discontinuities)
+	}
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * p.cfg.Part).Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", p.cfg.Part.Seconds())
+	}
+
+	for i, seg := range p.segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if lowLatency && i >= len(p.segments)-partSegments {
+			p.writeParts(&b, seg, query)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s%s\n", seg.duration.Seconds(), p.segmentURI(seg.msn), query)
+	}
+
+	// the parts of the segment being written, and the hint of its next part
+	if lowLatency && p.current != nil {
+		if p.current.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		p.writeParts(&b, p.current, query)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s%s\"\n", p.partURI(p.current.msn, len(p.current.parts)), query)
+	}
+
+	if p.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+func (p *Packager) writeParts(b *bytes.Buffer, seg *segment, query string) {
+	for i, part := range seg.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s%s\"", part.duration.Seconds(), p.partURI(seg.msn, i), query)
+		if part.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+func (p *Packager) segmentURI(msn int) string {
+	return fmt.Sprintf("%s-%d.ts", p.id, msn)
+}
+
+func (p *Packager) partURI(msn int, part int) string {
+	return fmt.Sprintf("%s-%d.%d.ts", p.id, msn, part)
+}
+
+// Lookup the msn and the part of a segment or part uri of the packager, part is -1 for a segment
+func (p *Packager) Lookup(uri string) (msn int, part int, ok bool) {
+
+	name := strings.TrimSuffix(uri, ".ts")
+	if name == uri || !strings.HasPrefix(name, p.id+"-") {
+		return 0, 0, false
+	}
+
+	fields := strings.Split(strings.TrimPrefix(name, p.id+"-"), ".")
+	if len(fields) > 2 {
+		return 0, 0, false
+	}
+
+	msn, ok = parseIndex(fields[0])
+	if !ok {
+		return 0, 0, false
+	}
+	if len(fields) == 1 {
+		return msn, -1, true
+	}
+	part, ok = parseIndex(fields[1])
+	return msn, part, ok
+}
+
+// parseIndex parse a decimal index without sign
+func parseIndex(s string) (int, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	index, err := strconv.Atoi(s)
+	return index, err == nil
+}
+
+// Segment the data of the segment in the window
+func (p *Packager) Segment(msn int) ([]byte, bool) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	for _, seg := range p.segments {
+		if seg.msn == msn {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// Part the data of the part of a segment in the window or of the segment being written
+func (p *Packager) Part(msn int, part int) ([]byte, bool) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	segments := p.segments
+	if p.current != nil {
+		segments = append(segments[:len(segments):len(segments)], p.current)
+	}
+
+	for _, seg := range segments {
+		if seg.msn == msn && part < len(seg.parts) {
+			// the written bytes are never modified, the range can be shared
+			return seg.data[seg.parts[part].start:seg.parts[part].end], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+type testH264 struct{}
+
+func (testH264) Type() av.CodecType { return av.H264 }
+func (testH264) SPS() []byte        { return []byte{0x67, 1} }
+func (testH264) PPS() []byte        { return []byte{0x68, 2} }
+
+type testAAC struct{}
+
+func (testAAC) Type() av.CodecType            { return av.AAC }
+func (testAAC) MPEG4AudioConfigBytes() []byte { return []byte{0x12, 0x10} }
+
+// writeVideo write a frame every 100ms from start to end, with a keyframe every second
+func writeVideo(t *testing.T, p *Packager, start time.Duration, end time.Duration) {
+	for ts := start; ts < end; ts += 100 * time.Millisecond {
+		packet := av.Packet{
+			Idx:        0,
+			Time:       ts,
+			IsKeyFrame: ts%time.Second == 0,
+			Data:       []byte{0, 0, 0, 2, 0x65, 3},
+		}
+		if err := p.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPackagerSegments(t *testing.T) {
+
+	p := NewPackager(Config{Segment: 2 * time.Second, Window: 3})
+	if err := p.WriteHeader([]av.CodecData{testH264{}, testAAC{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frames before the first keyframe are dropped
+	p.WritePacket(av.Packet{Idx: 0, Time: 0, Data: []byte{0, 0, 0, 2, 0x41, 4}})
+	writeVideo(t, p, 0, 9*time.Second)
+
+	// segments of 2s are cut at 2, 4, 6 and 8s, the window keeps the last 3
+	playlist := string(p.Playlist(""))
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:1\n") || strings.Count(playlist, "#EXTINF:2.000,") != 3 {
+		t.Errorf("playlist\n%s", playlist)
+	}
+	if strings.Contains(playlist, "#EXT-X-PART") || strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		t.Errorf("playlist should have no parts and no end\n%s", playlist)
+	}
+
+	if _, ok := p.Segment(0); ok {
+		t.Error("segment 0 should have slid out of the window")
+	}
+	data, ok := p.Segment(3)
+	if !ok || len(data)%tsPacketSize != 0 || data[0] != 0x47 {
+		t.Error("segment 3 should be mpeg-ts")
+	}
+	if !strings.Contains(playlist, p.segmentURI(3)+"\n") {
+		t.Errorf("playlist should list segment 3\n%s", playlist)
+	}
+
+	// a new source is a discontinuity, its timestamps start again
+	if err := p.WriteHeader([]av.CodecData{testH264{}}); err != nil {
+		t.Fatal(err)
+	}
+	writeVideo(t, p, 0, 3*time.Second)
+	p.Close()
+
+	playlist = string(p.Playlist("?vhost=example.com"))
+	if strings.Count(playlist, "#EXT-X-DISCONTINUITY\n") != 1 || !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist\n%s", playlist)
+	}
+	if !strings.Contains(playlist, p.segmentURI(5)+"?vhost=example.com\n") {
+		t.Errorf("the uris should have the query\n%s", playlist)
+	}
+}
+
+func TestPackagerParts(t *testing.T) {
+
+	p := NewPackager(Config{Segment: time.Second, Window: 3, Part: 300 * time.Millisecond})
+	if err := p.WriteHeader([]av.CodecData{testH264{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeVideo(t, p, 0, 1500*time.Millisecond)
+
+	// the first segment has 4 parts, the segment being written has its first part done
+	playlist := string(p.Playlist(""))
+	for _, line := range []string{
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.900\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.300\n",
+		"#EXT-X-PART:DURATION=0.300,URI=\"" + p.partURI(0, 0) + "\",INDEPENDENT=YES\n",
+		"#EXT-X-PART:DURATION=0.100,URI=\"" + p.partURI(0, 3) + "\"\n",
+		"#EXT-X-PART:DURATION=0.300,URI=\"" + p.partURI(1, 0) + "\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + p.partURI(1, 1) + "\"\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist should contain %q\n%s", line, playlist)
+		}
+	}
+
+	if data, ok := p.Part(1, 0); !ok || len(data) == 0 || len(data)%tsPacketSize != 0 {
+		t.Error("part 1.0 should be served")
+	}
+	if _, ok := p.Part(1, 1); ok {
+		t.Error("part 1.1 is not written yet")
+	}
+
+	if !p.Wait(1, 0, time.Millisecond) {
+		t.Error("part 1.0 is ready")
+	}
+	if p.Wait(1, 1, 10*time.Millisecond) {
+		t.Error("part 1.1 should time out")
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- p.Wait(1, 1, 5*time.Second)
+	}()
+	writeVideo(t, p, 1500*time.Millisecond, 1700*time.Millisecond)
+	if !<-done {
+		t.Error("the wait should end with part 1.1")
+	}
+}
+
+func TestPackagerLookup(t *testing.T) {
+
+	p := NewPackager(Config{Segment: time.Second, Window: 3})
+
+	if msn, part, ok := p.Lookup(p.segmentURI(12)); !ok || msn != 12 || part != -1 {
+		t.Errorf("segment uri = %d %d %v", msn, part, ok)
+	}
+	if msn, part, ok := p.Lookup(p.partURI(12, 3)); !ok || msn != 12 || part != 3 {
+		t.Errorf("part uri = %d %d %v", msn, part, ok)
+	}
+	for _, uri := range []string{"index.m3u8", "other-1.ts", p.id + "-1.ts.ts", p.id + "-+1.ts", p.id + "-1.2.3.ts", p.id + "-.ts"} {
+		if _, _, ok := p.Lookup(uri); ok {
+			t.Errorf("%s should not be found", uri)
+		}
+	}
+}
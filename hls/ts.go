@@ -0,0 +1,243 @@
+package hls
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const tsPacketSize = 188
+
+// the pids of the program, one program with one video and one audio stream
+const (
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+)
+
+const (
+	streamTypeH264 = 0x1b
+	streamTypeAAC  = 0x0f
+)
+
+// the timestamps are delayed by 700ms in 90khz, so the pcr is ahead of them
+const pcrDelay = 63000
+
+const (
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+)
+
+// tsWriter write the pat, the pmt and the pes packets as 188 bytes transport stream packets
+type tsWriter struct {
+	w        io.Writer
+	video    bool
+	audio    bool
+	counters map[uint16]byte
+	packet   [tsPacketSize]byte
+}
+
+func newTSWriter(w io.Writer, video bool, audio bool) *tsWriter {
+	return &tsWriter{w: w, video: video, audio: audio, counters: make(map[uint16]byte)}
+}
+
+// pcrPID the pcr is carried by the video, or by the audio without video
+func (t *tsWriter) pcrPID() uint16 {
+	if t.video {
+		return pidVideo
+	}
+	return pidAudio
+}
+
+// WriteTables write the pat and the pmt, each segment starts with them
+func (t *tsWriter) WriteTables() error {
+
+	pat := []byte{
+		0x00,       // table id
+		0xb0, 0x0d, // section syntax, section length
+		0x00, 0x01, // transport stream id
+		0xc1,       // version 0, current
+		0x00, 0x00, // section number, last section number
+		0x00, 0x01, // program number
+		0xe0 | pidPMT>>8, pidPMT & 0xff,
+	}
+	if err := t.writeSection(pidPAT, pat); err != nil {
+		return err
+	}
+
+	pcr := t.pcrPID()
+	pmt := []byte{
+		0x02,       // table id
+		0xb0, 0x00, // section syntax, section length is set below
+		0x00, 0x01, // program number
+		0xc1,       // version 0, current
+		0x00, 0x00, // section number, last section number
+		0xe0 | byte(pcr>>8), byte(pcr),
+		0xf0, 0x00, // program info length
+	}
+	if t.video {
+		pmt = append(pmt, streamTypeH264, 0xe0|pidVideo>>8, pidVideo&0xff, 0xf0, 0x00)
+	}
+	if t.audio {
+		pmt = append(pmt, streamTypeAAC, 0xe0|pidAudio>>8, pidAudio&0xff, 0xf0, 0x00)
+	}
+	// the section length counts the bytes after it and the crc
+	pmt[2] = byte(len(pmt) - 3 + 4)
+
+	return t.writeSection(pidPMT, pmt)
+}
+
+// writeSection write a psi section with its crc in one packet
+func (t *tsWriter) writeSection(pid uint16, section []byte) error {
+
+	section = append(section, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(section[len(section)-4:], crc32(section[:len(section)-4]))
+
+	packet := t.packet[:]
+	t.putHeader(packet, pid, true, false)
+	packet[4] = 0 // pointer field
+	n := copy(packet[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		packet[i] = 0xff
+	}
+
+	_, err := t.w.Write(packet)
+	return err
+}
+
+// WritePES write the access unit as a pes, pts and dts are in 90khz, the dts is the pcr written in the
+// first packet when pcr is true, and randomAccess marks a keyframe
+func (t *tsWriter) WritePES(pid uint16, streamID byte, pts uint64, dts uint64, data []byte, pcr bool, randomAccess bool) error {
+
+	payload := append(pesHeader(streamID, pts+pcrDelay, dts+pcrDelay, len(data)), data...)
+
+	for first := true; len(payload) > 0; first = false {
+
+		var adaptation []byte
+		if first && (pcr || randomAccess) {
+			var flags byte
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{0, flags}
+			if pcr {
+				adaptation[1] |= 0x10
+				adaptation = append(adaptation, pcrBytes(dts)...)
+			}
+		}
+
+		// the last packet is stuffed in its adaptation field
+		if space := tsPacketSize - 4 - len(adaptation); len(payload) < space {
+			stuffing := space - len(payload)
+			if adaptation == nil {
+				adaptation = []byte{0}
+				stuffing--
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xff)
+			}
+		}
+		if adaptation != nil {
+			adaptation[0] = byte(len(adaptation) - 1)
+		}
+
+		packet := t.packet[:]
+		t.putHeader(packet, pid, first, adaptation != nil)
+		copy(packet[4:], adaptation)
+		n := copy(packet[4+len(adaptation):], payload)
+		payload = payload[n:]
+
+		if _, err := t.w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putHeader put the 4 bytes packet header and step the continuity counter of the pid
+func (t *tsWriter) putHeader(packet []byte, pid uint16, start bool, adaptation bool) {
+
+	counter := t.counters[pid]
+	t.counters[pid] = (counter + 1) & 0x0f
+
+	packet[0] = 0x47
+	packet[1] = byte(pid>>8) & 0x1f
+	if start {
+		packet[1] |= 0x40
+	}
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | counter
+	if adaptation {
+		packet[3] |= 0x20
+	}
+}
+
+// pesHeader the pes header, the dts is left out when it is the pts, the length is 0 when it does not fit
+func pesHeader(streamID byte, pts uint64, dts uint64, size int) []byte {
+
+	header := []byte{0x00, 0x00, 0x01, streamID, 0, 0, 0x80, 0x80, 5}
+	if dts != pts {
+		header[7] = 0xc0
+		header[8] = 10
+		header = append(header, timestampBytes(0x03, pts)...)
+		header = append(header, timestampBytes(0x01, dts)...)
+	} else {
+		header = append(header, timestampBytes(0x02, pts)...)
+	}
+
+	if length := len(header) - 6 + size; length <= 0xffff {
+		binary.BigEndian.PutUint16(header[4:], uint16(length))
+	}
+	return header
+}
+
+// timestampBytes the 33 bits timestamp with its 4 bits prefix and the marker bits
+func timestampBytes(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 1,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 1,
+	}
+}
+
+// pcrBytes the pcr of the 90khz timestamp, the extension is 0
+func pcrBytes(ts uint64) []byte {
+	return []byte{
+		byte(ts >> 25),
+		byte(ts >> 17),
+		byte(ts >> 9),
+		byte(ts >> 1),
+		byte(ts<<7)&0x80 | 0x7e,
+		0x00,
+	}
+}
+
+var crcTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+// crc32 the mpeg-2 crc of the psi sections
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,107 @@
+package hls
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+
+	var buf bytes.Buffer
+	if err := newTSWriter(&buf, true, true).WriteTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if len(data) != 2*tsPacketSize {
+		t.Fatalf("the tables should be 2 packets, got %d bytes", len(data))
+	}
+
+	// the pat of one program with the pmt on 0x1000, as ffmpeg writes it
+	pat := []byte{0x47, 0x40, 0x00, 0x10, 0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0x2a, 0xb1, 0x04, 0xb2}
+	if !bytes.Equal(data[:len(pat)], pat) || data[len(pat)] != 0xff {
+		t.Errorf("pat % x", data[:len(pat)])
+	}
+
+	pmt := data[tsPacketSize:]
+	if pmt[1] != 0x50 || pmt[2] != 0x00 || pmt[5] != 0x02 {
+		t.Errorf("pmt header % x", pmt[:6])
+	}
+	// the section with its crc has a crc of 0
+	length := int(pmt[6]&0x0f)<<8 | int(pmt[7])
+	if crc32(pmt[5:8+length]) != 0 {
+		t.Error("pmt crc is wrong")
+	}
+	if pmt[17] != streamTypeH264 || pmt[22] != streamTypeAAC {
+		t.Errorf("pmt streams % x", pmt[17:27])
+	}
+}
+
+func TestPES(t *testing.T) {
+
+	var buf bytes.Buffer
+	writer := newTSWriter(&buf, true, false)
+
+	data := bytes.Repeat([]byte{0xaa}, 400)
+	if err := writer.WritePES(pidVideo, streamIDVideo, 3600, 0, data, true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := buf.Bytes()
+	if len(packets) != 3*tsPacketSize {
+		t.Fatalf("400 bytes should be 3 packets, got %d bytes", len(packets))
+	}
+
+	for i := 0; i < 3; i++ {
+		packet := packets[i*tsPacketSize:]
+		if packet[0] != 0x47 || packet[3]&0x0f != byte(i) {
+			t.Errorf("packet %d header % x", i, packet[:4])
+		}
+	}
+
+	first := packets[:tsPacketSize]
+	// payload start, adaptation field with random access and pcr
+	if first[1] != 0x41 || first[3]&0x30 != 0x30 || first[5] != 0x50 {
+		t.Errorf("first packet % x", first[:6])
+	}
+	pes := first[5+int(first[4]):]
+	if !bytes.Equal(pes[:4], []byte{0, 0, 1, streamIDVideo}) || pes[7] != 0xc0 || pes[8] != 10 {
+		t.Errorf("pes header % x", pes[:9])
+	}
+
+	// the pts and the dts are delayed, the pcr is not
+	if got := readTimestamp(pes[9:]); got != 3600+pcrDelay {
+		t.Errorf("pts %d", got)
+	}
+	if got := readTimestamp(pes[14:]); got != pcrDelay {
+		t.Errorf("dts %d", got)
+	}
+
+	// the last packet ends with the payload, after the stuffing
+	last := packets[2*tsPacketSize:]
+	if last[3]&0x30 != 0x30 || last[len(last)-1] != 0xaa {
+		t.Errorf("last packet % x", last[:8])
+	}
+}
+
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+func TestAnnexB(t *testing.T) {
+
+	sps, pps := []byte{0x67, 1}, []byte{0x68, 2}
+	avcc := []byte{0, 0, 0, 2, 0x65, 3}
+
+	got := annexB(avcc, sps, pps, true)
+	want := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65, 3}
+	if !bytes.Equal(got, want) {
+		t.Errorf("keyframe % x", got)
+	}
+
+	got = annexB([]byte{0, 0, 0, 2, 0x41, 4}, sps, pps, false)
+	want = []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x41, 4}
+	if !bytes.Equal(got, want) {
+		t.Errorf("frame % x", got)
+	}
+}
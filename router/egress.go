@@ -0,0 +1,537 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/codec"
+	"github.com/notedit/rtclive/transcoder"
+	"github.com/notedit/rtmp-lib/aac"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/h264"
+)
+
+// egress target states
+const (
+	EgressConnecting = "connecting"
+	EgressRunning    = "running"
+	EgressRetrying   = "retrying"
+	EgressStopped    = "stopped"
+)
+
+const (
+	// packets buffered for a slow target, more are dropped
+	egressQueueSize = 512
+
+	egressRetryBackoff = time.Second
+	egressMaxBackoff   = 30 * time.Second
+	// a push longer than this resets the backoff
+	egressStableRun = 30 * time.Second
+)
+
+// ErrNoTracks the publisher has no track to push
+var ErrNoTracks = errors.New("publisher has no tracks")
+
+// EgressTarget is where the egress pushes the stream, a rtmp connection or a local channel
+type EgressTarget interface {
+	WriteHeader(streams []av.CodecData) error
+	WritePacket(packet av.Packet) error
+	WriteTrailer() error
+	Close() error
+}
+
+// EgressTargetStatus the state of a target
+type EgressTargetStatus struct {
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	Packets uint64 `json:"packets"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// EgressStatus the state of an egress and its targets
+type EgressStatus struct {
+	ID      string                `json:"id"`
+	Video   bool                  `json:"video"`
+	Audio   bool                  `json:"audio"`
+	Started bool                  `json:"started"`
+	Uptime  int64                 `json:"uptime"`
+	Targets []*EgressTargetStatus `json:"targets"`
+}
+
+// Egress push the tracks of a webrtc publisher to rtmp targets,
+// h264 is remuxed as is and opus is transcoded to aac
+type Egress struct {
+	id         string
+	publisher  Publisher
+	targets    []*egressTarget
+	videoTrack *mediaserver.IncomingStreamTrack
+	audioTrack *mediaserver.IncomingStreamTrack
+	audio      transcoder.Transcoder
+	created    time.Time
+
+	sync.Mutex
+	streams      []av.CodecData
+	videoIdx     int8
+	audioIdx     int8
+	hasVideo     bool
+	hasAudio     bool
+	sps          []byte
+	pps          []byte
+	videoBase    uint32
+	videoStarted bool
+	audioBase    uint32
+	audioStarted bool
+	stopped      bool
+}
+
+type egressTarget struct {
+	name    string
+	dial    func() (EgressTarget, error)
+	packets chan av.Packet
+	stop    chan struct{}
+
+	sync.Mutex
+	streams []av.CodecData
+	header  int
+	state   string
+	err     error
+	written uint64
+	dropped uint64
+}
+
+// NewEgress create the egress of the publisher, the targets are added before it starts
+func NewEgress(id string, publisher Publisher) *Egress {
+	return &Egress{
+		id:        id,
+		publisher: publisher,
+		created:   time.Now(),
+	}
+}
+
+// GetID get egress id
+func (e *Egress) GetID() string {
+	return e.id
+}
+
+// GetPublisher the publisher the egress pushes
+func (e *Egress) GetPublisher() Publisher {
+	return e.publisher
+}
+
+// AddTarget add a target, dial is called once the stream header is known and again after a failure
+func (e *Egress) AddTarget(name string, dial func() (EgressTarget, error)) {
+	e.targets = append(e.targets, &egressTarget{
+		name:    name,
+		dial:    dial,
+		packets: make(chan av.Packet, egressQueueSize),
+		stop:    make(chan struct{}),
+		state:   EgressConnecting,
+	})
+}
+
+// Start listen to the media frames of the publisher tracks
+func (e *Egress) Start() error {
+
+	videoTrack := e.publisher.GetVideoTrack()
+	audioTrack := e.publisher.GetAudioTrack()
+
+	if videoTrack == nil && audioTrack == nil {
+		return ErrNoTracks
+	}
+
+	if audioTrack != nil {
+		audio, err := transcoder.NewOpusToAAC()
+		if err != nil {
+			return err
+		}
+		e.audio = audio
+		e.hasAudio = true
+	}
+	e.hasVideo = videoTrack != nil
+
+	// without video the header is known at once
+	if !e.hasVideo {
+		e.Lock()
+		e.writeHeader()
+		e.Unlock()
+	}
+
+	if videoTrack != nil {
+		e.videoTrack = videoTrack
+		videoTrack.OnMediaFrame(e.onVideoFrame)
+	}
+
+	if audioTrack != nil {
+		e.audioTrack = audioTrack
+		audioTrack.OnMediaFrame(e.onAudioFrame)
+		go e.readAudio()
+	}
+
+	return nil
+}
+
+// writeHeader start the targets once the codecs are known and give them the new header when the sps changes,
+// must be called with the lock held
+func (e *Egress) writeHeader() {
+
+	var streams []av.CodecData
+
+	if e.hasVideo {
+		video, err := h264.NewCodecDataFromSPSAndPPS(e.sps, e.pps)
+		if err != nil {
+			fmt.Printf("egress %s can not parse sps %s\n", e.id, err)
+			return
+		}
+		e.videoIdx = int8(len(streams))
+		streams = append(streams, video)
+	}
+
+	if e.hasAudio {
+		audio, err := aac.NewCodecDataFromMPEG4AudioConfigBytes(transcoder.OpusToAACConfig)
+		if err != nil {
+			fmt.Printf("egress %s can not create aac config %s\n", e.id, err)
+			return
+		}
+		e.audioIdx = int8(len(streams))
+		streams = append(streams, audio)
+	}
+
+	started := e.streams != nil
+	e.streams = streams
+
+	for _, target := range e.targets {
+		target.setHeader(streams)
+		if !started {
+			go target.run()
+		}
+	}
+}
+
+func (e *Egress) onVideoFrame(frame []byte, timestamp uint) {
+
+	var nalus [][]byte
+	var sps, pps []byte
+	keyframe := false
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.stopped {
+		return
+	}
+
+	for _, nalu := range codec.SplitH264(frame) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			sps = nalu
+		case naluTypePPS:
+			pps = nalu
+		case naluTypeIDR:
+			keyframe = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+
+	// the sps and pps of a keyframe may change the resolution
+	changed := false
+	if sps != nil && (e.sps == nil || keyframe) && !bytes.Equal(sps, e.sps) {
+		e.sps = append([]byte(nil), sps...)
+		changed = true
+	}
+	if pps != nil && (e.pps == nil || keyframe) && !bytes.Equal(pps, e.pps) {
+		e.pps = append([]byte(nil), pps...)
+		changed = true
+	}
+
+	if e.streams == nil {
+		// the stream starts at a keyframe with its sps and pps
+		if !keyframe || e.sps == nil || e.pps == nil {
+			return
+		}
+		e.writeHeader()
+		if e.streams == nil {
+			return
+		}
+	} else if changed {
+		e.writeHeader()
+	}
+
+	if len(nalus) == 0 {
+		return
+	}
+
+	if !e.videoStarted {
+		e.videoStarted = true
+		e.videoBase = uint32(timestamp)
+	}
+
+	e.writePacket(av.Packet{
+		IsKeyFrame: keyframe,
+		Idx:        e.videoIdx,
+		Time:       time.Duration(uint32(timestamp)-e.videoBase) * time.Second / 90000,
+		Data:       joinAVCC(nalus),
+	})
+}
+
+func (e *Egress) onAudioFrame(frame []byte, timestamp uint) {
+
+	e.Lock()
+	if e.stopped || e.streams == nil {
+		e.Unlock()
+		return
+	}
+	if !e.audioStarted {
+		e.audioStarted = true
+		e.audioBase = uint32(timestamp)
+	}
+	packet := av.Packet{
+		Idx:  e.audioIdx,
+		Time: time.Duration(uint32(timestamp)-e.audioBase) * time.Second / 48000,
+		Data: append([]byte(nil), frame...),
+	}
+	e.Unlock()
+
+	e.audio.WritePacket(packet)
+}
+
+// readAudio push the aac frames until the transcoder is closed
+func (e *Egress) readAudio() {
+
+	for {
+		frame, err := e.audio.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("egress %s audio transcoder error %s\n", e.id, err)
+			}
+			return
+		}
+
+		e.Lock()
+		if !e.stopped {
+			e.writePacket(av.Packet{
+				Idx:  e.audioIdx,
+				Time: frame.Time,
+				Data: frame.Data,
+			})
+		}
+		e.Unlock()
+	}
+}
+
+// writePacket queue the packet to the targets, must be called with the lock held
+func (e *Egress) writePacket(packet av.Packet) {
+	for _, target := range e.targets {
+		target.write(packet)
+	}
+}
+
+// Status the state of the egress and its targets
+func (e *Egress) Status() *EgressStatus {
+
+	e.Lock()
+	status := &EgressStatus{
+		ID:      e.id,
+		Video:   e.hasVideo,
+		Audio:   e.hasAudio,
+		Started: e.streams != nil,
+		Uptime:  int64(time.Since(e.created) / time.Second),
+	}
+	e.Unlock()
+
+	for _, target := range e.targets {
+		status.Targets = append(status.Targets, target.status())
+	}
+
+	return status
+}
+
+// Stop stop pushing to the targets
+func (e *Egress) Stop() {
+
+	e.Lock()
+	if e.stopped {
+		e.Unlock()
+		return
+	}
+	e.stopped = true
+	started := e.streams != nil
+	e.Unlock()
+
+	// the publisher may go on without the egress
+	if e.videoTrack != nil {
+		e.videoTrack.OnMediaFrame(nil)
+	}
+	if e.audioTrack != nil {
+		e.audioTrack.OnMediaFrame(nil)
+	}
+
+	if e.audio != nil {
+		// Stop is called from the stream events, they do not wait for the transcoder
+		go e.audio.Close()
+	}
+
+	for _, target := range e.targets {
+		// the targets are not dialed before the header is known
+		if !started {
+			target.setState(EgressStopped, nil)
+		}
+		close(target.stop)
+	}
+}
+
+func (t *egressTarget) write(packet av.Packet) {
+
+	select {
+	case t.packets <- packet:
+	default:
+		t.Lock()
+		t.dropped++
+		t.Unlock()
+	}
+}
+
+// setHeader the header of the next connection, a running one writes it before its next keyframe
+func (t *egressTarget) setHeader(streams []av.CodecData) {
+
+	t.Lock()
+	t.streams = streams
+	t.header++
+	t.Unlock()
+}
+
+func (t *egressTarget) getHeader() ([]av.CodecData, int) {
+
+	t.Lock()
+	defer t.Unlock()
+	return t.streams, t.header
+}
+
+func (t *egressTarget) run() {
+
+	backoff := egressRetryBackoff
+
+	for {
+		started := time.Now()
+		stopped, err := t.push()
+
+		if stopped {
+			t.setState(EgressStopped, nil)
+			return
+		}
+
+		if time.Since(started) > egressStableRun {
+			backoff = egressRetryBackoff
+		}
+
+		fmt.Printf("egress target %s error %s, reconnect in %s\n", t.name, err, backoff)
+		t.setState(EgressRetrying, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-t.stop:
+			t.setState(EgressStopped, nil)
+			return
+		}
+
+		backoff *= 2
+		if backoff > egressMaxBackoff {
+			backoff = egressMaxBackoff
+		}
+	}
+}
+
+// push the packets until the target fails, stopped is true once the egress is stopped
+func (t *egressTarget) push() (stopped bool, err error) {
+
+	t.setState(EgressConnecting, nil)
+
+	muxer, err := t.dial()
+	if err != nil {
+		return false, err
+	}
+	defer muxer.Close()
+
+	streams, header := t.getHeader()
+	if err := muxer.WriteHeader(streams); err != nil {
+		return false, err
+	}
+
+	t.setState(EgressRunning, nil)
+
+	// a new connection starts at a keyframe
+	waitKeyframe := false
+	for _, stream := range streams {
+		if stream.Type().IsVideo() {
+			waitKeyframe = true
+		}
+	}
+
+	for {
+		select {
+		case packet := <-t.packets:
+			if waitKeyframe && !packet.IsKeyFrame {
+				continue
+			}
+			waitKeyframe = false
+
+			if packet.IsKeyFrame {
+				if latest, current := t.getHeader(); current != header {
+					if err := muxer.WriteHeader(latest); err != nil {
+						return false, err
+					}
+					header = current
+				}
+			}
+
+			if err := muxer.WritePacket(packet); err != nil {
+				return false, err
+			}
+			t.Lock()
+			t.written++
+			t.Unlock()
+		case <-t.stop:
+			muxer.WriteTrailer()
+			return true, nil
+		}
+	}
+}
+
+func (t *egressTarget) setState(state string, err error) {
+
+	t.Lock()
+	defer t.Unlock()
+	t.state = state
+	t.err = err
+
+	if err != nil && state != EgressRetrying {
+		fmt.Printf("egress target %s %s: %s\n", t.name, state, err)
+	}
+}
+
+func (t *egressTarget) status() *EgressTargetStatus {
+
+	t.Lock()
+	defer t.Unlock()
+
+	status := &EgressTargetStatus{
+		Name:    t.name,
+		State:   t.state,
+		Packets: t.written,
+		Dropped: t.dropped,
+	}
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+type testCodec struct {
+	typ av.CodecType
+}
+
+func (c testCodec) Type() av.CodecType {
+	return c.typ
+}
+
+type testEgressTarget struct {
+	sync.Mutex
+	headers int
+	packets []av.Packet
+}
+
+func (t *testEgressTarget) WriteHeader(streams []av.CodecData) error {
+	t.Lock()
+	t.headers++
+	t.Unlock()
+	return nil
+}
+
+func (t *testEgressTarget) WritePacket(packet av.Packet) error {
+	t.Lock()
+	t.packets = append(t.packets, packet)
+	t.Unlock()
+	return nil
+}
+
+func (t *testEgressTarget) WriteTrailer() error { return nil }
+
+func (t *testEgressTarget) Close() error { return nil }
+
+func (t *testEgressTarget) counts() (int, int) {
+	t.Lock()
+	defer t.Unlock()
+	return t.headers, len(t.packets)
+}
+
+func waitEgress(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEgressTargetRetry(t *testing.T) {
+
+	muxer := &testEgressTarget{}
+	dials := 0
+
+	egress := NewEgress("test", nil)
+	egress.AddTarget("test", func() (EgressTarget, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("refused")
+		}
+		return muxer, nil
+	})
+	target := egress.targets[0]
+
+	streams := []av.CodecData{testCodec{av.H264}}
+	target.setHeader(streams)
+	go target.run()
+
+	waitEgress(t, "retrying", func() bool { return target.status().State == EgressRetrying })
+	if target.status().Error != "refused" {
+		t.Errorf("the status should have the error, got %q", target.status().Error)
+	}
+
+	waitEgress(t, "running", func() bool { return target.status().State == EgressRunning })
+
+	// the reconnect starts at a keyframe
+	target.write(av.Packet{Data: []byte{1}})
+	target.write(av.Packet{IsKeyFrame: true, Data: []byte{2}})
+	waitEgress(t, "keyframe", func() bool { _, packets := muxer.counts(); return packets == 1 })
+
+	// a new sps gets a new header before the next keyframe
+	target.setHeader(streams)
+	target.write(av.Packet{Data: []byte{3}})
+	waitEgress(t, "packet", func() bool { _, packets := muxer.counts(); return packets == 2 })
+	if headers, _ := muxer.counts(); headers != 1 {
+		t.Errorf("the header should wait for a keyframe, got %d headers", headers)
+	}
+
+	target.write(av.Packet{IsKeyFrame: true, Data: []byte{4}})
+	waitEgress(t, "header", func() bool { headers, packets := muxer.counts(); return headers == 2 && packets == 3 })
+
+	egress.Stop()
+	waitEgress(t, "stopped", func() bool { return target.status().State == EgressStopped })
+}
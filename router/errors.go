@@ -0,0 +1,21 @@
+package router
+
+import "errors"
+
+var (
+	// ErrNoStream the sdp does not have any stream to publish
+	ErrNoStream = errors.New("can not find stream info in sdp")
+	// ErrNoMedia no audio or video can be negotiated with the capabilities
+	ErrNoMedia = errors.New("can not negotiate audio or video")
+	// ErrNoPublisher the router does not have a publisher to subscribe
+	ErrNoPublisher = errors.New("can not find publisher")
+)
+
+// SdpError is returned when the sdp can not be parsed
+type SdpError struct {
+	Err error
+}
+
+func (e *SdpError) Error() string {
+	return "can not parse sdp: " + e.Err.Error()
+}
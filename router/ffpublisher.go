@@ -1,11 +1,14 @@
 package router
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/notedit/sdp"
 
@@ -18,15 +21,108 @@ ffmpeg -fflags nobuffer -i rtmp://ali.wangxiao.eaydu.com/live_bak/x_100_rtc_test
 -acodec libopus -vn -ar 48000 -ac 2 -f rtp -payload_type 96 rtp://127.0.0.1:5002
 */
 
+var ffmpegPath = "ffmpeg"
+
+const (
+	ffRestartBackoff    = 500 * time.Millisecond
+	ffMaxRestartBackoff = 30 * time.Second
+	// a run longer than this resets the backoff and the restart count
+	ffStableRun   = 30 * time.Second
+	ffStderrLines = 20
+)
+
+// Pipeline is how ffmpeg pulls the stream into the rtp sessions
+type Pipeline struct {
+	// Input the flags before -i
+	Input          []string
+	Video          bool
+	VideoTranscode bool
+	Bitrate        string
+	Preset         string
+	Bsfs           []string
+	Audio          bool
+	AudioTranscode bool
+	// SourceAudio the probed audio codec of the source, the audio is only copied when it is opus
+	SourceAudio string
+}
+
+// DefaultPipeline copy h264 and transcode audio to opus
+func DefaultPipeline() *Pipeline {
+	return &Pipeline{
+		Input:          []string{"-fflags", "nobuffer"},
+		Video:          true,
+		Bsfs:           []string{"h264_mp4toannexb"},
+		Audio:          true,
+		AudioTranscode: true,
+	}
+}
+
+// args the ffmpeg args which send rtp to the local ports
+func (p *Pipeline) args(streamURL string, videoPt int, videoPort int, audioPt int, audioPort int) []string {
+
+	args := append([]string{}, p.Input...)
+	args = append(args, "-i", streamURL)
+
+	if p.Video {
+		if p.VideoTranscode {
+			args = append(args, "-vcodec", "libx264", "-tune", "zerolatency", "-pix_fmt", "yuv420p", "-bf", "0")
+			if p.Preset != "" {
+				args = append(args, "-preset", p.Preset)
+			}
+			if p.Bitrate != "" {
+				args = append(args, "-b:v", p.Bitrate)
+			}
+		} else {
+			args = append(args, "-vcodec", "copy")
+		}
+		args = append(args, "-an")
+		if len(p.Bsfs) > 0 {
+			args = append(args, "-bsf:v", strings.Join(p.Bsfs, ","))
+		}
+		args = append(args,
+			"-f", "rtp",
+			"-payload_type", strconv.Itoa(videoPt),
+			"rtp://127.0.0.1:"+strconv.Itoa(videoPort))
+	}
+
+	if p.Audio {
+		// any other audio would be sent with the opus payload type
+		if p.AudioTranscode || p.SourceAudio != "opus" {
+			args = append(args, "-acodec", "libopus", "-vn", "-ar", "48000", "-ac", "2")
+		} else {
+			args = append(args, "-acodec", "copy", "-vn")
+		}
+		args = append(args,
+			"-f", "rtp",
+			"-payload_type", strconv.Itoa(audioPt),
+			"rtp://127.0.0.1:"+strconv.Itoa(audioPort))
+	}
+
+	return args
+}
+
 // FFPublisher publisher
 type FFPublisher struct {
 	id           string
 	streamURL    string
-	command      *exec.Cmd
-	stdStdinPipe io.WriteCloser
+	pipeline     *Pipeline
+	args         []string
 	videoSession *mediaserver.StreamerSession
 	audioSession *mediaserver.StreamerSession
 	capabilities map[string]*sdp.Capability
+
+	probe       func() *Probe
+	maxRestarts int
+	canRestart  func() bool
+	onRestart   func(err error)
+	stopTimeout time.Duration
+
+	sync.Mutex
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	exited  chan struct{}
+	stopped bool
+	stop    chan struct{}
 }
 
 // NewFFPublisher  new ffmpeg publisher
@@ -36,67 +132,198 @@ func NewFFPublisher(streamID string, streamURL string, capabilities map[string]*
 	publisher.id = streamID
 	publisher.capabilities = capabilities
 	publisher.streamURL = streamURL
+	publisher.pipeline = DefaultPipeline()
+	publisher.stopTimeout = 5 * time.Second
+	publisher.stop = make(chan struct{})
 
 	return publisher
 }
 
-// Start start the pipeline
+// SetPipeline set the ffmpeg pipeline, it must be called before Start
+func (p *FFPublisher) SetPipeline(pipeline *Pipeline) {
+	p.pipeline = pipeline
+}
+
+// SetProbe probe the source in Start, the pipeline is adapted to the probe when it is not nil
+// and the tracks the source does not have are not created
+func (p *FFPublisher) SetProbe(probe func() *Probe) {
+	p.probe = probe
+}
+
+// SetRestart restart ffmpeg up to maxRestarts times in a row while canRestart returns true,
+// onRestart is called before each restart
+func (p *FFPublisher) SetRestart(maxRestarts int, canRestart func() bool, onRestart func(err error)) {
+	p.maxRestarts = maxRestarts
+	p.canRestart = canRestart
+	p.onRestart = onRestart
+}
+
+// SetStopTimeout how long Stop waits for ffmpeg to quit before SIGTERM, and before SIGKILL after that
+func (p *FFPublisher) SetStopTimeout(timeout time.Duration) {
+	p.stopTimeout = timeout
+}
+
+// Start probe the source and start the pipeline, ffmpeg is restarted on the same sessions when it fails,
+// done gets the error once it is not restarted any more
 func (p *FFPublisher) Start() <-chan error {
 
 	done := make(chan error, 1)
 
-	videoMediaInfo := sdp.MediaInfoCreate("video", p.capabilities["video"])
-	videoPt := videoMediaInfo.GetCodec("h264").GetType()
-	p.videoSession = mediaserver.NewStreamerSession(videoMediaInfo)
+	pipeline := *p.pipeline
 
-	audioMediaInfo := sdp.MediaInfoCreate("audio", p.capabilities["audio"])
-	audioPt := audioMediaInfo.GetCodec("opus").GetType()
-	p.audioSession = mediaserver.NewStreamerSession(audioMediaInfo)
+	// the sessions are created once the source is known, so the subscribers never get a track without media
+	if p.probe != nil {
+		if probe := p.probe(); probe != nil {
+			pipeline = *pipeline.Adapt(probe)
+		}
+	}
+
+	var videoPt, videoPort, audioPt, audioPort int
+
+	videoMediaInfo, videoCodec := mediaCodec("video", "h264", p.capabilities)
+	audioMediaInfo, audioCodec := mediaCodec("audio", "opus", p.capabilities)
+
+	video := pipeline.Video && videoCodec != nil
+	audio := pipeline.Audio && audioCodec != nil
+
+	if pipeline.Video && !video {
+		fmt.Printf("capability has no h264, drop the video of %s\n", p.id)
+	}
+
+	if pipeline.Audio && !audio {
+		fmt.Printf("capability has no opus, drop the audio of %s\n", p.id)
+	}
+
+	if !video && !audio {
+		done <- ErrNoMedia
+		close(done)
+		return done
+	}
+
+	if video {
+		videoPt = videoCodec.GetType()
+		p.videoSession = mediaserver.NewStreamerSession(videoMediaInfo)
+		videoPort = p.videoSession.GetLocalPort()
+	}
 
-	command := []string{
-		"-i", p.streamURL,
-		"-fflags", "nobuffer",
-		"-vcodec", "copy", "-an", "-bsf:v", "h264_mp4toannexb",
-		"-f", "rtp",
-		"-payload_type", strconv.Itoa(videoPt),
-		"rtp://127.0.0.1:" + strconv.Itoa(p.videoSession.GetLocalPort()),
-		"-acodec", "libopus",
-		"-vn", "-ar", "48000", "-ac", "2",
-		"-f", "rtp",
-		"-payload_type", strconv.Itoa(audioPt),
-		"rtp://127.0.0.1:" + strconv.Itoa(p.audioSession.GetLocalPort()),
+	if audio {
+		audioPt = audioCodec.GetType()
+		p.audioSession = mediaserver.NewStreamerSession(audioMediaInfo)
+		audioPort = p.audioSession.GetLocalPort()
 	}
 
-	p.command = exec.Command("ffmpeg", command...)
+	pipeline.Video = video
+	pipeline.Audio = audio
+	p.pipeline = &pipeline
+	p.args = pipeline.args(p.streamURL, videoPt, videoPort, audioPt, audioPort)
 
-	out := &bytes.Buffer{}
+	go p.supervise(done)
 
-	p.command.Stdout = out
+	return done
+}
 
-	stdin, err := p.command.StdinPipe()
-	if nil != err {
-		fmt.Println("Stdin not available: " + err.Error())
+// mediaCodec the media info of the capability and its codec, nil codec if the capability does not have it
+func mediaCodec(media string, codec string, capabilities map[string]*sdp.Capability) (*sdp.MediaInfo, *sdp.CodecInfo) {
+
+	capability := capabilities[media]
+	if capability == nil {
+		return nil, nil
 	}
 
-	p.stdStdinPipe = stdin
+	mediaInfo := sdp.MediaInfoCreate(media, capability)
+	return mediaInfo, mediaInfo.GetCodec(codec)
+}
+
+func (p *FFPublisher) supervise(done chan error) {
+
+	defer close(done)
+
+	backoff := ffRestartBackoff
+	restarts := 0
 
-	err = p.command.Start()
+	for {
+		started := time.Now()
+		err := p.run()
 
-	go func(err error, out *bytes.Buffer) {
-		if err != nil {
-			done <- fmt.Errorf("Failed Start FFMPEG with %s, message %s", err, out.String())
-			close(done)
+		if err == nil || p.isStopped() {
+			done <- nil
 			return
 		}
-		err = p.command.Wait()
-		if err != nil {
-			err = fmt.Errorf("Failed Finish FFMPEG with %s, message %s", err, out.String())
+
+		if time.Since(started) > ffStableRun {
+			restarts = 0
+			backoff = ffRestartBackoff
 		}
-		done <- err
-		close(done)
-	}(err, out)
 
-	return done
+		if restarts >= p.maxRestarts || (p.canRestart != nil && !p.canRestart()) {
+			done <- err
+			return
+		}
+		restarts++
+
+		fmt.Printf("ffmpeg of %s failed: %s, restart in %s\n", p.id, err, backoff)
+
+		if p.onRestart != nil {
+			p.onRestart(err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			done <- nil
+			return
+		}
+
+		backoff *= 2
+		if backoff > ffMaxRestartBackoff {
+			backoff = ffMaxRestartBackoff
+		}
+	}
+}
+
+// run ffmpeg once and wait for it to exit
+func (p *FFPublisher) run() error {
+
+	command := exec.Command(ffmpegPath, p.args...)
+
+	stderr := newStderrTail(ffStderrLines)
+	command.Stderr = stderr
+
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Stdin not available: %s", err)
+	}
+
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		stdin.Close()
+		return nil
+	}
+	if err := command.Start(); err != nil {
+		p.Unlock()
+		stdin.Close()
+		return fmt.Errorf("Failed Start FFMPEG with %s", err)
+	}
+	exited := make(chan struct{})
+	p.command = command
+	p.stdin = stdin
+	p.exited = exited
+	p.Unlock()
+
+	err = command.Wait()
+	close(exited)
+
+	if err != nil {
+		return fmt.Errorf("Failed Finish FFMPEG with %s, message %s", err, parseFFmpegError(stderr.Lines()))
+	}
+	return nil
+}
+
+func (p *FFPublisher) isStopped() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.stopped
 }
 
 // GetID  get publisher id
@@ -127,9 +354,21 @@ func (p *FFPublisher) GetAudioTrack() *mediaserver.IncomingStreamTrack {
 	return nil
 }
 
-// Stop  stop this publisher
+// Stop  stop this publisher, ffmpeg is asked to quit and killed if it does not
 func (p *FFPublisher) Stop() {
 
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.stop)
+	command := p.command
+	stdin := p.stdin
+	exited := p.exited
+	p.Unlock()
+
 	if p.audioSession != nil {
 		p.audioSession.Stop()
 	}
@@ -138,10 +377,98 @@ func (p *FFPublisher) Stop() {
 		p.videoSession.Stop()
 	}
 
-	if p.command != nil {
-		stdin := p.stdStdinPipe
-		if stdin != nil {
-			stdin.Write([]byte("q\n"))
+	if command != nil {
+		stdin.Write([]byte("q\n"))
+		go p.terminate(command, exited)
+	}
+}
+
+// terminate escalate to SIGTERM and then SIGKILL if ffmpeg does not quit
+func (p *FFPublisher) terminate(command *exec.Cmd, exited chan struct{}) {
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(p.stopTimeout):
+	}
+
+	fmt.Printf("ffmpeg of %s does not quit, terminate it\n", p.id)
+	command.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(p.stopTimeout):
+	}
+
+	fmt.Printf("ffmpeg of %s does not terminate, kill it\n", p.id)
+	command.Process.Kill()
+}
+
+// stderrTail keep the last lines ffmpeg writes to stderr
+type stderrTail struct {
+	sync.Mutex
+	lines   []string
+	partial []byte
+	max     int
+}
+
+func newStderrTail(max int) *stderrTail {
+	return &stderrTail{max: max}
+}
+
+func (t *stderrTail) Write(data []byte) (int, error) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	for _, b := range data {
+		// ffmpeg rewrites its progress line with \r
+		if b != '\n' && b != '\r' {
+			t.partial = append(t.partial, b)
+			continue
+		}
+		if len(t.partial) == 0 {
+			continue
+		}
+		t.lines = append(t.lines, string(t.partial))
+		t.partial = t.partial[:0]
+		if len(t.lines) > t.max {
+			t.lines = t.lines[len(t.lines)-t.max:]
 		}
 	}
+	return len(data), nil
+}
+
+// Lines the last lines, with the unterminated one
+func (t *stderrTail) Lines() []string {
+
+	t.Lock()
+	defer t.Unlock()
+
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
+
+var ffErrorKeywords = []string{"error", "failed", "invalid", "refused", "not found", "denied", "timed out", "no such", "unable"}
+
+// parseFFmpegError find the line explaining why ffmpeg exited, the last line if none matches
+func parseFFmpegError(lines []string) string {
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.ToLower(lines[i])
+		for _, keyword := range ffErrorKeywords {
+			if strings.Contains(line, keyword) {
+				return strings.TrimSpace(lines[i])
+			}
+		}
+	}
+
+	if len(lines) > 0 {
+		return strings.TrimSpace(lines[len(lines)-1])
+	}
+	return ""
 }
@@ -0,0 +1,207 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/sdp"
+)
+
+func TestStderrTail(t *testing.T) {
+
+	tail := newStderrTail(2)
+	tail.Write([]byte("line 1\nline 2\nframe=1\rframe=2\rline 3\npartial"))
+
+	lines := tail.Lines()
+	if strings.Join(lines, "|") != "frame=2|line 3|partial" {
+		t.Errorf("wrong lines %q", lines)
+	}
+}
+
+func TestParseFFmpegError(t *testing.T) {
+
+	lines := []string{
+		"Input #0, flv, from 'rtmp://127.0.0.1/live/test':",
+		"[tcp @ 0x7f] Connection to tcp://127.0.0.1:1935 failed: Connection refused",
+		"Exiting normally, received signal 2.",
+	}
+
+	if msg := parseFFmpegError(lines); msg != lines[1] {
+		t.Errorf("should find the error line, got %q", msg)
+	}
+
+	if msg := parseFFmpegError([]string{"last line"}); msg != "last line" {
+		t.Errorf("should fall back to the last line, got %q", msg)
+	}
+
+	if msg := parseFFmpegError(nil); msg != "" {
+		t.Errorf("no lines should be empty, got %q", msg)
+	}
+}
+
+func fakeFFmpeg(t *testing.T, script string) func() {
+
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := ffmpegPath
+	ffmpegPath = path
+	return func() {
+		ffmpegPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFFPublisherRestart(t *testing.T) {
+
+	defer fakeFFmpeg(t, "echo 'Server returned 404 Not Found' >&2; exit 1")()
+
+	publisher := NewFFPublisher("test", "rtmp://127.0.0.1/live/test", nil)
+
+	var restartErrs []error
+	publisher.SetRestart(2, func() bool { return true }, func(err error) {
+		restartErrs = append(restartErrs, err)
+	})
+
+	done := make(chan error, 1)
+	go publisher.supervise(done)
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "Server returned 404 Not Found") {
+			t.Errorf("should fail with the stderr message, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor should give up")
+	}
+
+	if len(restartErrs) != 2 {
+		t.Errorf("should restart twice, got %d", len(restartErrs))
+	}
+}
+
+func TestFFPublisherNoRestart(t *testing.T) {
+
+	defer fakeFFmpeg(t, "exit 1")()
+
+	publisher := NewFFPublisher("test", "rtmp://127.0.0.1/live/test", nil)
+	publisher.SetRestart(5, func() bool { return false }, func(err error) {
+		t.Error("should not restart without subscribers")
+	})
+
+	done := make(chan error, 1)
+	go publisher.supervise(done)
+
+	if err := <-done; err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestFFPublisherStopKill(t *testing.T) {
+
+	defer fakeFFmpeg(t, "trap '' TERM; while true; do sleep 0.05; done")()
+
+	publisher := NewFFPublisher("test", "rtmp://127.0.0.1/live/test", nil)
+	publisher.SetStopTimeout(50 * time.Millisecond)
+	publisher.SetRestart(5, func() bool { return true }, nil)
+
+	done := make(chan error, 1)
+	go publisher.supervise(done)
+
+	for i := 0; i < 100 && !running(publisher); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publisher.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stopped publisher should not fail, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ffmpeg should be killed")
+	}
+}
+
+func TestFFPublisherProbeFirst(t *testing.T) {
+
+	defer fakeFFmpeg(t, "exit 0")()
+
+	capabilities := map[string]*sdp.Capability{
+		"video": {Codecs: []string{"h264"}},
+		"audio": {Codecs: []string{"opus"}},
+	}
+
+	publisher := NewFFPublisher("test", "rtmp://127.0.0.1/live/test", capabilities)
+	publisher.SetProbe(func() *Probe {
+		return &Probe{Video: "h264"}
+	})
+
+	done := publisher.Start()
+	defer publisher.Stop()
+
+	// the source has no audio, so its session is never created
+	if publisher.audioSession != nil || publisher.GetAudioTrack() != nil {
+		t.Error("the audio track the source does not have should not be created")
+	}
+
+	args := strings.Join(publisher.args, " ")
+	if !strings.Contains(args, "-vcodec copy") || strings.Contains(args, "-acodec") {
+		t.Errorf("the args should only pull the video %s", args)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("ffmpeg should finish, got %v", err)
+	}
+}
+
+func running(publisher *FFPublisher) bool {
+	publisher.Lock()
+	defer publisher.Unlock()
+	return publisher.command != nil
+}
+
+func TestPipelineArgs(t *testing.T) {
+
+	args := strings.Join(DefaultPipeline().args("rtmp://127.0.0.1/live/test", 96, 5000, 111, 5002), " ")
+	expected := "-fflags nobuffer -i rtmp://127.0.0.1/live/test " +
+		"-vcodec copy -an -bsf:v h264_mp4toannexb -f rtp -payload_type 96 rtp://127.0.0.1:5000 " +
+		"-acodec libopus -vn -ar 48000 -ac 2 -f rtp -payload_type 111 rtp://127.0.0.1:5002"
+	if args != expected {
+		t.Errorf("wrong default args %s", args)
+	}
+
+	pipeline := &Pipeline{Video: true, VideoTranscode: true, Bitrate: "1500k", Preset: "veryfast"}
+	args = strings.Join(pipeline.args("rtmp://127.0.0.1/live/test", 96, 5000, 0, 0), " ")
+	expected = "-i rtmp://127.0.0.1/live/test " +
+		"-vcodec libx264 -tune zerolatency -pix_fmt yuv420p -bf 0 -preset veryfast -b:v 1500k -an " +
+		"-f rtp -payload_type 96 rtp://127.0.0.1:5000"
+	if args != expected {
+		t.Errorf("wrong transcode args %s", args)
+	}
+
+	// the audio is copied only when the source is known to be opus
+	pipeline = &Pipeline{Audio: true}
+	args = strings.Join(pipeline.args("rtmp://127.0.0.1/live/test", 0, 0, 111, 5002), " ")
+	if !strings.Contains(args, "-acodec libopus") {
+		t.Errorf("audio of an unknown source should be transcoded %s", args)
+	}
+
+	pipeline.SourceAudio = "opus"
+	args = strings.Join(pipeline.args("rtmp://127.0.0.1/live/test", 0, 0, 111, 5002), " ")
+	if !strings.Contains(args, "-acodec copy") {
+		t.Errorf("opus audio should be copied %s", args)
+	}
+}
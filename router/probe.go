@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+var ffprobePath = "ffprobe"
+
+// Probe the codecs of the source, empty if the source has no such track
+type Probe struct {
+	Video string
+	Audio string
+}
+
+// ProbeStream probe the source with ffprobe
+func ProbeStream(streamURL string, timeout time.Duration) (*Probe, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-show_streams", "-of", "json", streamURL)
+	out, err := command.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("probe %s timeout", streamURL)
+		}
+		return nil, fmt.Errorf("probe %s error: %s", streamURL, err)
+	}
+
+	return parseProbe(out)
+}
+
+func parseProbe(out []byte) (*Probe, error) {
+
+	var result struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+	}
+
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("can not parse probe result: %s", err)
+	}
+
+	probe := &Probe{}
+
+	for _, stream := range result.Streams {
+		switch stream.CodecType {
+		case "video":
+			if probe.Video == "" {
+				probe.Video = stream.CodecName
+			}
+		case "audio":
+			if probe.Audio == "" {
+				probe.Audio = stream.CodecName
+			}
+		}
+	}
+
+	if probe.Video == "" && probe.Audio == "" {
+		return nil, ErrNoMedia
+	}
+
+	return probe, nil
+}
+
+// Adapt drop the tracks the source does not have and transcode the codecs which can not be copied,
+// the transcodes of the profile are kept
+func (p *Pipeline) Adapt(probe *Probe) *Pipeline {
+
+	pipeline := *p
+	pipeline.SourceAudio = probe.Audio
+
+	switch probe.Video {
+	case "":
+		pipeline.Video = false
+	case "h264":
+	default:
+		pipeline.VideoTranscode = true
+	}
+
+	switch probe.Audio {
+	case "":
+		pipeline.Audio = false
+	case "opus":
+	default:
+		pipeline.AudioTranscode = true
+	}
+
+	return &pipeline
+}
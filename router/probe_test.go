@@ -0,0 +1,70 @@
+package router
+
+import "testing"
+
+func TestParseProbe(t *testing.T) {
+
+	out := []byte(`{"streams":[
+		{"index":0,"codec_name":"hevc","codec_type":"video","width":1280,"height":720},
+		{"index":1,"codec_name":"aac","codec_type":"audio","sample_rate":"44100"}
+	]}`)
+
+	probe, err := parseProbe(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if probe.Video != "hevc" || probe.Audio != "aac" {
+		t.Errorf("wrong probe %+v", probe)
+	}
+
+	if _, err := parseProbe([]byte(`{"streams":[]}`)); err != ErrNoMedia {
+		t.Errorf("source without tracks should be ErrNoMedia, got %v", err)
+	}
+
+	if _, err := parseProbe([]byte(`not json`)); err == nil {
+		t.Error("invalid output should fail")
+	}
+}
+
+func TestPipelineAdapt(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		probe    *Probe
+		expected Pipeline
+	}{
+		{"h264 aac", &Probe{Video: "h264", Audio: "aac"},
+			Pipeline{Video: true, Audio: true, AudioTranscode: true}},
+		{"hevc opus", &Probe{Video: "hevc", Audio: "opus"},
+			Pipeline{Video: true, VideoTranscode: true, Audio: true, AudioTranscode: true}},
+		{"video only", &Probe{Video: "h264"},
+			Pipeline{Video: true, AudioTranscode: true}},
+		{"audio only", &Probe{Audio: "mp3"},
+			Pipeline{Audio: true, AudioTranscode: true}},
+	}
+
+	for _, c := range cases {
+		pipeline := DefaultPipeline().Adapt(c.probe)
+		if pipeline.Video != c.expected.Video || pipeline.VideoTranscode != c.expected.VideoTranscode ||
+			pipeline.Audio != c.expected.Audio || pipeline.AudioTranscode != c.expected.AudioTranscode {
+			t.Errorf("%s: wrong pipeline %+v", c.name, pipeline)
+		}
+	}
+
+	pipeline := DefaultPipeline()
+	pipeline.Adapt(&Probe{})
+	if !pipeline.Video || !pipeline.Audio {
+		t.Error("adapt should not change the profile pipeline")
+	}
+
+	// the copies of the profile are kept for the codecs which can be copied, the transcodes always
+	copied := (&Pipeline{Video: true, Audio: true}).Adapt(&Probe{Video: "h264", Audio: "opus"})
+	if copied.VideoTranscode || copied.AudioTranscode || copied.SourceAudio != "opus" {
+		t.Errorf("h264 and opus should be copied %+v", copied)
+	}
+	transcoded := (&Pipeline{Video: true, VideoTranscode: true, Audio: true, AudioTranscode: true}).Adapt(&Probe{Video: "h264", Audio: "opus"})
+	if !transcoded.VideoTranscode || !transcoded.AudioTranscode {
+		t.Errorf("the transcodes of the profile should be kept %+v", transcoded)
+	}
+}
@@ -2,8 +2,10 @@ package router
 
 import (
 	"sync"
+	"time"
 
 	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/sdp"
 )
 
@@ -25,6 +27,13 @@ type Subscriber interface {
 	Stop()
 }
 
+// Listener get notified when subscribers join or leave the router
+type Listener interface {
+	OnSubscriberAdded(router *MediaRouter, subscriber Subscriber)
+	OnSubscriberRemoved(router *MediaRouter, subscriber Subscriber)
+	OnSubscriberTimeout(router *MediaRouter, subscriber Subscriber)
+}
+
 // MediaRouter mediarouter
 type MediaRouter struct {
 	routerID     string
@@ -33,6 +42,12 @@ type MediaRouter struct {
 	publisher    Publisher
 	subscribers  map[string]Subscriber
 	origin       bool
+	listener     Listener
+	icetimeout   time.Duration
+	idletimeout  time.Duration
+	onidle       func(router *MediaRouter)
+	idletimer    *time.Timer
+	created      time.Time
 	sync.Mutex
 }
 
@@ -42,6 +57,7 @@ func NewMediaRouter(routerID string, endpoint *mediaserver.Endpoint, capabilitie
 	router.endpoint = endpoint
 	router.capabilities = capabilities
 	router.origin = origin
+	router.created = time.Now()
 
 	router.subscribers = make(map[string]Subscriber)
 	return router
@@ -55,79 +71,236 @@ func (r *MediaRouter) IsOrgin() bool {
 	return r.origin
 }
 
+// GetCreateTime the time the router is created
+func (r *MediaRouter) GetCreateTime() time.Time {
+	return r.created
+}
+
+func (r *MediaRouter) SetListener(listener Listener) {
+	r.listener = listener
+}
+
+// SetICETimeout the subscribers without ice requests within the timeout are stopped, 0 never stops them
+func (r *MediaRouter) SetICETimeout(timeout time.Duration) {
+	r.icetimeout = timeout
+}
+
+// SetIdleTimeout call onidle once the router has no subscribers for the timeout
+func (r *MediaRouter) SetIdleTimeout(timeout time.Duration, onidle func(router *MediaRouter)) {
+	r.Lock()
+	defer r.Unlock()
+	r.idletimeout = timeout
+	r.onidle = onidle
+	r.resetIdleTimer()
+}
+
+// resetIdleTimer must be called with the lock held
+func (r *MediaRouter) resetIdleTimer() {
+
+	if r.idletimer != nil {
+		r.idletimer.Stop()
+		r.idletimer = nil
+	}
+
+	if r.onidle == nil || len(r.subscribers) > 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(r.idletimeout, func() {
+		r.Lock()
+		idle := r.idletimer == timer
+		if idle {
+			r.idletimer = nil
+		}
+		onidle := r.onidle
+		r.Unlock()
+
+		if idle && onidle != nil {
+			onidle(r)
+		}
+	})
+	r.idletimer = timer
+}
+
 func (r *MediaRouter) GetPublisher() Publisher {
+	r.Lock()
+	defer r.Unlock()
 	return r.publisher
 }
 
 func (r *MediaRouter) SetPublisher(publisher Publisher) {
+	r.Lock()
+	defer r.Unlock()
 	r.publisher = publisher
 }
 
 func (s *MediaRouter) GetSubscribers() map[string]Subscriber {
-	return s.subscribers
+	s.Lock()
+	defer s.Unlock()
+	subscribers := make(map[string]Subscriber, len(s.subscribers))
+	for id, subscriber := range s.subscribers {
+		subscribers[id] = subscriber
+	}
+	return subscribers
+}
+
+func (s *MediaRouter) GetSubscriber(subscriberID string) Subscriber {
+	s.Lock()
+	defer s.Unlock()
+	return s.subscribers[subscriberID]
 }
 
 func (s *MediaRouter) GetSubscribersCount() int {
+	s.Lock()
+	defer s.Unlock()
 	return len(s.subscribers)
 }
 
-func (r *MediaRouter) CreatePublisher(sdpStr string) *RTCPublisher {
+func (r *MediaRouter) CreatePublisher(sdpStr string) (*RTCPublisher, error) {
 
-	publisher := NewRTCPublisher(sdpStr, r.endpoint, r.capabilities)
-	r.publisher = publisher
-	return publisher
+	publisher, err := NewRTCPublisher(sdpStr, r.endpoint, r.capabilities)
+	if err != nil {
+		return nil, err
+	}
+	r.SwitchPublisher(publisher)
+	return publisher, nil
 }
 
-func (r *MediaRouter) CreateRelayPublisher(offerStr string, answerStr string) *RTCPublisher {
+func (r *MediaRouter) CreateRelayPublisher(offerStr string, answerStr string) (*RTCPublisher, error) {
 
-	publisher := NewRelayPublisher(offerStr, answerStr, r.endpoint, r.capabilities)
+	publisher, err := NewRelayPublisher(offerStr, answerStr, r.endpoint, r.capabilities)
+	if err != nil {
+		return nil, err
+	}
+	r.SwitchPublisher(publisher)
+	return publisher, nil
+}
+
+// SwitchPublisher replace the publisher, attach the subscribers to the new one and stop the old one
+func (r *MediaRouter) SwitchPublisher(publisher Publisher) {
+
+	r.Lock()
+	old := r.publisher
 	r.publisher = publisher
-	return publisher
+	for _, subscriber := range r.subscribers {
+		subscriber.Attach(publisher)
+	}
+	r.Unlock()
+
+	if old != nil && old != publisher {
+		old.Stop()
+	}
 }
 
 func (r *MediaRouter) CreateFFPublisher(streamID string, streamURL string) *FFPublisher {
 
 	publisher := NewFFPublisher(streamID, streamURL, r.capabilities)
-	r.publisher = publisher
+	r.SetPublisher(publisher)
 	return publisher
 }
 
-func (r *MediaRouter) CreateSubscriber(sdpStr string) Subscriber {
+func (r *MediaRouter) CreateRTMPPublisher(streamID string, demuxer Demuxer, streams []av.CodecData) (*RTMPPublisher, error) {
+
+	publisher, err := NewRTMPPublisher(streamID, demuxer, streams, r.capabilities)
+	if err != nil {
+		return nil, err
+	}
+	r.SetPublisher(publisher)
+	return publisher, nil
+}
+
+// CreateSubscriber create a subscriber of the publisher, it is stopped on ice timeout,
+// the relay subscribers of the edges too as the edges send stun keepalives
+func (r *MediaRouter) CreateSubscriber(sdpStr string) (Subscriber, error) {
 
-	subscriber := NewRTCSubscriber(sdpStr, r.endpoint, r.capabilities)
+	// fail before the transport is created, the publisher may still go away before it is attached
+	if r.GetPublisher() == nil {
+		return nil, ErrNoPublisher
+	}
+
+	subscriber, err := NewRTCSubscriber(sdpStr, r.endpoint, r.capabilities)
+	if err != nil {
+		return nil, err
+	}
 
+	// attached in the same critical section as SwitchPublisher, so the subscriber never misses a switch
 	r.Lock()
+	publisher := r.publisher
+	if publisher == nil {
+		r.Unlock()
+		subscriber.Stop()
+		return nil, ErrNoPublisher
+	}
 	r.subscribers[subscriber.GetID()] = subscriber
+	r.resetIdleTimer()
+	subscriber.Attach(publisher)
 	r.Unlock()
 
-	subscriber.Attach(r.publisher)
+	if r.icetimeout > 0 {
+		subscriber.SetICETimeout(r.icetimeout, r.onSubscriberTimeout)
+	}
+
+	if r.listener != nil {
+		r.listener.OnSubscriberAdded(r, subscriber)
+	}
 
-	return subscriber
+	return subscriber, nil
 }
 
 func (r *MediaRouter) StopSubscriber(subscriberId string) {
+
+	r.Lock()
 	subscriber := r.subscribers[subscriberId]
+	delete(r.subscribers, subscriberId)
+	if subscriber != nil {
+		r.resetIdleTimer()
+	}
+	r.Unlock()
+
 	if subscriber == nil {
 		return
 	}
 
 	subscriber.Stop()
 
-	r.Lock()
-	delete(r.subscribers, subscriberId)
-	r.Unlock()
+	if r.listener != nil {
+		r.listener.OnSubscriberRemoved(r, subscriber)
+	}
 }
 
-func (r *MediaRouter) Stop() {
+func (r *MediaRouter) onSubscriberTimeout(subscriber *RTCSubscriber) {
 
-	if r.publisher != nil {
-		r.publisher.Stop()
+	if r.GetSubscriber(subscriber.GetID()) == nil {
+		return
 	}
 
-	for _, subscriber := range r.subscribers {
-		subscriber.Stop()
+	if r.listener != nil {
+		r.listener.OnSubscriberTimeout(r, subscriber)
 	}
 
+	r.StopSubscriber(subscriber.GetID())
+}
+
+func (r *MediaRouter) Stop() {
+
+	r.Lock()
+	publisher := r.publisher
+	subscribers := r.subscribers
 	r.publisher = nil
-	r.subscribers = nil
+	r.subscribers = make(map[string]Subscriber)
+	r.onidle = nil
+	r.resetIdleTimer()
+	r.Unlock()
+
+	if publisher != nil {
+		publisher.Stop()
+	}
+
+	for _, subscriber := range subscribers {
+		subscriber.Stop()
+		if r.listener != nil {
+			r.listener.OnSubscriberRemoved(r, subscriber)
+		}
+	}
 }
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/sdp"
+)
+
+func TestInvalidSdp(t *testing.T) {
+
+	if _, err := NewRTCPublisher("invalid sdp", nil, nil); err == nil {
+		t.Error("publisher with invalid sdp should fail")
+	} else if _, ok := err.(*SdpError); !ok {
+		t.Errorf("should be sdp error, got %v", err)
+	}
+
+	if _, err := NewRelayPublisher("invalid sdp", "invalid sdp", nil, nil); err == nil {
+		t.Error("relay publisher with invalid sdp should fail")
+	}
+
+	if _, err := NewRTCSubscriber("invalid sdp", nil, nil); err == nil {
+		t.Error("subscriber with invalid sdp should fail")
+	}
+}
+
+func TestSubscribeWithoutPublisher(t *testing.T) {
+
+	router := NewMediaRouter("test", nil, nil, true)
+
+	if _, err := router.CreateSubscriber("invalid sdp"); err != ErrNoPublisher {
+		t.Errorf("should be ErrNoPublisher, got %v", err)
+	}
+
+	if router.GetSubscribersCount() != 0 {
+		t.Error("should not add subscriber")
+	}
+}
+
+func TestSubscribeNoMedia(t *testing.T) {
+
+	// the offer has only vp8 video, the router only h264
+	endpoint := mediaserver.NewEndpoint("127.0.0.1")
+	offer := endpoint.CreateOffer(&sdp.Capability{Codecs: []string{"vp8"}}, nil).String()
+
+	router := NewMediaRouter("test", endpoint, map[string]*sdp.Capability{
+		"video": {Codecs: []string{"h264"}},
+	}, true)
+	router.SetPublisher(&testPublisher{id: "test"})
+
+	if _, err := router.CreateSubscriber(offer); err != ErrNoMedia {
+		t.Errorf("should be ErrNoMedia, got %v", err)
+	}
+
+	if router.GetSubscribersCount() != 0 {
+		t.Error("should not add subscriber")
+	}
+}
+
+type testPublisher struct {
+	id string
+}
+
+func (p *testPublisher) GetID() string                                   { return p.id }
+func (p *testPublisher) GetAnswer() string                               { return "" }
+func (p *testPublisher) GetVideoTrack() *mediaserver.IncomingStreamTrack { return nil }
+func (p *testPublisher) GetAudioTrack() *mediaserver.IncomingStreamTrack { return nil }
+func (p *testPublisher) Stop()                                           {}
+
+type testSubscriber struct {
+	id string
+}
+
+func (s *testSubscriber) GetID() string                        { return s.id }
+func (s *testSubscriber) GetAnswer() string                    { return "" }
+func (s *testSubscriber) Attach(publisher Publisher)           {}
+func (s *testSubscriber) GetTransport() *mediaserver.Transport { return nil }
+func (s *testSubscriber) Stop()                                {}
+
+func TestIdleTimeout(t *testing.T) {
+
+	router := NewMediaRouter("test", nil, nil, true)
+	router.subscribers["subscriber"] = &testSubscriber{id: "subscriber"}
+
+	idle := make(chan *MediaRouter, 1)
+	router.SetIdleTimeout(20*time.Millisecond, func(r *MediaRouter) {
+		idle <- r
+	})
+
+	select {
+	case <-idle:
+		t.Fatal("router with subscribers should not be idle")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	router.StopSubscriber("subscriber")
+
+	select {
+	case r := <-idle:
+		if r != router {
+			t.Error("should be the idle router")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("router should be idle after the last subscriber left")
+	}
+}
+
+func TestIdleTimeoutStopped(t *testing.T) {
+
+	router := NewMediaRouter("test", nil, nil, true)
+
+	idle := make(chan *MediaRouter, 1)
+	router.SetIdleTimeout(20*time.Millisecond, func(r *MediaRouter) {
+		idle <- r
+	})
+	router.Stop()
+
+	select {
+	case <-idle:
+		t.Fatal("stopped router should not be idle")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriberICETimeout(t *testing.T) {
+
+	start := time.Now()
+	subscriber := &RTCSubscriber{id: "subscriber", lastICE: start}
+
+	timedout := false
+	subscriber.SetICETimeout(10*time.Second, func(s *RTCSubscriber) {
+		timedout = true
+	})
+
+	stats := mediaserver.ICEStats{RequestsReceived: 1}
+	if subscriber.checkICE(stats, start.Add(5*time.Second)) != nil {
+		t.Error("new ice requests should keep the subscriber")
+	}
+
+	if subscriber.checkICE(stats, start.Add(15*time.Second)) != nil {
+		t.Error("the subscriber should be kept within the timeout of the last ice request")
+	}
+
+	ontimeout := subscriber.checkICE(stats, start.Add(16*time.Second))
+	if ontimeout == nil {
+		t.Fatal("the subscriber without ice requests for the timeout should time out")
+	}
+	ontimeout(subscriber)
+	if !timedout {
+		t.Error("the timeout callback should be returned")
+	}
+
+	// without a timeout the subscriber never times out
+	subscriber.SetICETimeout(0, nil)
+	if subscriber.checkICE(stats, start.Add(time.Hour)) != nil {
+		t.Error("the subscriber without ice timeout should be kept")
+	}
+}
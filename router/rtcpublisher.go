@@ -1,6 +1,8 @@
 package router
 
 import (
+	"sync"
+
 	mediaserver "github.com/notedit/media-server-go"
 	"github.com/notedit/sdp"
 )
@@ -12,18 +14,21 @@ type RTCPublisher struct {
 	audiotrack *mediaserver.IncomingStreamTrack
 	transport  *mediaserver.Transport
 	answer     string
+	relay      bool
+	clientIP   string
+	sync.Mutex
 }
 
 // NewRTCPublisher create new rtc publisher
-func NewRTCPublisher(sdpStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) *RTCPublisher {
+func NewRTCPublisher(sdpStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) (*RTCPublisher, error) {
 
 	offer, err := sdp.Parse(sdpStr)
 	if err != nil {
-		panic(err)
+		return nil, &SdpError{Err: err}
 	}
 
 	if offer.GetFirstStream() == nil {
-		panic("can not find stream info")
+		return nil, ErrNoStream
 	}
 
 	transport := endpoint.CreateTransport(offer, nil)
@@ -34,6 +39,11 @@ func NewRTCPublisher(sdpStr string, endpoint *mediaserver.Endpoint, capabilities
 		endpoint.GetLocalCandidates(),
 		capabilities)
 
+	if answerInfo.GetMedia("audio") == nil && answerInfo.GetMedia("video") == nil {
+		transport.Stop()
+		return nil, ErrNoMedia
+	}
+
 	transport.SetLocalProperties(answerInfo.GetMedia("audio"), answerInfo.GetMedia("video"))
 
 	streamInfo := offer.GetFirstStream()
@@ -57,26 +67,33 @@ func NewRTCPublisher(sdpStr string, endpoint *mediaserver.Endpoint, capabilities
 		transport:  transport,
 		answer:     answerInfo.String(),
 	}
-	return publisher
+	return publisher, nil
 }
 
-func NewRelayPublisher(offerStr string, answerStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) *RTCPublisher {
+// NewRelayPublisher create publisher from the offer we sent to the origin and the origin's answer
+func NewRelayPublisher(offerStr string, answerStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) (*RTCPublisher, error) {
 
 	offer, err := sdp.Parse(offerStr)
 	if err != nil {
-		panic(err)
+		return nil, &SdpError{Err: err}
 	}
 
 	answer, err := sdp.Parse(answerStr)
 	if err != nil {
-		panic(err)
+		return nil, &SdpError{Err: err}
 	}
 
 	if answer.GetFirstStream() == nil {
-		panic("can not get stream info")
+		return nil, ErrNoStream
 	}
 
-	transport := endpoint.CreateTransport(answer, offer, true)
+	if answer.GetAudioMedia() == nil && answer.GetVideoMedia() == nil {
+		return nil, ErrNoMedia
+	}
+
+	// both ends are ice lite, the edge sends the stun keepalives so the origin sees ice requests
+	// on its relay subscriber and the edge sees the responses on its upstream
+	transport := endpoint.CreateTransport(answer, offer)
 
 	transport.SetLocalProperties(offer.GetAudioMedia(), offer.GetVideoMedia())
 	transport.SetRemoteProperties(answer.GetAudioMedia(), answer.GetVideoMedia())
@@ -101,9 +118,10 @@ func NewRelayPublisher(offerStr string, answerStr string, endpoint *mediaserver.
 		videotrack: videoTrack,
 		audiotrack: audioTrack,
 		transport:  transport,
+		relay:      true,
 	}
 
-	return publisher
+	return publisher, nil
 }
 
 // GetID  get publisher id
@@ -116,6 +134,11 @@ func (p *RTCPublisher) GetAnswer() string {
 	return p.answer
 }
 
+// IsRelay whether the publisher relays the stream from an origin
+func (p *RTCPublisher) IsRelay() bool {
+	return p.relay
+}
+
 // GetVideoTrack  get video track
 func (p *RTCPublisher) GetVideoTrack() *mediaserver.IncomingStreamTrack {
 	return p.videotrack
@@ -126,6 +149,25 @@ func (p *RTCPublisher) GetAudioTrack() *mediaserver.IncomingStreamTrack {
 	return p.audiotrack
 }
 
+// GetTransport get transport
+func (p *RTCPublisher) GetTransport() *mediaserver.Transport {
+	return p.transport
+}
+
+// SetClientIP set the ip of the client which published
+func (p *RTCPublisher) SetClientIP(ip string) {
+	p.Lock()
+	defer p.Unlock()
+	p.clientIP = ip
+}
+
+// GetClientIP the ip of the client which published, empty for a relay
+func (p *RTCPublisher) GetClientIP() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.clientIP
+}
+
 // Stop  stop this publisher
 func (p *RTCPublisher) Stop() {
 
@@ -0,0 +1,271 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/codec"
+	"github.com/notedit/rtclive/transcoder"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/sdp"
+)
+
+// ErrNoH264 the rtmp stream has no h264 video to bridge
+var ErrNoH264 = errors.New("rtmp stream has no h264 video")
+
+// BridgeSupported whether the rtmp streams can be bridged in process, h264 video with aac or no audio
+func BridgeSupported(streams []av.CodecData) bool {
+
+	video := false
+
+	for _, stream := range streams {
+		switch stream.Type() {
+		case av.H264:
+			if _, ok := stream.(codec.H264CodecData); ok {
+				video = true
+			}
+		case av.AAC:
+			if _, ok := stream.(codec.AACCodecData); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return video
+}
+
+// Demuxer read the packets of a rtmp push, a rtmp conn or a queue cursor
+type Demuxer interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+}
+
+// RTMPPublisher bridge a rtmp stream to webrtc, h264 is packetized in process
+// and aac is transcoded to opus by the transcoder
+type RTMPPublisher struct {
+	id              string
+	demuxer         Demuxer
+	streams         []av.CodecData
+	videoSession    *mediaserver.StreamerSession
+	audioSession    *mediaserver.StreamerSession
+	videoConn       net.Conn
+	audioConn       net.Conn
+	videoPacketizer *rtpPacketizer
+	audioPacketizer *rtpPacketizer
+	audio           transcoder.Transcoder
+	stop            chan struct{}
+	stopOnce        sync.Once
+}
+
+// NewRTMPPublisher create the bridge of the demuxer, streams are its codecs
+func NewRTMPPublisher(streamID string, demuxer Demuxer, streams []av.CodecData, capabilities map[string]*sdp.Capability) (*RTMPPublisher, error) {
+
+	if !BridgeSupported(streams) {
+		return nil, ErrNoH264
+	}
+
+	videoMediaInfo, videoCodec := mediaCodec("video", "h264", capabilities)
+	if videoCodec == nil {
+		return nil, ErrNoMedia
+	}
+
+	publisher := &RTMPPublisher{
+		id:      streamID,
+		demuxer: demuxer,
+		streams: streams,
+		stop:    make(chan struct{}),
+	}
+
+	publisher.videoSession = mediaserver.NewStreamerSession(videoMediaInfo)
+	publisher.videoPacketizer = newRTPPacketizer(videoCodec.GetType())
+
+	videoConn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(publisher.videoSession.GetLocalPort()))
+	if err != nil {
+		publisher.videoSession.Stop()
+		return nil, err
+	}
+	publisher.videoConn = videoConn
+
+	audioMediaInfo, audioCodec := mediaCodec("audio", "opus", capabilities)
+
+	for _, stream := range streams {
+		if stream.Type() != av.AAC {
+			continue
+		}
+		if audioCodec == nil {
+			fmt.Printf("capability has no opus, drop the audio of %s\n", streamID)
+			break
+		}
+		publisher.audioSession = mediaserver.NewStreamerSession(audioMediaInfo)
+		publisher.audioPacketizer = newRTPPacketizer(audioCodec.GetType())
+
+		publisher.audioConn, err = net.Dial("udp", "127.0.0.1:"+strconv.Itoa(publisher.audioSession.GetLocalPort()))
+		if err != nil {
+			publisher.Stop()
+			return nil, err
+		}
+
+		publisher.audio, err = transcoder.New(stream)
+		if err != nil {
+			publisher.Stop()
+			return nil, err
+		}
+		break
+	}
+
+	return publisher, nil
+}
+
+// Start read the rtmp packets until the stream ends or the publisher is stopped
+func (p *RTMPPublisher) Start() <-chan error {
+
+	done := make(chan error, 1)
+
+	if p.audio != nil {
+		go p.writeAudio()
+	}
+
+	go func() {
+		done <- p.run()
+		close(done)
+	}()
+
+	return done
+}
+
+func (p *RTMPPublisher) run() error {
+
+	for {
+		packet, err := p.demuxer.ReadPacket()
+
+		select {
+		case <-p.stop:
+			return nil
+		default:
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if int(packet.Idx) >= len(p.streams) {
+			continue
+		}
+
+		switch stream := p.streams[packet.Idx].(type) {
+		case codec.H264CodecData:
+			p.writeVideo(stream, packet)
+		case codec.AACCodecData:
+			if p.audio != nil {
+				p.audio.WritePacket(packet)
+			}
+		}
+	}
+}
+
+func (p *RTMPPublisher) writeVideo(video codec.H264CodecData, packet av.Packet) {
+
+	nalus := codec.SplitAVCC(packet.Data)
+
+	if packet.IsKeyFrame {
+		hasSPS := false
+		for _, nalu := range nalus {
+			if len(nalu) > 0 && nalu[0]&0x1f == naluTypeSPS {
+				hasSPS = true
+			}
+		}
+		if !hasSPS {
+			nalus = append([][]byte{video.SPS(), video.PPS()}, nalus...)
+		}
+	}
+
+	timestamp := uint32((packet.Time + packet.CompositionTime) * 90000 / time.Second)
+
+	for _, rtp := range p.videoPacketizer.packetizeH264(nalus, timestamp) {
+		p.videoConn.Write(rtp)
+	}
+}
+
+// writeAudio send the opus frames until the transcoder is closed
+func (p *RTMPPublisher) writeAudio() {
+
+	for {
+		frame, err := p.audio.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("audio transcoder of %s error %s\n", p.id, err)
+			}
+			return
+		}
+
+		timestamp := uint32(frame.Time * 48000 / time.Second)
+		p.audioConn.Write(p.audioPacketizer.packet(frame.Data, timestamp, false))
+	}
+}
+
+// GetID get publisher id
+func (p *RTMPPublisher) GetID() string {
+	return p.id
+}
+
+// GetAnswer get answer str
+func (p *RTMPPublisher) GetAnswer() string {
+	return ""
+}
+
+// GetVideoTrack get video track
+func (p *RTMPPublisher) GetVideoTrack() *mediaserver.IncomingStreamTrack {
+
+	if p.videoSession != nil {
+		return p.videoSession.GetIncomingStreamTrack()
+	}
+	return nil
+}
+
+// GetAudioTrack get audio track
+func (p *RTMPPublisher) GetAudioTrack() *mediaserver.IncomingStreamTrack {
+
+	if p.audioSession != nil {
+		return p.audioSession.GetIncomingStreamTrack()
+	}
+	return nil
+}
+
+// Stop stop the bridge and the audio transcoder
+func (p *RTMPPublisher) Stop() {
+
+	p.stopOnce.Do(func() {
+		close(p.stop)
+
+		if p.audio != nil {
+			// the rtmp connection is closed at once, the transcoder exits on its own
+			go p.audio.Close()
+		}
+
+		if p.videoConn != nil {
+			p.videoConn.Close()
+		}
+
+		if p.audioConn != nil {
+			p.audioConn.Close()
+		}
+
+		if p.audioSession != nil {
+			p.audioSession.Stop()
+		}
+
+		if p.videoSession != nil {
+			p.videoSession.Stop()
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+const (
+	rtpHeaderSize = 12
+	// rtp payload size, small enough for any path mtu
+	rtpPayloadSize = 1200
+
+	naluTypeFUA = 28
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+)
+
+// rtpPacketizer packetize the frames of a track into rtp packets
+type rtpPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	sequence    uint16
+}
+
+func newRTPPacketizer(payloadType int) *rtpPacketizer {
+	return &rtpPacketizer{
+		payloadType: uint8(payloadType),
+		ssrc:        rand.Uint32(),
+		sequence:    uint16(rand.Uint32()),
+	}
+}
+
+// packetizeH264 packetize the nalus of an access unit, RFC 6184 single nalu and FU-A mode.
+// The marker is set on the last packet of the access unit
+func (p *rtpPacketizer) packetizeH264(nalus [][]byte, timestamp uint32) [][]byte {
+
+	var packets [][]byte
+
+	for i, nalu := range nalus {
+
+		if len(nalu) == 0 {
+			continue
+		}
+
+		last := i == len(nalus)-1
+
+		if len(nalu) <= rtpPayloadSize {
+			packets = append(packets, p.packet(nalu, timestamp, last))
+			continue
+		}
+
+		indicator := nalu[0]&0xe0 | naluTypeFUA
+		naluType := nalu[0] & 0x1f
+		payload := nalu[1:]
+
+		for offset := 0; offset < len(payload); offset += rtpPayloadSize - 2 {
+
+			end := offset + rtpPayloadSize - 2
+			if end > len(payload) {
+				end = len(payload)
+			}
+
+			header := naluType
+			if offset == 0 {
+				header |= 0x80
+			}
+			if end == len(payload) {
+				header |= 0x40
+			}
+
+			fragment := make([]byte, 0, end-offset+2)
+			fragment = append(fragment, indicator, header)
+			fragment = append(fragment, payload[offset:end]...)
+
+			packets = append(packets, p.packet(fragment, timestamp, last && end == len(payload)))
+		}
+	}
+
+	return packets
+}
+
+// packet a rtp packet of the payload, the sequence is increased
+func (p *rtpPacketizer) packet(payload []byte, timestamp uint32, marker bool) []byte {
+
+	packet := make([]byte, rtpHeaderSize+len(payload))
+	packet[0] = 0x80
+	packet[1] = p.payloadType
+	if marker {
+		packet[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(packet[2:], p.sequence)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	binary.BigEndian.PutUint32(packet[8:], p.ssrc)
+	copy(packet[rtpHeaderSize:], payload)
+
+	p.sequence++
+
+	return packet
+}
+
+// joinAVCC join the nalus into an avcc sample
+func joinAVCC(nalus [][]byte) []byte {
+
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	return data
+}
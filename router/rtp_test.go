@@ -0,0 +1,92 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestPacketizeSingleNALU(t *testing.T) {
+
+	packetizer := newRTPPacketizer(96)
+	sequence := packetizer.sequence
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	idr := []byte{0x65, 0x88, 0x84}
+
+	packets := packetizer.packetizeH264([][]byte{sps, idr}, 9000)
+	if len(packets) != 2 {
+		t.Fatalf("packets = %d, want 2", len(packets))
+	}
+
+	for i, packet := range packets {
+		if packet[0] != 0x80 {
+			t.Errorf("packet %d version byte = %x", i, packet[0])
+		}
+		if packet[1]&0x7f != 96 {
+			t.Errorf("packet %d payload type = %d", i, packet[1]&0x7f)
+		}
+		if got := binary.BigEndian.Uint16(packet[2:]); got != sequence+uint16(i) {
+			t.Errorf("packet %d sequence = %d, want %d", i, got, sequence+uint16(i))
+		}
+		if got := binary.BigEndian.Uint32(packet[4:]); got != 9000 {
+			t.Errorf("packet %d timestamp = %d", i, got)
+		}
+	}
+
+	if packets[0][1]&0x80 != 0 {
+		t.Error("marker set before the last packet")
+	}
+	if packets[1][1]&0x80 == 0 {
+		t.Error("marker not set on the last packet")
+	}
+	if !bytes.Equal(packets[1][rtpHeaderSize:], idr) {
+		t.Errorf("payload = %x, want %x", packets[1][rtpHeaderSize:], idr)
+	}
+}
+
+func TestPacketizeFUA(t *testing.T) {
+
+	packetizer := newRTPPacketizer(96)
+
+	nalu := make([]byte, rtpPayloadSize*2+100)
+	nalu[0] = 0x65
+	for i := 1; i < len(nalu); i++ {
+		nalu[i] = byte(i)
+	}
+
+	packets := packetizer.packetizeH264([][]byte{nalu}, 0)
+	if len(packets) != 3 {
+		t.Fatalf("packets = %d, want 3", len(packets))
+	}
+
+	var payload []byte
+	for i, packet := range packets {
+		indicator := packet[rtpHeaderSize]
+		header := packet[rtpHeaderSize+1]
+
+		if indicator != 0x60|naluTypeFUA {
+			t.Errorf("packet %d indicator = %x", i, indicator)
+		}
+		if header&0x1f != naluTypeIDR {
+			t.Errorf("packet %d nalu type = %d", i, header&0x1f)
+		}
+		if start := header&0x80 != 0; start != (i == 0) {
+			t.Errorf("packet %d start bit = %v", i, start)
+		}
+		if end := header&0x40 != 0; end != (i == len(packets)-1) {
+			t.Errorf("packet %d end bit = %v", i, end)
+		}
+		if marker := packet[1]&0x80 != 0; marker != (i == len(packets)-1) {
+			t.Errorf("packet %d marker = %v", i, marker)
+		}
+		if len(packet) > rtpHeaderSize+rtpPayloadSize {
+			t.Errorf("packet %d size = %d", i, len(packet))
+		}
+		payload = append(payload, packet[rtpHeaderSize+2:]...)
+	}
+
+	if !bytes.Equal(payload, nalu[1:]) {
+		t.Error("fragments do not rebuild the nalu")
+	}
+}
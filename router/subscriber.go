@@ -2,6 +2,7 @@ package router
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -13,19 +14,26 @@ import (
 type RTCSubscriber struct {
 	id          string
 	publisherID string
+	clientIP    string
 	answer      string
 	outgoing    *mediaserver.OutgoingStream
 	transport   *mediaserver.Transport
 	iceticker   *time.Ticker
 	icestats    mediaserver.ICEStats
+	icetimeout  time.Duration
+	lastICE     time.Time
+	ontimeout   func(subscriber *RTCSubscriber)
+	done        chan struct{}
+	stopOnce    sync.Once
+	sync.Mutex
 }
 
 // NewRTCSubscriber create new subscriber
-func NewRTCSubscriber(sdpStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) *RTCSubscriber {
+func NewRTCSubscriber(sdpStr string, endpoint *mediaserver.Endpoint, capabilities map[string]*sdp.Capability) (*RTCSubscriber, error) {
 
 	offer, err := sdp.Parse(sdpStr)
 	if err != nil {
-		panic(err)
+		return nil, &SdpError{Err: err}
 	}
 
 	transport := endpoint.CreateTransport(offer, nil)
@@ -36,11 +44,19 @@ func NewRTCSubscriber(sdpStr string, endpoint *mediaserver.Endpoint, capabilitie
 		endpoint.GetLocalCandidates(),
 		capabilities)
 
+	audio := answer.GetMedia("audio") != nil
+	video := answer.GetMedia("video") != nil
+
+	if !audio && !video {
+		transport.Stop()
+		return nil, ErrNoMedia
+	}
+
 	transport.SetLocalProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
 
 	subID := uuid.Must(uuid.NewV4()).String()
 
-	outgoing := transport.CreateOutgoingStreamWithID(subID, true, true)
+	outgoing := transport.CreateOutgoingStreamWithID(subID, audio, video)
 
 	answer.AddStream(outgoing.GetStreamInfo())
 
@@ -49,13 +65,15 @@ func NewRTCSubscriber(sdpStr string, endpoint *mediaserver.Endpoint, capabilitie
 		outgoing:  outgoing,
 		transport: transport,
 		answer:    answer.String(),
+		lastICE:   time.Now(),
+		done:      make(chan struct{}),
 	}
 
 	subscriber.iceticker = time.NewTicker(5 * time.Second)
 
 	go subscriber.runIceTicker()
 
-	return subscriber
+	return subscriber, nil
 }
 
 // GetID get subscriber id
@@ -71,13 +89,15 @@ func (s *RTCSubscriber) GetPublisherID() string {
 // Attach to a publisher
 func (s *RTCSubscriber) Attach(publisher Publisher) {
 
-	if publisher.GetAudioTrack() != nil {
+	s.publisherID = publisher.GetID()
+
+	if publisher.GetAudioTrack() != nil && len(s.outgoing.GetAudioTracks()) > 0 {
 		s.outgoing.GetAudioTracks()[0].AttachTo(publisher.GetAudioTrack())
 	} else {
 		fmt.Println("Attach audio track")
 	}
 
-	if publisher.GetVideoTrack() != nil {
+	if publisher.GetVideoTrack() != nil && len(s.outgoing.GetVideoTracks()) > 0 {
 		s.outgoing.GetVideoTracks()[0].AttachTo(publisher.GetVideoTrack())
 	} else {
 		fmt.Println("Attach video track")
@@ -89,6 +109,35 @@ func (s *RTCSubscriber) GetTransport() *mediaserver.Transport {
 	return s.transport
 }
 
+// SetClientIP set the ip of the client which subscribed
+func (s *RTCSubscriber) SetClientIP(ip string) {
+	s.Lock()
+	defer s.Unlock()
+	s.clientIP = ip
+}
+
+// GetClientIP the ip of the client which subscribed
+func (s *RTCSubscriber) GetClientIP() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.clientIP
+}
+
+// GetICEStats the ice stats of the last tick
+func (s *RTCSubscriber) GetICEStats() mediaserver.ICEStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.icestats
+}
+
+// SetICETimeout call ontimeout once no ice requests are received within the timeout
+func (s *RTCSubscriber) SetICETimeout(timeout time.Duration, ontimeout func(subscriber *RTCSubscriber)) {
+	s.Lock()
+	defer s.Unlock()
+	s.icetimeout = timeout
+	s.ontimeout = ontimeout
+}
+
 // GetAnswer return the answer sdp
 func (s *RTCSubscriber) GetAnswer() string {
 	return s.answer
@@ -101,13 +150,42 @@ func (s *RTCSubscriber) Stop() {
 	s.transport.Stop()
 
 	s.iceticker.Stop()
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
 }
 
 func (s *RTCSubscriber) runIceTicker() {
 
-	for range s.iceticker.C {
-		icestats := s.transport.GetICEStats()
-		s.icestats = icestats
-		//fmt.Printf("Old RequestsReceived %d, New RequestsReceived %d\n", s.icestats.RequestsReceived, icestats.RequestsReceived)
+	for {
+		var now time.Time
+		select {
+		case now = <-s.iceticker.C:
+		case <-s.done:
+			return
+		}
+
+		if ontimeout := s.checkICE(s.transport.GetICEStats(), now); ontimeout != nil {
+			ontimeout(s)
+			return
+		}
+	}
+}
+
+// checkICE keep the ice stats read at now, the timeout callback is returned once there are no ice requests within the timeout
+func (s *RTCSubscriber) checkICE(icestats mediaserver.ICEStats, now time.Time) func(subscriber *RTCSubscriber) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if icestats.RequestsReceived != s.icestats.RequestsReceived {
+		s.lastICE = now
+	}
+	s.icestats = icestats
+
+	if s.icetimeout > 0 && s.ontimeout != nil && now.Sub(s.lastICE) > s.icetimeout {
+		fmt.Printf("subscriber %s has no ice requests in %s\n", s.id, s.icetimeout)
+		return s.ontimeout
 	}
+	return nil
 }
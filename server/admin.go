@@ -0,0 +1,385 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/router"
+)
+
+// BanList the stream ids and client ips refused by play and publish
+type BanList struct {
+	sync.RWMutex
+	streams map[string]bool
+	ips     map[string]bool
+}
+
+// NewBanList create empty ban list
+func NewBanList() *BanList {
+	return &BanList{
+		streams: make(map[string]bool),
+		ips:     make(map[string]bool),
+	}
+}
+
+// BanStream ban the stream id
+func (b *BanList) BanStream(streamID string) {
+	b.Lock()
+	defer b.Unlock()
+	b.streams[streamID] = true
+}
+
+// UnbanStream remove the stream id from the ban list
+func (b *BanList) UnbanStream(streamID string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.streams, streamID)
+}
+
+// BanIP ban the client ip
+func (b *BanList) BanIP(ip string) {
+	b.Lock()
+	defer b.Unlock()
+	b.ips[ip] = true
+}
+
+// UnbanIP remove the client ip from the ban list
+func (b *BanList) UnbanIP(ip string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.ips, ip)
+}
+
+// Streams the banned stream ids
+func (b *BanList) Streams() []string {
+	b.RLock()
+	defer b.RUnlock()
+	return sortedKeys(b.streams)
+}
+
+// IPs the banned client ips
+func (b *BanList) IPs() []string {
+	b.RLock()
+	defer b.RUnlock()
+	return sortedKeys(b.ips)
+}
+
+func (b *BanList) check(streamID string, ip string) error {
+
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.streams[streamID] {
+		return errStreamBanned
+	}
+	if ip != "" && b.ips[ip] {
+		return errClientBanned
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errAdminDisabled = NewError(CodeUnauthorized, "admin api is not enabled")
+
+// adminAuth check the admin token in the bearer Authorization header
+func (s *Server) adminAuth(c *gin.Context) {
+
+	if s.cfg.Admin == nil {
+		abortWithError(c, errAdminDisabled)
+		return
+	}
+
+	if !s.isAdmin(c) {
+		abortWithError(c, NewError(CodeUnauthorized, "admin token is invalid"))
+		return
+	}
+}
+
+// isAdmin the request has the admin token in the bearer Authorization header
+func (s *Server) isAdmin(c *gin.Context) bool {
+
+	if s.cfg.Admin == nil {
+		return false
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Admin.Token)) == 1
+}
+
+// adminStop stop the stream, both the router and the rtmp push
+func (s *Server) adminStop(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId" binding:"required"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if !s.stopStream(streamID) {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// adminKick stop a subscriber of the stream
+func (s *Server) adminKick(c *gin.Context) {
+
+	var data struct {
+		StreamID     string `json:"streamId" binding:"required"`
+		SubscriberID string `json:"subscriberId" binding:"required"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	if mediarouter.GetSubscriber(data.SubscriberID) == nil {
+		abortWithError(c, errSubscriberNotFound)
+		return
+	}
+
+	mediarouter.StopSubscriber(data.SubscriberID)
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// adminBan ban the stream id or the client ip, the live sessions of them are stopped
+func (s *Server) adminBan(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId"`
+		IP       string `json:"ip"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil || (data.StreamID == "" && data.IP == "") {
+		abortWithError(c, NewError(CodeBadRequest, "streamId or ip is required"))
+		return
+	}
+
+	if data.StreamID != "" {
+		streamID, err := parseStreamID(data.StreamID)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		s.bans.BanStream(streamID)
+		s.stopStream(streamID)
+	}
+
+	if data.IP != "" {
+		s.bans.BanIP(data.IP)
+		s.closeRtmpConns(data.IP)
+		s.closeWebrtcSessions(data.IP)
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// adminUnban remove the stream id or the client ip from the ban list
+func (s *Server) adminUnban(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId"`
+		IP       string `json:"ip"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil || (data.StreamID == "" && data.IP == "") {
+		abortWithError(c, NewError(CodeBadRequest, "streamId or ip is required"))
+		return
+	}
+
+	if data.StreamID != "" {
+		streamID, err := parseStreamID(data.StreamID)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		s.bans.UnbanStream(streamID)
+	}
+
+	if data.IP != "" {
+		s.bans.UnbanIP(data.IP)
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// adminBans list the ban list
+func (s *Server) adminBans(c *gin.Context) {
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string][]string{
+			"streams": s.bans.Streams(),
+			"ips":     s.bans.IPs(),
+		},
+	})
+}
+
+// stopStream close the router and the rtmp push of the stream, false if there is neither
+func (s *Server) stopStream(streamID string) bool {
+
+	mediarouter := s.getRouter(streamID)
+	channel := s.getChannel(streamID)
+
+	if mediarouter == nil && channel == nil {
+		return false
+	}
+
+	if mediarouter != nil {
+		s.closeRouter(mediarouter)
+	}
+
+	// the backups would take over the stream
+	for _, backup := range s.removeBackups(streamID) {
+		backup.conn.Close()
+	}
+
+	// the rtmp publish handler tears down the channel and sends stream.stop when the conn is closed
+	if channel != nil && channel.conn != nil {
+		channel.conn.Close()
+		return true
+	}
+
+	s.events.Publish(&Event{
+		Type:     EventStreamStop,
+		StreamID: streamID,
+		Error:    "stopped by admin",
+	})
+
+	return true
+}
+
+// clientIPGetter the webrtc publishers and subscribers keep the ip of their client
+type clientIPGetter interface {
+	GetClientIP() string
+}
+
+// setClientIP keep the ip of the http client on the subscriber, so it is closed when the ip is banned
+func (s *Server) setClientIP(subscriber router.Subscriber, c *gin.Context) {
+	if rtc, ok := subscriber.(*router.RTCSubscriber); ok {
+		rtc.SetClientIP(s.clientIP(c.Request))
+	}
+}
+
+// closeWebrtcSessions close the webrtc publishes and the subscribers from the client ip
+func (s *Server) closeWebrtcSessions(ip string) {
+
+	s.RLock()
+	routers := make([]*router.MediaRouter, 0, len(s.routers))
+	for _, mediarouter := range s.routers {
+		routers = append(routers, mediarouter)
+	}
+	s.RUnlock()
+
+	for _, mediarouter := range routers {
+
+		if getter, ok := mediarouter.GetPublisher().(clientIPGetter); ok && getter.GetClientIP() == ip {
+			fmt.Printf("close webrtc stream %s from banned ip %s\n", mediarouter.GetID(), ip)
+			s.closeRouter(mediarouter)
+			s.events.Publish(&Event{
+				Type:     EventStreamStop,
+				StreamID: mediarouter.GetID(),
+				Error:    "client is banned",
+			})
+			continue
+		}
+
+		for subscriberID, subscriber := range mediarouter.GetSubscribers() {
+			if getter, ok := subscriber.(clientIPGetter); ok && getter.GetClientIP() == ip {
+				mediarouter.StopSubscriber(subscriberID)
+			}
+		}
+	}
+}
+
+// closeRtmpConns close the rtmp pushes from the client ip
+func (s *Server) closeRtmpConns(ip string) {
+
+	s.RLock()
+	channels := make(map[string]*Channel)
+	for streamID, channel := range s.rtmpChannels {
+		channels[streamID] = channel
+	}
+	backups := make(map[string][]*Channel)
+	for streamID, channels := range s.rtmpBackups {
+		backups[streamID] = append([]*Channel(nil), channels...)
+	}
+	s.RUnlock()
+
+	// the backups are removed first, so they can not take over
+	for streamID, channels := range backups {
+		for _, backup := range channels {
+			if rtmpClientIP(backup.conn) != ip {
+				continue
+			}
+			s.Lock()
+			removed := s.removeBackup(streamID, backup)
+			s.Unlock()
+			if removed {
+				backup.conn.Close()
+			}
+		}
+	}
+
+	for streamID, channel := range channels {
+		if channel.conn == nil || rtmpClientIP(channel.conn) != ip {
+			continue
+		}
+		fmt.Printf("close rtmp stream %s from banned ip %s\n", streamID, ip)
+		// a backup from another ip takes over the stream
+		if s.hasBackups(streamID) {
+			channel.conn.Close()
+			continue
+		}
+		s.stopStream(streamID)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtclive/router"
+)
+
+func testAdminConfig(t *testing.T) *config.Config {
+
+	data, err := ioutil.ReadFile("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "rtclive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	data = append(data, []byte("\nadmin:\n  token: admintoken\n")...)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func getAdmin(t *testing.T, address string, token string, result interface{}) int {
+
+	request, _ := http.NewRequest("GET", address, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func postAdmin(t *testing.T, address string, token string, data interface{}, result interface{}) int {
+
+	body, _ := json.Marshal(data)
+	request, _ := http.NewRequest("POST", address, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminDisabled(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	var result Error
+	status := postAdmin(t, serverHTTP.URL+"/api/admin/stop", "", map[string]string{"streamId": "stream"}, &result)
+
+	if status != http.StatusUnauthorized || result.Code != CodeUnauthorized {
+		t.Errorf("admin api should be disabled, got %d/%d", status, result.Code)
+	}
+}
+
+func TestAdminStopAndBan(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "admintest"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	var result Error
+
+	if status := postAdmin(t, serverHTTP.URL+"/api/admin/stop", "wrong", map[string]string{"streamId": streamID}, &result); status != http.StatusUnauthorized {
+		t.Errorf("wrong admin token should be 401, got %d", status)
+	}
+
+	if status := postAdmin(t, serverHTTP.URL+"/api/admin/kick", "admintoken", map[string]string{"streamId": streamID, "subscriberId": "unknown"}, &result); status != http.StatusNotFound {
+		t.Errorf("kick unknown subscriber should be 404, got %d", status)
+	}
+
+	var ok struct {
+		S ErrorCode `json:"s"`
+	}
+
+	if status := postAdmin(t, serverHTTP.URL+"/api/admin/ban", "admintoken", map[string]string{"streamId": streamID}, &ok); status != 200 || ok.S != CodeOK {
+		t.Fatalf("ban should succeed, got %d", status)
+	}
+
+	if s.getRouter(streamID) != nil {
+		t.Error("banned stream should be stopped")
+	}
+
+	data := map[string]string{"streamId": streamID, "sdp": "v=0"}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/publish", data, &result); status != http.StatusForbidden || result.Code != CodeBanned {
+		t.Errorf("banned stream should not be published, got %d/%d", status, result.Code)
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/play", data, &result); status != http.StatusForbidden || result.Code != CodeBanned {
+		t.Errorf("banned stream should not be played, got %d/%d", status, result.Code)
+	}
+
+	postAdmin(t, serverHTTP.URL+"/api/admin/unban", "admintoken", map[string]string{"streamId": streamID}, &ok)
+	postAdmin(t, serverHTTP.URL+"/api/admin/ban", "admintoken", map[string]string{"ip": "127.0.0.1"}, &ok)
+
+	if status := postJSON(t, serverHTTP.URL+"/api/play", data, &result); status != http.StatusForbidden || result.Code != CodeBanned {
+		t.Errorf("banned client should not play, got %d/%d", status, result.Code)
+	}
+
+	if s.bans.check(streamID, "127.0.0.2") != nil {
+		t.Error("stream should be unbanned")
+	}
+
+	if streams, ips := s.bans.Streams(), s.bans.IPs(); len(streams) != 0 || len(ips) != 1 || ips[0] != "127.0.0.1" {
+		t.Errorf("wrong ban list %v %v", streams, ips)
+	}
+}
+
+type testClientPublisher struct {
+	testPublisher
+	ip string
+}
+
+func (p *testClientPublisher) GetClientIP() string { return p.ip }
+
+func TestAdminBanWebrtc(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	for streamID, ip := range map[string]string{"banned": "192.0.2.1", "other": "192.0.2.2"} {
+		mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+		mediarouter.SetPublisher(&testClientPublisher{testPublisher{id: streamID}, ip})
+		s.addRouter(mediarouter)
+	}
+
+	var ok struct {
+		S ErrorCode `json:"s"`
+	}
+
+	if status := postAdmin(t, serverHTTP.URL+"/api/admin/ban", "admintoken", map[string]string{"ip": "192.0.2.1"}, &ok); status != 200 || ok.S != CodeOK {
+		t.Fatalf("ban should succeed, got %d", status)
+	}
+
+	if s.getRouter("banned") != nil {
+		t.Error("the webrtc publish from the banned ip should be stopped")
+	}
+	if s.getRouter("other") == nil {
+		t.Error("the webrtc publish from another ip should be kept")
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/config"
+)
+
+// auth actions
+const (
+	ActionPlay    = "play"
+	ActionPublish = "publish"
+)
+
+// AuthRequest is checked before a play or publish session is accepted
+type AuthRequest struct {
+	Action   string `json:"action"`
+	StreamID string `json:"streamId"`
+	Token    string `json:"token"`
+	ClientIP string `json:"clientIp"`
+	Protocol string `json:"protocol"`
+}
+
+// Authenticator decide whether a session is allowed
+type Authenticator interface {
+	Authenticate(req *AuthRequest) error
+}
+
+var (
+	errTokenMissing = errors.New("token is missing")
+	errTokenInvalid = errors.New("token is invalid")
+	errTokenExpired = errors.New("token is expired")
+)
+
+// TokenAuth checks hmac signed tokens, a token looks like {expire}.{signature}
+type TokenAuth struct {
+	secret []byte
+}
+
+// NewTokenAuth create token authenticator
+func NewTokenAuth(secret string) *TokenAuth {
+	return &TokenAuth{secret: []byte(secret)}
+}
+
+// GenerateToken sign a token of the action on the stream, valid until expire
+func GenerateToken(secret string, action string, streamID string, expire time.Time) string {
+	expireStr := strconv.FormatInt(expire.Unix(), 10)
+	return expireStr + "." + signToken([]byte(secret), action, streamID, expireStr)
+}
+
+func signToken(secret []byte, action string, streamID string, expire string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(action + ":" + streamID + ":" + expire))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate check the token signature and expiry
+func (a *TokenAuth) Authenticate(req *AuthRequest) error {
+
+	if req.Token == "" {
+		return errTokenMissing
+	}
+
+	parts := strings.SplitN(req.Token, ".", 2)
+	if len(parts) != 2 {
+		return errTokenInvalid
+	}
+
+	expire, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errTokenInvalid
+	}
+
+	expected := signToken(a.secret, req.Action, req.StreamID, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return errTokenInvalid
+	}
+
+	if time.Now().Unix() > expire {
+		return errTokenExpired
+	}
+
+	return nil
+}
+
+// WebhookAuth posts the auth request to a webhook, a 2xx response allows the session
+type WebhookAuth struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookAuth create webhook authenticator
+func NewWebhookAuth(url string, timeout time.Duration) *WebhookAuth {
+	return &WebhookAuth{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Authenticate ask the webhook
+func (a *WebhookAuth) Authenticate(req *AuthRequest) error {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("auth webhook error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("auth webhook denied with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newAuthenticator create the authenticator from config, nil if auth is disabled
+func newAuthenticator(cfg *config.Config) Authenticator {
+
+	if cfg.Auth == nil {
+		return nil
+	}
+
+	switch cfg.Auth.Mode {
+	case config.AuthToken:
+		return NewTokenAuth(cfg.Auth.Secret)
+	case config.AuthWebhook:
+		return NewWebhookAuth(cfg.Auth.Webhook, time.Duration(cfg.Auth.Timeout)*time.Second)
+	}
+	return nil
+}
+
+// newInternalSecret the secret of the server, it signs the tokens of our own loopback rtmp pulls and the hls uris
+func newInternalSecret() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// internalToken the token of our own loopback rtmp pull of the stream, it is seen in the ffmpeg command line,
+// so it only plays that stream
+func (s *Server) internalToken(streamID string) string {
+	mac := hmac.New(sha256.New, []byte(s.internalSecret))
+	fmt.Fprintf(mac, "%s\n%s", ActionPlay, streamID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetAuthenticator replace the authenticator, nil disables auth
+func (s *Server) SetAuthenticator(authenticator Authenticator) {
+	s.Lock()
+	defer s.Unlock()
+	s.authenticator = authenticator
+}
+
+func (s *Server) authenticate(req *AuthRequest) error {
+
+	auth, err := s.checkApp(req.Action, req.StreamID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.bans.check(req.StreamID, req.ClientIP); err != nil {
+		return err
+	}
+
+	// our own loopback pull skips the authenticator, not the app and the bans
+	if req.Action == ActionPlay && req.Token != "" && hmac.Equal([]byte(req.Token), []byte(s.internalToken(req.StreamID))) {
+		return nil
+	}
+
+	s.RLock()
+	authenticator := s.authenticator
+	s.RUnlock()
+
+	// the app does not need authentication
+	if authenticator == nil || !auth {
+		return nil
+	}
+
+	if err := authenticator.Authenticate(req); err != nil {
+		return NewError(CodeUnauthorized, err.Error())
+	}
+	return nil
+}
+
+// authorize check the http request, the token is from the body, a bearer Authorization header or the query
+func (s *Server) authorize(c *gin.Context, action string, streamID string, token string, protocol string) error {
+
+	if token == "" {
+		auth := c.GetHeader("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	return s.authenticate(&AuthRequest{
+		Action:   action,
+		StreamID: streamID,
+		Token:    token,
+		ClientIP: s.clientIP(c.Request),
+		Protocol: protocol,
+	})
+}
+
+// clientIP the ip of the http client, the forwarded headers are only trusted from the configured proxies
+func (s *Server) clientIP(r *http.Request) string {
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !s.cfg.Server.TrustedProxy(ip) {
+		return ip
+	}
+
+	// each proxy appends the ip it got the request from, the client is the last one which is not a trusted proxy
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !s.cfg.Server.TrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
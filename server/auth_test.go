@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenAuth(t *testing.T) {
+
+	auth := NewTokenAuth("secret")
+	expire := time.Now().Add(time.Minute)
+
+	token := GenerateToken("secret", ActionPlay, "stream", expire)
+
+	if err := auth.Authenticate(&AuthRequest{Action: ActionPlay, StreamID: "stream", Token: token}); err != nil {
+		t.Errorf("valid token should pass, got %s", err)
+	}
+
+	cases := []struct {
+		name string
+		req  *AuthRequest
+		err  error
+	}{
+		{"missing", &AuthRequest{Action: ActionPlay, StreamID: "stream"}, errTokenMissing},
+		{"malformed", &AuthRequest{Action: ActionPlay, StreamID: "stream", Token: "token"}, errTokenInvalid},
+		{"other stream", &AuthRequest{Action: ActionPlay, StreamID: "other", Token: token}, errTokenInvalid},
+		{"other action", &AuthRequest{Action: ActionPublish, StreamID: "stream", Token: token}, errTokenInvalid},
+		{"other secret", &AuthRequest{Action: ActionPlay, StreamID: "stream", Token: GenerateToken("other", ActionPlay, "stream", expire)}, errTokenInvalid},
+		{"expired", &AuthRequest{Action: ActionPlay, StreamID: "stream", Token: GenerateToken("secret", ActionPlay, "stream", time.Now().Add(-time.Minute))}, errTokenExpired},
+	}
+
+	for _, c := range cases {
+		if err := auth.Authenticate(c.req); err != c.err {
+			t.Errorf("%s: should be %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestWebhookAuth(t *testing.T) {
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token != "allowed" || req.Action != ActionPublish {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer webhook.Close()
+
+	auth := NewWebhookAuth(webhook.URL, time.Second)
+
+	if err := auth.Authenticate(&AuthRequest{Action: ActionPublish, StreamID: "stream", Token: "allowed"}); err != nil {
+		t.Errorf("webhook should allow, got %s", err)
+	}
+
+	if err := auth.Authenticate(&AuthRequest{Action: ActionPublish, StreamID: "stream", Token: "denied"}); err == nil {
+		t.Error("webhook should deny")
+	}
+}
+
+func TestPlayUnauthorized(t *testing.T) {
+
+	s := New(testConfig(t))
+	s.SetAuthenticator(NewTokenAuth("secret"))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	var result Error
+
+	status := postJSON(t, serverHTTP.URL+"/api/play", map[string]string{
+		"streamId": "authtest",
+		"sdp":      "v=0",
+	}, &result)
+
+	if status != http.StatusUnauthorized || result.Code != CodeUnauthorized {
+		t.Errorf("play without token should be unauthorized, got %d/%d", status, result.Code)
+	}
+
+	token := GenerateToken("secret", ActionPlay, "authtest", time.Now().Add(time.Minute))
+
+	status = postJSON(t, serverHTTP.URL+"/api/play", map[string]string{
+		"streamId": "authtest",
+		"sdp":      "v=0",
+		"token":    token,
+	}, &result)
+
+	// authorized, but there is no such stream
+	if status != http.StatusNotFound {
+		t.Errorf("play with token should pass auth, got %d/%d", status, result.Code)
+	}
+
+	status = postJSON(t, serverHTTP.URL+"/api/publish", map[string]string{
+		"streamId": "authtest",
+		"sdp":      "v=0",
+		"token":    token,
+	}, &result)
+
+	if status != http.StatusUnauthorized {
+		t.Errorf("publish with a play token should be unauthorized, got %d/%d", status, result.Code)
+	}
+
+	status = postJSON(t, serverHTTP.URL+"/api/unplay", map[string]string{
+		"streamId":     "authtest",
+		"subscriberId": "authtest",
+	}, &result)
+
+	if status != http.StatusUnauthorized {
+		t.Errorf("unplay without token should be unauthorized, got %d/%d", status, result.Code)
+	}
+}
+
+func TestInternalToken(t *testing.T) {
+
+	s := New(testConfig(t))
+	s.SetAuthenticator(NewTokenAuth("secret"))
+
+	token := s.internalToken("internal")
+
+	if err := s.authenticate(&AuthRequest{Action: ActionPlay, StreamID: "internal", Token: token}); err != nil {
+		t.Errorf("internal token should pass, got %s", err)
+	}
+
+	if err := s.authenticate(&AuthRequest{Action: ActionPlay, StreamID: "other", Token: token}); err == nil {
+		t.Error("internal token should not play another stream")
+	}
+
+	if err := s.authenticate(&AuthRequest{Action: ActionPublish, StreamID: "internal", Token: token}); err == nil {
+		t.Error("internal token should not publish")
+	}
+
+	s.bans.BanStream("internal")
+
+	if err := s.authenticate(&AuthRequest{Action: ActionPlay, StreamID: "internal", Token: token}); err == nil {
+		t.Error("internal token should not play a banned stream")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+
+	s := New(testConfig(t))
+	proxied := New(extendConfig(t, "\nserver:\n  port: 5000\n  trustedproxies: [10.0.0.0/8]\n"))
+
+	cases := []struct {
+		server    *Server
+		remote    string
+		forwarded string
+		real      string
+		ip        string
+	}{
+		{s, "192.0.2.1:1234", "", "", "192.0.2.1"},
+		// the headers of an untrusted client are spoofed
+		{s, "192.0.2.1:1234", "198.51.100.1", "198.51.100.2", "192.0.2.1"},
+		{proxied, "192.0.2.1:1234", "198.51.100.1", "", "192.0.2.1"},
+		{proxied, "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{proxied, "10.0.0.1:1234", "198.51.100.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{proxied, "10.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if c.real != "" {
+			r.Header.Set("X-Real-Ip", c.real)
+		}
+		if ip := c.server.clientIP(r); ip != c.ip {
+			t.Errorf("client ip of %s %q %q = %s, want %s", c.remote, c.forwarded, c.real, ip, c.ip)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+// ProtocolEgress the protocol of the stream events of the local egress channels
+const ProtocolEgress = "egress"
+
+// the name of the local target in the egress status
+const localTargetName = "local"
+
+var (
+	errEgressNotFound = NewError(CodeStreamNotFound, "can not find egress")
+	errEgressStarted  = NewError(CodeStreamPublished, "egress is already started")
+)
+
+// startEgress push a webrtc publish to rtmp urls, and to the local rtmp server if local is set
+func (s *Server) startEgress(c *gin.Context) {
+
+	var data struct {
+		StreamID string   `json:"streamId" binding:"required"`
+		Targets  []string `json:"targets"`
+		Local    bool     `json:"local"`
+		Token    string   `json:"token"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if len(data.Targets) == 0 && !data.Local {
+		abortWithError(c, NewError(CodeBadRequest, "targets or local is required"))
+		return
+	}
+
+	// the targets are named by their host and index, their urls have the stream key
+	names := make([]string, len(data.Targets))
+	for i, target := range data.Targets {
+		parsed, err := url.Parse(target)
+		if err != nil || parsed.Scheme != "rtmp" {
+			abortWithError(c, NewError(CodeInvalidStreamURL, fmt.Sprintf("target %d is not a rtmp url", i)))
+			return
+		}
+		names[i] = fmt.Sprintf("%s#%d", parsed.Host, i)
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, ProtocolEgress); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	publisher, ok := mediarouter.GetPublisher().(*router.RTCPublisher)
+	if !ok {
+		abortWithError(c, errPublisherNotFound)
+		return
+	}
+
+	if data.Local && s.getChannel(streamID) != nil {
+		abortWithError(c, errStreamPublished)
+		return
+	}
+
+	egress := router.NewEgress(streamID, publisher)
+
+	for i, target := range data.Targets {
+		target := target
+		egress.AddTarget(names[i], func() (router.EgressTarget, error) {
+			return rtmp.Dial(target)
+		})
+	}
+
+	if data.Local {
+		egress.AddTarget(localTargetName, func() (router.EgressTarget, error) {
+			return s.newLocalTarget(streamID)
+		})
+	}
+
+	if err := egress.Start(); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	s.Lock()
+	old := s.egresses[streamID]
+	if old != nil && old.GetPublisher() == publisher {
+		s.Unlock()
+		egress.Stop()
+		abortWithError(c, errEgressStarted)
+		return
+	}
+	s.egresses[streamID] = egress
+	s.Unlock()
+
+	// the egress of a publisher taken over is replaced
+	if old != nil {
+		old.Stop()
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": egress.Status(),
+	})
+}
+
+// stopEgress stop the egress of the stream
+func (s *Server) stopEgress(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId" binding:"required"`
+		Token    string `json:"token"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, ProtocolEgress); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	egress := s.getEgress(streamID)
+	if egress == nil || !s.removeEgress(egress) {
+		abortWithError(c, errEgressNotFound)
+		return
+	}
+
+	egress.Stop()
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// listEgresses list the status of the egresses
+func (s *Server) listEgresses(c *gin.Context) {
+
+	s.RLock()
+	egresses := make([]*router.Egress, 0, len(s.egresses))
+	for _, egress := range s.egresses {
+		egresses = append(egresses, egress)
+	}
+	s.RUnlock()
+
+	statuses := make([]*router.EgressStatus, 0, len(egresses))
+	for _, egress := range egresses {
+		statuses = append(statuses, egress.Status())
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": statuses,
+	})
+}
+
+// getEgressStatus the status of the egress of the stream
+func (s *Server) getEgressStatus(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "id")
+	if !ok {
+		return
+	}
+
+	egress := s.getEgress(streamID)
+	if egress == nil {
+		abortWithError(c, errEgressNotFound)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": egress.Status(),
+	})
+}
+
+// stopEgressOnStop stop the egress once its webrtc publish stops
+func (s *Server) stopEgressOnStop(event *Event) {
+
+	if event.Type != EventStreamStop || event.Protocol == ProtocolEgress {
+		return
+	}
+
+	egress := s.getEgress(event.StreamID)
+	if egress == nil {
+		return
+	}
+
+	// a rtmp push of the same id stopped, the publisher is still alive
+	if mediarouter := s.getRouter(event.StreamID); mediarouter != nil && mediarouter.GetPublisher() == egress.GetPublisher() {
+		return
+	}
+
+	if s.removeEgress(egress) {
+		egress.Stop()
+	}
+}
+
+// localTarget push the egress into a rtmp channel, so rtmp players can watch the webrtc publish
+type localTarget struct {
+	server   *Server
+	streamID string
+	channel  *Channel
+	gop      bool
+}
+
+func (s *Server) newLocalTarget(streamID string) (*localTarget, error) {
+
+	s.Lock()
+	if s.rtmpChannels[streamID] != nil {
+		s.Unlock()
+		return nil, errors.New("stream " + streamID + " is already pushed")
+	}
+	channel := &Channel{}
+	channel.created = time.Now()
+	channel.que = pubsub.NewQueue()
+	s.rtmpChannels[streamID] = channel
+	s.Unlock()
+
+	s.events.Publish(&Event{
+		Type:     EventStreamStart,
+		StreamID: streamID,
+		Protocol: ProtocolEgress,
+	})
+
+	key, _ := ParseStreamKey(streamID)
+
+	return &localTarget{
+		server:   s,
+		streamID: streamID,
+		channel:  channel,
+		gop:      s.cfg.App(key.Vhost, key.App).GopCache,
+	}, nil
+}
+
+func (t *localTarget) WriteHeader(streams []av.CodecData) error {
+	t.channel.setGopCache(t.gop, streams)
+	t.channel.setStreams(streams)
+	return t.channel.que.WriteHeader(streams)
+}
+
+func (t *localTarget) WritePacket(packet av.Packet) error {
+	return t.channel.que.WritePacket(packet)
+}
+
+func (t *localTarget) WriteTrailer() error {
+	return t.channel.que.WriteTrailer()
+}
+
+// Close remove the channel and close its queue, the rtmp players are closed with it
+func (t *localTarget) Close() error {
+
+	t.server.removeChannel(t.streamID, t.channel)
+
+	t.channel.que.Close()
+
+	fmt.Printf("egress %s local channel closed\n", t.streamID)
+
+	t.server.events.Publish(&Event{
+		Type:     EventStreamStop,
+		StreamID: t.streamID,
+		Protocol: ProtocolEgress,
+	})
+
+	return nil
+}
+
+func (s *Server) getEgress(streamID string) *router.Egress {
+	s.RLock()
+	defer s.RUnlock()
+	return s.egresses[streamID]
+}
+
+func (s *Server) addEgress(egress *router.Egress) {
+	s.Lock()
+	defer s.Unlock()
+	s.egresses[egress.GetID()] = egress
+}
+
+// removeEgress remove the egress if it is still the one of its stream
+func (s *Server) removeEgress(egress *router.Egress) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.egresses[egress.GetID()] != egress {
+		return false
+	}
+	delete(s.egresses, egress.GetID())
+	return true
+}
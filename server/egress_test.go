@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/notedit/rtclive/router"
+)
+
+func TestEgressLocalTarget(t *testing.T) {
+
+	s := New(testConfig(t))
+
+	var lock sync.Mutex
+	var events []*Event
+	s.events.Subscribe(func(event *Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+
+	streamID := "egresstest"
+
+	target, err := s.newLocalTarget(streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.getChannel(streamID) != target.channel {
+		t.Fatal("local target should add the rtmp channel")
+	}
+
+	if _, err := s.newLocalTarget(streamID); err == nil {
+		t.Error("a second local target of the stream should fail")
+	}
+
+	target.Close()
+
+	if s.getChannel(streamID) != nil {
+		t.Error("closed local target should remove the rtmp channel")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(events) != 2 || events[0].Type != EventStreamStart || events[1].Type != EventStreamStop {
+		t.Fatalf("should send stream.start and stream.stop, got %+v", events)
+	}
+	for _, event := range events {
+		if event.Protocol != ProtocolEgress || event.StreamID != streamID {
+			t.Errorf("wrong event %+v", event)
+		}
+	}
+}
+
+func TestEgressStopOnStreamStop(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "egressstop"
+	egress := router.NewEgress(streamID, &testPublisher{id: streamID})
+	s.addEgress(egress)
+
+	var status struct {
+		S ErrorCode            `json:"s"`
+		D *router.EgressStatus `json:"d"`
+	}
+
+	if code := getJSON(t, serverHTTP.URL+"/api/egress/"+streamID, &status); code != 401 || status.D != nil {
+		t.Fatalf("get egress should need the admin token, got %d", code)
+	}
+
+	if code := getAdmin(t, serverHTTP.URL+"/api/egress/"+streamID, "admintoken", &status); code != 200 || status.D.ID != streamID {
+		t.Fatalf("get egress should succeed, got %d %+v", code, status.D)
+	}
+
+	// the local channel of the egress stops
+	s.events.Publish(&Event{Type: EventStreamStop, StreamID: streamID, Protocol: ProtocolEgress})
+	if s.getEgress(streamID) == nil {
+		t.Fatal("egress should not stop with its own local channel")
+	}
+
+	s.events.Publish(&Event{Type: EventStreamStop, StreamID: streamID, Protocol: "webrtc"})
+	if s.getEgress(streamID) != nil {
+		t.Error("egress should stop with its publish")
+	}
+
+	var list struct {
+		S ErrorCode              `json:"s"`
+		D []*router.EgressStatus `json:"d"`
+	}
+
+	if code := getAdmin(t, serverHTTP.URL+"/api/egress", "admintoken", &list); code != 200 || len(list.D) != 0 {
+		t.Errorf("list egress should be empty, got %d %+v", code, list.D)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/router"
+)
+
+// ErrorCode is the "s" field of the api response
+type ErrorCode int
+
+// api error codes
+const (
+	CodeOK                   ErrorCode = 10000
+	CodeBadRequest           ErrorCode = 10001
+	CodeStreamNotFound       ErrorCode = 10002
+	CodeStreamPublished      ErrorCode = 10003
+	CodeInvalidStreamURL     ErrorCode = 10004
+	CodeUpstreamFailed       ErrorCode = 10005
+	CodeRelayDisabled        ErrorCode = 10006
+	CodeSdpFailed            ErrorCode = 10007
+	CodeUnauthorized         ErrorCode = 10008
+	CodeUnsupportedMediaType ErrorCode = 10009
+	CodeInternal             ErrorCode = 10010
+	CodeBanned               ErrorCode = 10011
+	CodeAppDenied            ErrorCode = 10012
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeBadRequest:           http.StatusBadRequest,
+	CodeStreamNotFound:       http.StatusNotFound,
+	CodeStreamPublished:      http.StatusConflict,
+	CodeInvalidStreamURL:     http.StatusBadRequest,
+	CodeUpstreamFailed:       http.StatusBadGateway,
+	CodeRelayDisabled:        http.StatusForbidden,
+	CodeSdpFailed:            http.StatusBadRequest,
+	CodeUnauthorized:         http.StatusUnauthorized,
+	CodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	CodeInternal:             http.StatusInternalServerError,
+	CodeBanned:               http.StatusForbidden,
+	CodeAppDenied:            http.StatusForbidden,
+}
+
+// Error is the error returned by the http api
+type Error struct {
+	Code    ErrorCode `json:"s"`
+	Message string    `json:"e"`
+}
+
+// NewError create api error
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status the http status code of the error
+func (e *Error) Status() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+var (
+	errStreamNotFound     = NewError(CodeStreamNotFound, "can not find stream")
+	errStreamPublished    = NewError(CodeStreamPublished, "stream is already published")
+	errRelayDisabled      = NewError(CodeRelayDisabled, "relay is not enabled")
+	errClusterSecret      = NewError(CodeUnauthorized, "cluster secret is invalid")
+	errSubscriberNotFound = NewError(CodeStreamNotFound, "can not find subscriber")
+	errPublisherNotFound  = NewError(CodeStreamNotFound, "can not find publisher")
+	errStreamBanned       = NewError(CodeBanned, "stream is banned")
+	errClientBanned       = NewError(CodeBanned, "client is banned")
+)
+
+// toError convert any error to an api error
+func toError(err error) *Error {
+
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *router.SdpError:
+		return NewError(CodeSdpFailed, e.Error())
+	}
+
+	switch err {
+	case router.ErrNoPublisher:
+		return NewError(CodeStreamNotFound, err.Error())
+	case router.ErrNoStream, router.ErrNoMedia:
+		return NewError(CodeSdpFailed, err.Error())
+	case router.ErrNoTracks:
+		return NewError(CodeBadRequest, err.Error())
+	}
+
+	return NewError(CodeInternal, err.Error())
+}
+
+// abortWithError reply the error with its http status
+func abortWithError(c *gin.Context, err error) {
+	apiErr := toError(err)
+	c.AbortWithStatusJSON(apiErr.Status(), apiErr)
+}
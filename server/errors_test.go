@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func TestErrorJSON(t *testing.T) {
+
+	data, err := json.Marshal(NewError(CodeStreamNotFound, "can not find stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `{"s":10002,"e":"can not find stream"}` {
+		t.Errorf("error body is %s", data)
+	}
+}
+
+func TestToError(t *testing.T) {
+
+	cases := []struct {
+		err    error
+		code   ErrorCode
+		status int
+	}{
+		{errStreamPublished, CodeStreamPublished, http.StatusConflict},
+		{&router.SdpError{Err: errors.New("invalid")}, CodeSdpFailed, http.StatusBadRequest},
+		{router.ErrNoStream, CodeSdpFailed, http.StatusBadRequest},
+		{router.ErrNoMedia, CodeSdpFailed, http.StatusBadRequest},
+		{router.ErrNoPublisher, CodeStreamNotFound, http.StatusNotFound},
+		{router.ErrNoTracks, CodeBadRequest, http.StatusBadRequest},
+		{NewError(CodeUnauthorized, "unauthorized"), CodeUnauthorized, http.StatusUnauthorized},
+		{errors.New("unknown"), CodeInternal, http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		apiErr := toError(c.err)
+		if apiErr.Code != c.code || apiErr.Status() != c.status {
+			t.Errorf("%v should be %d/%d, got %d/%d", c.err, c.code, c.status, apiErr.Code, apiErr.Status())
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+
+	s := New(testConfig(t))
+	s.cfg.Relay = true
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "errortest"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	s.addChannel("rtmptest", &Channel{que: pubsub.NewQueue()})
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		code   ErrorCode
+		status int
+	}{
+		{"play invalid json", "/api/play", `not json`, CodeBadRequest, 400},
+		{"play without stream id", "/api/play", `{"sdp":"v=0"}`, CodeBadRequest, 400},
+		{"play unknown stream", "/api/play", `{"streamId":"unknown","sdp":"v=0"}`, CodeStreamNotFound, 404},
+		{"play invalid stream id", "/api/play", `{"streamId":"live//rtmptest","sdp":"v=0"}`, CodeBadRequest, 400},
+		{"play malformed stream url", "/api/play", `{"streamId":"unknown","streamUrl":"rtmp://[bad","sdp":"v=0"}`, CodeInvalidStreamURL, 400},
+		{"play unknown profile", "/api/play", `{"streamId":"unknown","streamUrl":"rtmp://127.0.0.1/live/unknown","profile":"unknown","sdp":"v=0"}`, CodeBadRequest, 400},
+		{"play invalid sdp", "/api/play", `{"streamId":"errortest","sdp":"invalid"}`, CodeSdpFailed, 400},
+		{"publish invalid json", "/api/publish", `not json`, CodeBadRequest, 400},
+		{"publish without sdp", "/api/publish", `{"streamId":"errortest"}`, CodeBadRequest, 400},
+		{"publish duplicate", "/api/publish", `{"streamId":"errortest","sdp":"v=0"}`, CodeStreamPublished, 409},
+		{"publish invalid sdp", "/api/publish", `{"streamId":"newstream","sdp":"invalid"}`, CodeSdpFailed, 400},
+		{"unpublish without stream id", "/api/unpublish", `{}`, CodeBadRequest, 400},
+		{"unpublish unknown stream", "/api/unpublish", `{"streamId":"unknown"}`, CodeStreamNotFound, 404},
+		{"unplay without subscriber id", "/api/unplay", `{"streamId":"errortest"}`, CodeBadRequest, 400},
+		{"unplay unknown stream", "/api/unplay", `{"streamId":"unknown","subscriberId":"unknown"}`, CodeStreamNotFound, 404},
+		{"unplay unknown subscriber", "/api/unplay", `{"streamId":"errortest","subscriberId":"unknown"}`, CodeStreamNotFound, 404},
+		{"relay invalid json", "/api/relay", `not json`, CodeBadRequest, 400},
+		{"relay unknown stream", "/api/relay", `{"streamId":"unknown","sdp":"v=0"}`, CodeStreamNotFound, 404},
+		{"relay invalid sdp", "/api/relay", `{"streamId":"errortest","sdp":"invalid"}`, CodeSdpFailed, 400},
+		{"egress without targets", "/api/egress/start", `{"streamId":"errortest"}`, CodeBadRequest, 400},
+		{"egress invalid target", "/api/egress/start", `{"streamId":"errortest","targets":["http://127.0.0.1/live"]}`, CodeInvalidStreamURL, 400},
+		{"egress unknown stream", "/api/egress/start", `{"streamId":"unknown","local":true}`, CodeStreamNotFound, 404},
+		{"egress not webrtc publisher", "/api/egress/start", `{"streamId":"errortest","local":true}`, CodeStreamNotFound, 404},
+		{"egress stop unknown", "/api/egress/stop", `{"streamId":"unknown"}`, CodeStreamNotFound, 404},
+	}
+
+	for _, c := range cases {
+
+		resp, err := http.Post(serverHTTP.URL+c.path, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result Error
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("%s: can not decode error body %s", c.name, err)
+			continue
+		}
+
+		if resp.StatusCode != c.status || result.Code != c.code || result.Message == "" {
+			t.Errorf("%s: should be %d/%d, got %d/%d %q", c.name, c.status, c.code, resp.StatusCode, result.Code, result.Message)
+		}
+	}
+
+	if s.getRouter("newstream") != nil {
+		t.Error("failed publish should not leave a router")
+	}
+}
+
+func TestWhipWhepErrors(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		code        ErrorCode
+		status      int
+	}{
+		{"whip wrong content type", "POST", "/whip/unknown", "application/json", "{}", CodeUnsupportedMediaType, 415},
+		{"whip empty body", "POST", "/whip/unknown", sdpContentType, "", CodeBadRequest, 400},
+		{"whip invalid sdp", "POST", "/whip/unknown", sdpContentType, "invalid", CodeSdpFailed, 400},
+		{"whip patch unknown stream", "PATCH", "/whip/unknown/id", trickleContentType, "a=end-of-candidates", CodeStreamNotFound, 404},
+		{"whip delete unknown stream", "DELETE", "/whip/unknown/id", "", "", CodeStreamNotFound, 404},
+		{"whep unknown stream", "POST", "/whep/unknown", sdpContentType, "v=0", CodeStreamNotFound, 404},
+		{"whep wrong content type", "POST", "/whep/unknown", "text/plain", "v=0", CodeUnsupportedMediaType, 415},
+		{"whep patch wrong content type", "PATCH", "/whep/unknown/id", sdpContentType, "v=0", CodeUnsupportedMediaType, 415},
+		{"whep delete unknown stream", "DELETE", "/whep/unknown/id", "", "", CodeStreamNotFound, 404},
+	}
+
+	for _, c := range cases {
+
+		request, _ := http.NewRequest(c.method, serverHTTP.URL+c.path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			request.Header.Set("Content-Type", c.contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result Error
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("%s: can not decode error body %s", c.name, err)
+			continue
+		}
+
+		if resp.StatusCode != c.status || result.Code != c.code {
+			t.Errorf("%s: should be %d/%d, got %d/%d", c.name, c.status, c.code, resp.StatusCode, result.Code)
+		}
+	}
+}
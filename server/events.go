@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtclive/router"
+)
+
+// EventType lifecycle event type
+type EventType string
+
+// lifecycle events
+const (
+	EventStreamStart   EventType = "stream.start"
+	EventStreamStop    EventType = "stream.stop"
+	EventViewerJoin    EventType = "viewer.join"
+	EventViewerLeave   EventType = "viewer.leave"
+	EventViewerTimeout EventType = "viewer.timeout"
+	EventPullFailed    EventType = "pull.failed"
+	EventPullRestart   EventType = "pull.restart"
+)
+
+// Event is a stream or viewer lifecycle event
+type Event struct {
+	Type         EventType `json:"type"`
+	StreamID     string    `json:"streamId"`
+	SubscriberID string    `json:"subscriberId,omitempty"`
+	Protocol     string    `json:"protocol,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Time         int64     `json:"time"`
+}
+
+// EventHandler handle the events, it is called on the media paths and should never block
+type EventHandler func(event *Event)
+
+// EventBus fan out the events to the handlers
+type EventBus struct {
+	sync.RWMutex
+	handlers []EventHandler
+}
+
+// NewEventBus create event bus
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe add an event handler
+func (b *EventBus) Subscribe(handler EventHandler) {
+	b.Lock()
+	defer b.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Publish send the event to the handlers
+func (b *EventBus) Publish(event *Event) {
+
+	if event.Time == 0 {
+		event.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	b.RLock()
+	handlers := b.handlers
+	b.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// WebhookDispatcher post the events to a webhook, with a bounded queue so slow receivers never block
+type WebhookDispatcher struct {
+	url     string
+	queue   chan *Event
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	done    chan struct{}
+}
+
+// NewWebhookDispatcher create the dispatcher and start its worker
+func NewWebhookDispatcher(url string, queueSize int, retries int, timeout time.Duration) *WebhookDispatcher {
+
+	dispatcher := &WebhookDispatcher{
+		url:     url,
+		queue:   make(chan *Event, queueSize),
+		retries: retries,
+		backoff: 500 * time.Millisecond,
+		client:  &http.Client{Timeout: timeout},
+		done:    make(chan struct{}),
+	}
+
+	go dispatcher.run()
+
+	return dispatcher
+}
+
+// Dispatch queue the event, the event is dropped if the queue is full
+func (d *WebhookDispatcher) Dispatch(event *Event) {
+	select {
+	case d.queue <- event:
+	default:
+		fmt.Printf("webhook queue is full, drop event %s of %s\n", event.Type, event.StreamID)
+	}
+}
+
+// Stop stop the worker, queued events are dropped
+func (d *WebhookDispatcher) Stop() {
+	close(d.done)
+}
+
+func (d *WebhookDispatcher) run() {
+
+	for {
+		select {
+		case event := <-d.queue:
+			d.send(event)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) send(event *Event) {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	backoff := d.backoff
+
+	for i := 0; i <= d.retries; i++ {
+
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-d.done:
+				return
+			}
+			backoff *= 2
+		}
+
+		resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Printf("webhook post %s error: %s\n", event.Type, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return
+		}
+		fmt.Printf("webhook post %s status %d\n", event.Type, resp.StatusCode)
+	}
+}
+
+// routerListener publish the subscriber events of the routers
+type routerListener struct {
+	events *EventBus
+}
+
+func (l *routerListener) OnSubscriberAdded(mediarouter *router.MediaRouter, subscriber router.Subscriber) {
+	l.events.Publish(&Event{
+		Type:         EventViewerJoin,
+		StreamID:     mediarouter.GetID(),
+		SubscriberID: subscriber.GetID(),
+	})
+}
+
+func (l *routerListener) OnSubscriberRemoved(mediarouter *router.MediaRouter, subscriber router.Subscriber) {
+	l.events.Publish(&Event{
+		Type:         EventViewerLeave,
+		StreamID:     mediarouter.GetID(),
+		SubscriberID: subscriber.GetID(),
+	})
+}
+
+func (l *routerListener) OnSubscriberTimeout(mediarouter *router.MediaRouter, subscriber router.Subscriber) {
+	l.events.Publish(&Event{
+		Type:         EventViewerTimeout,
+		StreamID:     mediarouter.GetID(),
+		SubscriberID: subscriber.GetID(),
+		Error:        "ice timeout",
+	})
+}
+
+// Events the event bus of the server
+func (s *Server) Events() *EventBus {
+	return s.events
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+
+	bus := NewEventBus()
+
+	var received []*Event
+	bus.Subscribe(func(event *Event) {
+		received = append(received, event)
+	})
+
+	bus.Publish(&Event{Type: EventStreamStart, StreamID: "stream"})
+
+	if len(received) != 1 || received[0].Type != EventStreamStart {
+		t.Fatal("handler should receive the event")
+	}
+
+	if received[0].Time == 0 {
+		t.Error("event time should be set")
+	}
+}
+
+func TestWebhookDispatcherRetry(t *testing.T) {
+
+	var attempts int32
+	events := make(chan *Event, 1)
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- &event
+	}))
+	defer webhook.Close()
+
+	dispatcher := NewWebhookDispatcher(webhook.URL, 10, 2, time.Second)
+	dispatcher.backoff = 10 * time.Millisecond
+	defer dispatcher.Stop()
+
+	dispatcher.Dispatch(&Event{Type: EventViewerJoin, StreamID: "stream", SubscriberID: "subscriber"})
+
+	select {
+	case event := <-events:
+		if event.Type != EventViewerJoin || event.SubscriberID != "subscriber" {
+			t.Errorf("wrong event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event should be delivered after retry")
+	}
+
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("should post twice, got %d", attempts)
+	}
+}
+
+func TestWebhookDispatcherNeverBlocks(t *testing.T) {
+
+	block := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer webhook.Close()
+	defer close(block)
+
+	dispatcher := NewWebhookDispatcher(webhook.URL, 2, 0, 5*time.Second)
+	defer dispatcher.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			dispatcher.Dispatch(&Event{Type: EventViewerJoin, StreamID: "stream"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch should not block on a slow webhook")
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/codec"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// ProtocolFLV the protocol of http-flv players
+const ProtocolFLV = "flv"
+
+const flvContentType = "video/x-flv"
+
+// flv tag types
+const (
+	flvTagAudio = 8
+	flvTagVideo = 9
+)
+
+// flvMuxer write h264 and aac packets as flv tags, the other codecs are skipped
+type flvMuxer struct {
+	w       io.Writer
+	streams []av.CodecData
+}
+
+func newFLVMuxer(w io.Writer) *flvMuxer {
+	return &flvMuxer{w: w}
+}
+
+// WriteHeader write the flv header and the sequence headers of the streams
+func (m *flvMuxer) WriteHeader(streams []av.CodecData) error {
+
+	m.streams = streams
+
+	var flags byte
+	for _, stream := range streams {
+		switch stream.Type() {
+		case av.H264:
+			flags |= 0x01
+		case av.AAC:
+			flags |= 0x04
+		}
+	}
+
+	// header, then the size of the previous tag which is 0
+	header := []byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+	if _, err := m.w.Write(header); err != nil {
+		return err
+	}
+
+	for _, stream := range streams {
+		var err error
+		switch data := stream.(type) {
+		case codec.AVCCodecData:
+			err = m.writeTag(flvTagVideo, flvVideoData(true, 0, 0, data.AVCDecoderConfRecordBytes()), 0)
+		case codec.AACCodecData:
+			err = m.writeTag(flvTagAudio, flvAudioData(0, data.MPEG4AudioConfigBytes()), 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePacket write the packet as a flv tag
+func (m *flvMuxer) WritePacket(packet av.Packet) error {
+
+	if int(packet.Idx) >= len(m.streams) {
+		return nil
+	}
+
+	switch m.streams[packet.Idx].Type() {
+	case av.H264:
+		return m.writeTag(flvTagVideo, flvVideoData(packet.IsKeyFrame, 1, packet.CompositionTime, packet.Data), packet.Time)
+	case av.AAC:
+		return m.writeTag(flvTagAudio, flvAudioData(1, packet.Data), packet.Time)
+	}
+	return nil
+}
+
+// WriteTrailer flv has no trailer
+func (m *flvMuxer) WriteTrailer() error {
+	return nil
+}
+
+// writeTag write the tag with its 11 bytes header, and the tag size after it
+func (m *flvMuxer) writeTag(tagType byte, data []byte, ts time.Duration) error {
+
+	timestamp := uint32(ts / time.Millisecond)
+
+	buf := make([]byte, 11, 11+len(data)+4)
+	buf[0] = tagType
+	putUint24(buf[1:], uint32(len(data)))
+	putUint24(buf[4:], timestamp&0xffffff)
+	buf[7] = byte(timestamp >> 24)
+	buf = append(buf, data...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(11+len(data)))
+
+	_, err := m.w.Write(buf)
+	return err
+}
+
+// flvVideoData the avc video tag data, packetType is 0 for the sequence header and 1 for the nalus
+func flvVideoData(keyframe bool, packetType byte, cts time.Duration, data []byte) []byte {
+
+	frameType := byte(0x27)
+	if keyframe {
+		frameType = 0x17
+	}
+
+	tag := []byte{frameType, packetType, 0, 0, 0}
+	putUint24(tag[2:], uint32(int32(cts/time.Millisecond)))
+	return append(tag, data...)
+}
+
+// flvAudioData the aac audio tag data, packetType is 0 for the audio config and 1 for the raw frames
+func flvAudioData(packetType byte, data []byte) []byte {
+	// aac, 44khz, 16 bits, stereo, as flv requires for aac
+	return append([]byte{0xaf, packetType}, data...)
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// playFLV http-flv playback of a rtmp push, GET /live/{app}/{stream}.flv
+func (s *Server) playFLV(c *gin.Context) {
+
+	if !strings.HasSuffix(c.Param("stream"), ".flv") {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	key := StreamKey{
+		Vhost:  c.Query("vhost"),
+		App:    c.Param("app"),
+		Stream: strings.TrimSuffix(c.Param("stream"), ".flv"),
+	}
+	if key.Vhost == "" {
+		key.Vhost = DefaultVhost
+	}
+	if key.Stream == "" {
+		abortWithError(c, errInvalidStreamID)
+		return
+	}
+	streamID := key.String()
+
+	if err := s.authorize(c, ActionPlay, streamID, "", ProtocolFLV); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	channel := s.getChannel(streamID)
+	if channel == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	cursor := channel.cursor()
+	streams, err := cursor.Streams()
+	if err != nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	// without a content length the response is chunked
+	c.Header("Content-Type", flvContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	muxer := newFLVMuxer(c.Writer)
+	if err := muxer.WriteHeader(streams); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	fmt.Printf("flv playing stream %s from %s\n", streamID, s.clientIP(c.Request))
+
+	// the cursor is read in its own goroutine, so a disconnect ends the request without waiting for a packet
+	packets := make(chan av.Packet)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(packets)
+		for {
+			packet, err := cursor.ReadPacket()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- packet:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	done := c.Request.Context().Done()
+
+	for {
+		select {
+		case <-done:
+			fmt.Printf("flv player of stream %s disconnected\n", streamID)
+			return
+		case packet, ok := <-packets:
+			if !ok {
+				fmt.Printf("flv playing stream %s ended\n", streamID)
+				return
+			}
+			if err := muxer.WritePacket(packet); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+type testAVCCodec struct{}
+
+func (testAVCCodec) Type() av.CodecType                { return av.H264 }
+func (testAVCCodec) AVCDecoderConfRecordBytes() []byte { return []byte{1, 2, 3} }
+
+type testAACCodec struct{}
+
+func (testAACCodec) Type() av.CodecType            { return av.AAC }
+func (testAACCodec) MPEG4AudioConfigBytes() []byte { return []byte{0x12, 0x10} }
+
+func TestFLVMuxer(t *testing.T) {
+
+	var buf bytes.Buffer
+	muxer := newFLVMuxer(&buf)
+
+	if err := muxer.WriteHeader([]av.CodecData{testAVCCodec{}, testAACCodec{}}); err != nil {
+		t.Fatal(err)
+	}
+	muxer.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: 0x01020304 * time.Millisecond, CompositionTime: 40 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x65}})
+	muxer.WritePacket(av.Packet{Idx: 1, Time: 20 * time.Millisecond, Data: []byte{0x21}})
+	muxer.WritePacket(av.Packet{Idx: 2, Data: []byte{0xff}})
+
+	want := []byte{
+		// header with audio and video, and the first previous tag size
+		'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0,
+		// avc sequence header
+		9, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0x17, 0, 0, 0, 0, 1, 2, 3, 0, 0, 0, 19,
+		// aac audio config
+		8, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0xaf, 0, 0x12, 0x10, 0, 0, 0, 15,
+		// keyframe, the upper byte of the timestamp is the extended timestamp
+		9, 0, 0, 10, 0x02, 0x03, 0x04, 0x01, 0, 0, 0, 0x17, 1, 0, 0, 40, 0, 0, 0, 1, 0x65, 0, 0, 0, 21,
+		// raw aac frame
+		8, 0, 0, 3, 0, 0, 20, 0, 0, 0, 0, 0xaf, 1, 0x21, 0, 0, 0, 14,
+	}
+
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("flv = %x\nwant  %x", buf.Bytes(), want)
+	}
+}
+
+func TestPlayFLVNotFound(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/live/live/unknown.flv", http.StatusNotFound},
+		{"/live/live/unknown", http.StatusNotFound},
+		{"/live/live/.flv", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Get(serverHTTP.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s should be %d, got %d", c.path, c.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestPlayFLV(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	channel := &Channel{que: pubsub.NewQueue(), created: time.Now()}
+	channel.que.WriteHeader([]av.CodecData{testAVCCodec{}, testAACCodec{}})
+	s.addChannel("flvtest", channel)
+
+	// the response ends once the push ends
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(serverHTTP.URL + "/live/live/flvtest.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != flvContentType {
+		t.Fatalf("flv should be served, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// the flv header and the sequence headers of the streams
+	header := make([]byte, 13+23+19)
+	if _, err := io.ReadFull(resp.Body, header); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(header, []byte{'F', 'L', 'V', 1, 0x05}) {
+		t.Errorf("flv header % x", header[:13])
+	}
+
+	// the player starts from the latest packet, the packets pushed after it joined are played
+	channel.que.WritePacket(av.Packet{Idx: 1, Time: 20 * time.Millisecond, Data: []byte{0x21}})
+	channel.que.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{8, 0, 0, 3, 0, 0, 20, 0, 0, 0, 0, 0xaf, 1, 0x21, 0, 0, 0, 14}
+	if !bytes.Equal(data, want) {
+		t.Errorf("flv = % x\nwant  % x", data, want)
+	}
+}
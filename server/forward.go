@@ -0,0 +1,431 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// forward states
+const (
+	ForwardConnecting = "connecting"
+	ForwardRunning    = "running"
+	ForwardRetrying   = "retrying"
+	ForwardStopped    = "stopped"
+)
+
+const (
+	forwardMaxBackoff = 30 * time.Second
+	// a push longer than this resets the backoff
+	forwardStableRun = 30 * time.Second
+)
+
+var errForwardNotFound = NewError(CodeStreamNotFound, "can not find forward")
+
+// forwardConn the methods of the rtmp conn a forward pushes with
+type forwardConn interface {
+	WriteHeader(streams []av.CodecData) error
+	WritePacket(packet av.Packet) error
+	WriteTrailer() error
+	Close() error
+}
+
+var dialForward = func(target string) (forwardConn, error) {
+	return rtmp.Dial(target)
+}
+
+// ForwardInfo the state and stats of a forward target, the url has no path so the stream key is not shown
+type ForwardInfo struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Connects int    `json:"connects"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+	Uptime   int64  `json:"uptime"`
+}
+
+// Forward push a rtmp channel to a rtmp url, it reconnects with backoff until it is stopped or the channel ends
+type Forward struct {
+	id        string
+	url       string
+	cursor    func() router.Demuxer
+	reconnect time.Duration
+	created   time.Time
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	sync.Mutex
+	conn      forwardConn
+	state     string
+	err       error
+	connects  int
+	packets   uint64
+	bytes     uint64
+	connected time.Time
+}
+
+// NewForward create the forward of the url, cursor returns a new reader of the channel
+func NewForward(target string, cursor func() router.Demuxer, reconnect time.Duration) *Forward {
+	return &Forward{
+		id:        uuid.Must(uuid.NewV4()).String(),
+		url:       target,
+		cursor:    cursor,
+		reconnect: reconnect,
+		created:   time.Now(),
+		stop:      make(chan struct{}),
+		state:     ForwardConnecting,
+	}
+}
+
+// GetID get forward id
+func (f *Forward) GetID() string {
+	return f.id
+}
+
+// Start push in the background
+func (f *Forward) Start() {
+	go f.run()
+}
+
+func (f *Forward) run() {
+
+	backoff := f.reconnect
+
+	for {
+		started := time.Now()
+		ended, err := f.push()
+
+		if ended || f.isStopped() {
+			f.setState(ForwardStopped, nil)
+			return
+		}
+
+		if time.Since(started) > forwardStableRun {
+			backoff = f.reconnect
+		}
+
+		fmt.Printf("forward to %s error %s, reconnect in %s\n", redactURL(f.url), err, backoff)
+		f.setState(ForwardRetrying, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-f.stop:
+			f.setState(ForwardStopped, nil)
+			return
+		}
+
+		backoff *= 2
+		if backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+// push the channel until the target fails, ended is true once the channel has no more packets
+func (f *Forward) push() (ended bool, err error) {
+
+	f.setState(ForwardConnecting, nil)
+
+	conn, err := dialForward(f.url)
+	if err != nil {
+		return false, err
+	}
+
+	f.Lock()
+	if f.isStopped() {
+		f.Unlock()
+		conn.Close()
+		return true, nil
+	}
+	f.conn = conn
+	f.connects++
+	f.Unlock()
+
+	defer func() {
+		f.Lock()
+		f.conn = nil
+		f.Unlock()
+		conn.Close()
+	}()
+
+	cursor := f.cursor()
+
+	streams, err := cursor.Streams()
+	if err != nil {
+		return true, err
+	}
+
+	if err := conn.WriteHeader(streams); err != nil {
+		return false, err
+	}
+
+	f.Lock()
+	f.state = ForwardRunning
+	f.err = nil
+	f.connected = time.Now()
+	f.Unlock()
+
+	for {
+		packet, err := cursor.ReadPacket()
+		if err != nil {
+			return true, err
+		}
+
+		if err := conn.WritePacket(packet); err != nil {
+			return false, err
+		}
+
+		f.Lock()
+		f.packets++
+		f.bytes += uint64(len(packet.Data))
+		f.Unlock()
+	}
+}
+
+// Stop stop pushing and close the connection
+func (f *Forward) Stop() {
+
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+
+	f.Lock()
+	conn := f.conn
+	f.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (f *Forward) isStopped() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *Forward) setState(state string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.state = state
+	if err != nil {
+		f.err = err
+	}
+}
+
+// Info the state and stats of the forward
+func (f *Forward) Info() *ForwardInfo {
+
+	f.Lock()
+	defer f.Unlock()
+
+	info := &ForwardInfo{
+		ID:       f.id,
+		URL:      redactURL(f.url),
+		State:    f.state,
+		Connects: f.connects,
+		Packets:  f.packets,
+		Bytes:    f.bytes,
+	}
+	if f.err != nil {
+		info.Error = f.err.Error()
+	}
+	if f.state == ForwardRunning {
+		info.Uptime = int64(time.Since(f.connected) / time.Second)
+	}
+	return info
+}
+
+// redactURL the scheme and the host of the url, the path and the query have the stream key
+func redactURL(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func (ch *Channel) addForward(forward *Forward) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.forwards == nil {
+		ch.forwards = make(map[string]*Forward)
+	}
+	ch.forwards[forward.GetID()] = forward
+}
+
+func (ch *Channel) removeForward(forwardID string) *Forward {
+	ch.Lock()
+	defer ch.Unlock()
+	forward := ch.forwards[forwardID]
+	delete(ch.forwards, forwardID)
+	return forward
+}
+
+// getForwards the forwards of the channel, the oldest first
+func (ch *Channel) getForwards() []*Forward {
+	ch.RLock()
+	defer ch.RUnlock()
+	forwards := make([]*Forward, 0, len(ch.forwards))
+	for _, forward := range ch.forwards {
+		forwards = append(forwards, forward)
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].created.Before(forwards[j].created)
+	})
+	return forwards
+}
+
+// startForward forward the channel to the url
+func (s *Server) startForward(channel *Channel, target string) *Forward {
+
+	forward := NewForward(target, channel.cursor, time.Duration(s.cfg.Forward.Reconnect)*time.Second)
+
+	channel.addForward(forward)
+	forward.Start()
+
+	return forward
+}
+
+// stopForwards stop the forwards of the channel
+func (s *Server) stopForwards(channel *Channel) {
+	for _, forward := range channel.getForwards() {
+		channel.removeForward(forward.GetID())
+		forward.Stop()
+	}
+}
+
+// addForward forward a rtmp push to a rtmp url
+func (s *Server) addForward(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId" binding:"required"`
+		URL      string `json:"url" binding:"required"`
+		Token    string `json:"token"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if parsed, err := url.Parse(data.URL); err != nil || parsed.Scheme != "rtmp" {
+		abortWithError(c, NewError(CodeInvalidStreamURL, "forward url is not a rtmp url"))
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, "rtmp"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	channel := s.getChannel(streamID)
+	if channel == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	forward := s.startForward(channel, data.URL)
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": forward.Info(),
+	})
+}
+
+// removeForward stop a forward of the rtmp push
+func (s *Server) removeForward(c *gin.Context) {
+
+	var data struct {
+		StreamID string `json:"streamId" binding:"required"`
+		ID       string `json:"id" binding:"required"`
+		Token    string `json:"token"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, "rtmp"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	channel := s.getChannel(streamID)
+	if channel == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	forward := channel.removeForward(data.ID)
+	if forward == nil {
+		abortWithError(c, errForwardNotFound)
+		return
+	}
+
+	forward.Stop()
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{},
+	})
+}
+
+// listForwards the forwards of the rtmp push with their stats, with the admin token or the publish token of the stream
+func (s *Server) listForwards(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !s.isAdmin(c) {
+		if err := s.authorize(c, ActionPublish, streamID, "", "rtmp"); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	channel := s.getChannel(streamID)
+	if channel == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	forwards := channel.getForwards()
+	infos := make([]*ForwardInfo, 0, len(forwards))
+	for _, forward := range forwards {
+		infos = append(infos, forward.Info())
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": infos,
+	})
+}
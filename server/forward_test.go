@@ -0,0 +1,257 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+// testCursor read count packets, then end or block until it is closed
+type testCursor struct {
+	count  int
+	end    bool
+	closed chan struct{}
+}
+
+func (c *testCursor) Streams() ([]av.CodecData, error) {
+	return nil, nil
+}
+
+func (c *testCursor) ReadPacket() (av.Packet, error) {
+	if c.count > 0 {
+		c.count--
+		return av.Packet{Data: []byte{0, 1, 2, 3}}, nil
+	}
+	if c.end {
+		return av.Packet{}, io.EOF
+	}
+	<-c.closed
+	return av.Packet{}, io.EOF
+}
+
+// testConn fail its writes after limit packets, or once it is closed
+type testConn struct {
+	sync.Mutex
+	limit   int
+	written int
+	closed  bool
+}
+
+func (c *testConn) WriteHeader(streams []av.CodecData) error { return nil }
+func (c *testConn) WriteTrailer() error                      { return nil }
+
+func (c *testConn) WritePacket(packet av.Packet) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed || c.written >= c.limit {
+		return errors.New("broken pipe")
+	}
+	c.written++
+	return nil
+}
+
+func (c *testConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func fakeDial(dial func(target string) (forwardConn, error)) func() {
+	old := dialForward
+	dialForward = dial
+	return func() {
+		dialForward = old
+	}
+}
+
+func waitForward(t *testing.T, forward *Forward, check func(info *ForwardInfo) bool) *ForwardInfo {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info := forward.Info()
+		if check(info) {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward did not reach the state, got %+v", info)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForwardReconnect(t *testing.T) {
+
+	var lock sync.Mutex
+	dials := 0
+
+	defer fakeDial(func(target string) (forwardConn, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		dials++
+		if dials == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return &testConn{limit: 3}, nil
+	})()
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	forward := NewForward("rtmp://127.0.0.1/live/test", func() router.Demuxer {
+		return &testCursor{count: 5, closed: closed}
+	}, 10*time.Millisecond)
+	forward.Start()
+
+	// the first dial fails, then each connection breaks after 3 packets
+	info := waitForward(t, forward, func(info *ForwardInfo) bool {
+		return info.Connects >= 2
+	})
+
+	if info.Packets < 3 || info.Bytes != info.Packets*4 {
+		t.Errorf("wrong forward stats %+v", info)
+	}
+
+	forward.Stop()
+
+	info = waitForward(t, forward, func(info *ForwardInfo) bool {
+		return info.State == ForwardStopped
+	})
+
+	if info.Error == "" {
+		t.Error("forward should keep the last error")
+	}
+}
+
+func TestForwardChannelEnds(t *testing.T) {
+
+	conn := &testConn{limit: 100}
+	defer fakeDial(func(target string) (forwardConn, error) {
+		return conn, nil
+	})()
+
+	forward := NewForward("rtmp://127.0.0.1/live/test", func() router.Demuxer {
+		return &testCursor{count: 5, end: true}
+	}, time.Millisecond)
+	forward.Start()
+
+	info := waitForward(t, forward, func(info *ForwardInfo) bool {
+		return info.State == ForwardStopped
+	})
+
+	if info.Connects != 1 || info.Packets != 5 {
+		t.Errorf("forward should stop without reconnect when the channel ends, got %+v", info)
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	if !conn.closed {
+		t.Error("the connection should be closed")
+	}
+}
+
+func TestForwardAPI(t *testing.T) {
+
+	defer fakeDial(func(target string) (forwardConn, error) {
+		return nil, errors.New("connection refused")
+	})()
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "forwardtest"
+	channel := &Channel{que: pubsub.NewQueue(), created: time.Now()}
+	s.addChannel(streamID, channel)
+
+	var result Error
+
+	if status := postJSON(t, serverHTTP.URL+"/api/forward/add", map[string]string{"streamId": "unknown", "url": "rtmp://127.0.0.1/live/test"}, &result); status != 404 {
+		t.Errorf("forward of unknown stream should be not found, got %d", status)
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/forward/add", map[string]string{"streamId": streamID, "url": "http://127.0.0.1/live/test"}, &result); status != 400 || result.Code != CodeInvalidStreamURL {
+		t.Errorf("forward to a non rtmp url should fail, got %d/%d", status, result.Code)
+	}
+
+	var added struct {
+		S ErrorCode    `json:"s"`
+		D *ForwardInfo `json:"d"`
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/forward/add", map[string]string{"streamId": streamID, "url": "rtmp://127.0.0.1/live/test"}, &added); status != 200 || added.D.ID == "" {
+		t.Fatalf("add forward should succeed, got %d", status)
+	}
+
+	var list struct {
+		S ErrorCode      `json:"s"`
+		D []*ForwardInfo `json:"d"`
+	}
+
+	if status := getJSON(t, serverHTTP.URL+"/api/streams/"+streamID+"/forwards", &list); status != 200 || len(list.D) != 1 || list.D[0].ID != added.D.ID {
+		t.Fatalf("list forwards should return the forward, got %d %+v", status, list.D)
+	}
+	if list.D[0].URL != "rtmp://127.0.0.1" {
+		t.Errorf("the forward url should not have the stream key, got %s", list.D[0].URL)
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/forward/remove", map[string]string{"streamId": streamID, "id": "unknown"}, &result); status != 404 {
+		t.Errorf("remove unknown forward should be not found, got %d", status)
+	}
+
+	var removed struct {
+		S ErrorCode `json:"s"`
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/forward/remove", map[string]string{"streamId": streamID, "id": added.D.ID}, &removed); status != 200 {
+		t.Errorf("remove forward should succeed, got %d", status)
+	}
+
+	if len(channel.getForwards()) != 0 {
+		t.Error("removed forward should be gone")
+	}
+}
+
+func TestListForwardsUnauthorized(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	s.SetAuthenticator(NewTokenAuth("secret"))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "forwardauth"
+	s.addChannel(streamID, &Channel{que: pubsub.NewQueue(), created: time.Now()})
+
+	var list struct {
+		S ErrorCode      `json:"s"`
+		D []*ForwardInfo `json:"d"`
+	}
+
+	address := serverHTTP.URL + "/api/streams/" + streamID + "/forwards"
+
+	if status := getJSON(t, address, &list); status != http.StatusUnauthorized {
+		t.Errorf("list forwards without token should be unauthorized, got %d", status)
+	}
+
+	if status := getAdmin(t, address, "admintoken", &list); status != 200 {
+		t.Errorf("list forwards with the admin token should succeed, got %d", status)
+	}
+
+	token := GenerateToken("secret", ActionPublish, streamID, time.Now().Add(time.Minute))
+	if status := getJSON(t, address+"?token="+token, &list); status != 200 {
+		t.Errorf("list forwards with the publish token should succeed, got %d", status)
+	}
+
+	token = GenerateToken("secret", ActionPlay, streamID, time.Now().Add(time.Minute))
+	if status := getJSON(t, address+"?token="+token, &list); status != http.StatusUnauthorized {
+		t.Errorf("list forwards with a play token should be unauthorized, got %d", status)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/hls"
+)
+
+// ProtocolHLS the protocol of hls players
+const ProtocolHLS = "hls"
+
+const (
+	hlsPlaylist     = "index.m3u8"
+	hlsPlaylistType = "application/vnd.apple.mpegurl"
+	hlsSegmentType  = "video/mp2t"
+)
+
+var (
+	errInvalidBlockingReload = NewError(CodeBadRequest, "_HLS_msn should be a media sequence number not too far ahead, and _HLS_part needs it")
+	errInvalidHLSSignature   = NewError(CodeUnauthorized, "the segment signature is invalid or expired")
+)
+
+// startHLS package the active push of the stream, the packager is kept when the push is taken over,
+// the streams of the apps which do not allow play are not packaged
+func (s *Server) startHLS(streamID string, channel *Channel) {
+
+	if s.cfg.HLS == nil {
+		return
+	}
+
+	key, _ := ParseStreamKey(streamID)
+	if !s.cfg.App(key.Vhost, key.App).Play {
+		return
+	}
+
+	s.Lock()
+	packager := s.packagers[streamID]
+	if packager == nil {
+		packager = hls.NewPackager(hls.Config{
+			Segment: time.Duration(s.cfg.HLS.Segment) * time.Second,
+			Window:  s.cfg.HLS.Window,
+			Part:    time.Duration(s.cfg.HLS.Part) * time.Millisecond,
+		})
+		s.packagers[streamID] = packager
+	}
+	s.Unlock()
+
+	go s.packHLS(streamID, channel, packager)
+}
+
+// packHLS feed the packager with the channel while it is the active push of the stream
+func (s *Server) packHLS(streamID string, channel *Channel, packager *hls.Packager) {
+
+	cursor := channel.cursor()
+	streams, err := cursor.Streams()
+	if err != nil {
+		return
+	}
+
+	if err := packager.WriteHeader(streams); err != nil {
+		fmt.Printf("hls of stream %s: %s\n", streamID, err)
+		return
+	}
+
+	for {
+		packet, err := cursor.ReadPacket()
+		if err != nil {
+			return
+		}
+		// the push has been taken over, the new push feeds the packager
+		if s.getChannel(streamID) != channel {
+			return
+		}
+		packager.WritePacket(packet)
+	}
+}
+
+// stopHLS end the playlist of the stream
+func (s *Server) stopHLS(streamID string) {
+
+	s.Lock()
+	packager := s.packagers[streamID]
+	delete(s.packagers, streamID)
+	s.Unlock()
+
+	if packager != nil {
+		packager.Close()
+	}
+}
+
+func (s *Server) getPackager(streamID string) *hls.Packager {
+	s.RLock()
+	defer s.RUnlock()
+	return s.packagers[streamID]
+}
+
+// hlsTimeout how long a blocking playlist reload or a preloaded part is held
+func (s *Server) hlsTimeout() time.Duration {
+	return 3 * time.Duration(s.cfg.HLS.Segment) * time.Second
+}
+
+// hlsExpiry how long the signature of the segment uris lasts, a player reloads the playlist well before
+func (s *Server) hlsExpiry() time.Duration {
+	return time.Duration(s.cfg.HLS.Window*s.cfg.HLS.Segment)*time.Second + s.hlsTimeout()
+}
+
+// hlsSignature sign the segment uris of the stream until expires, with the secret of the server
+func (s *Server) hlsSignature(streamID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.internalSecret))
+	fmt.Fprintf(mac, "%s\n%d", streamID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkHLSSignature check the signature of a segment or part uri
+func (s *Server) checkHLSSignature(c *gin.Context, streamID string) error {
+
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return errInvalidHLSSignature
+	}
+	if !hmac.Equal([]byte(c.Query("signature")), []byte(s.hlsSignature(streamID, expires))) {
+		return errInvalidHLSSignature
+	}
+	return nil
+}
+
+// playHLS serve the playlist, the segments and the parts of a rtmp push, GET /hls/{app}/{stream}/{file},
+// the playlist is authorized, the segments are checked by the signature the playlist gives their uris
+func (s *Server) playHLS(c *gin.Context) {
+
+	key := StreamKey{
+		Vhost:  c.Query("vhost"),
+		App:    c.Param("app"),
+		Stream: c.Param("stream"),
+	}
+	if key.Vhost == "" {
+		key.Vhost = DefaultVhost
+	}
+	streamID := key.String()
+
+	if c.Param("file") == hlsPlaylist {
+		s.servePlaylist(c, key, streamID)
+		return
+	}
+
+	if err := s.checkHLSSignature(c, streamID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	packager := s.getPackager(streamID)
+	if packager == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	msn, part, ok := packager.Lookup(c.Param("file"))
+	if !ok {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	var data []byte
+	if part < 0 {
+		data, ok = packager.Segment(msn)
+	} else {
+		data, ok = packager.Part(msn, part)
+		// the preload hint is the next part of the segment being written
+		if !ok && msn == packager.Next() && packager.Wait(msn, part, s.hlsTimeout()) {
+			data, ok = packager.Part(msn, part)
+		}
+	}
+	if !ok {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	// the segments and the parts never change, their uris are unique to the packager and expire with the signature
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.hlsExpiry()/time.Second)))
+	c.Data(http.StatusOK, hlsSegmentType, data)
+}
+
+// servePlaylist serve the playlist, a blocking reload with _HLS_msn and _HLS_part waits for the segment or the part
+func (s *Server) servePlaylist(c *gin.Context, key StreamKey, streamID string) {
+
+	if err := s.authorize(c, ActionPlay, streamID, "", ProtocolHLS); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	packager := s.getPackager(streamID)
+	if packager == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	if c.Query("_HLS_msn") != "" || c.Query("_HLS_part") != "" {
+		msn, err := strconv.Atoi(c.Query("_HLS_msn"))
+		if err != nil || msn < 0 || msn > packager.Next()+2 {
+			abortWithError(c, errInvalidBlockingReload)
+			return
+		}
+		part := -1
+		if c.Query("_HLS_part") != "" {
+			if part, err = strconv.Atoi(c.Query("_HLS_part")); err != nil || part < 0 {
+				abortWithError(c, errInvalidBlockingReload)
+				return
+			}
+		}
+		packager.Wait(msn, part, s.hlsTimeout())
+	}
+
+	// the uris keep the vhost of the stream and are signed instead of carrying the token, the expiry is
+	// rounded so the uris stay the same across reloads and can be cached
+	expiry := int64(s.hlsExpiry() / time.Second)
+	expires := (time.Now().Unix()/expiry + 2) * expiry
+
+	query := url.Values{}
+	if key.Vhost != DefaultVhost {
+		query.Set("vhost", key.Vhost)
+	}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", s.hlsSignature(streamID, expires))
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, hlsPlaylistType, packager.Playlist("?"+query.Encode()))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/hls"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func TestPlayHLS(t *testing.T) {
+
+	s := New(extendConfig(t, "\nhls:\n  segment: 1\n  window: 3\n"))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	// an audio only push, segments are cut every second
+	packager := hls.NewPackager(hls.Config{Segment: time.Second, Window: 3})
+	packager.WriteHeader([]av.CodecData{testAACCodec{}})
+	for ts := time.Duration(0); ts < 3*time.Second; ts += 100 * time.Millisecond {
+		packager.WritePacket(av.Packet{Time: ts, Data: []byte{0x21}})
+	}
+
+	s.Lock()
+	s.packagers["test/hlstest"] = packager
+	s.Unlock()
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(serverHTTP.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, playlist := get("/hls/test/hlstest/index.m3u8")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != hlsPlaylistType || res.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("playlist should be served, got %d %v", res.StatusCode, res.Header)
+	}
+
+	var segment string
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.Contains(line, ".ts?") {
+			segment = line
+			break
+		}
+	}
+	if segment == "" {
+		t.Fatalf("playlist should list the segments\n%s", playlist)
+	}
+
+	res, data := get("/hls/test/hlstest/" + segment)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != hlsSegmentType || !strings.Contains(res.Header.Get("Cache-Control"), "max-age") || len(data)%188 != 0 {
+		t.Errorf("segment should be served, got %d %v", res.StatusCode, res.Header)
+	}
+
+	// the segment is ready, the blocking reload does not wait
+	if res, _ := get("/hls/test/hlstest/index.m3u8?_HLS_msn=0"); res.StatusCode != http.StatusOK {
+		t.Errorf("blocking reload of a ready segment should be served, got %d", res.StatusCode)
+	}
+
+	// the segments are signed for the stream until they expire
+	name := segment[:strings.Index(segment, "?")]
+	expired := "?expires=1&signature=" + s.hlsSignature("test/hlstest", 1)
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/hls/test/hlstest/index.m3u8?_HLS_msn=abc", http.StatusBadRequest},
+		{"/hls/test/hlstest/index.m3u8?_HLS_msn=100", http.StatusBadRequest},
+		{"/hls/test/hlstest/index.m3u8?_HLS_part=1", http.StatusBadRequest},
+		{"/hls/test/hlstest/other-0.ts" + segment[strings.Index(segment, "?"):], http.StatusNotFound},
+		{"/hls/live/hlstest/index.m3u8", http.StatusNotFound},
+		{"/hls/test/hlstest/" + name, http.StatusUnauthorized},
+		{"/hls/test/hlstest/" + name + expired, http.StatusUnauthorized},
+		{"/hls/test/hlstest/" + segment + "0", http.StatusUnauthorized},
+		{"/hls/live/hlstest/" + segment, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		if res, _ := get(c.path); res.StatusCode != c.status {
+			t.Errorf("%s should be %d, got %d", c.path, c.status, res.StatusCode)
+		}
+	}
+}
+
+func TestHLSPlayDenied(t *testing.T) {
+
+	s := New(extendConfig(t, "\nhls:\n  segment: 1\n\napps:\n  closed:\n    play: false\n"))
+
+	s.startHLS("closed/hlstest", &Channel{que: pubsub.NewQueue(), created: time.Now()})
+	if s.getPackager("closed/hlstest") != nil {
+		t.Error("the streams of an app which denies play should not be packaged")
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/router"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	routersDesc = prometheus.NewDesc("rtclive_routers",
+		"Number of media routers.", nil, nil)
+	rtmpChannelsDesc = prometheus.NewDesc("rtclive_rtmp_channels",
+		"Number of rtmp channels being published.", nil, nil)
+	subscribersDesc = prometheus.NewDesc("rtclive_subscribers",
+		"Number of subscribers of the router.", []string{"stream"}, nil)
+	ffmpegDesc = prometheus.NewDesc("rtclive_ffmpeg_processes",
+		"Number of ffmpeg pipelines.", nil, nil)
+	iceRequestsReceivedDesc = prometheus.NewDesc("rtclive_ice_requests_received_total",
+		"Ice requests received by the subscriber transports of the router.", []string{"stream"}, nil)
+	iceRequestsSentDesc = prometheus.NewDesc("rtclive_ice_requests_sent_total",
+		"Ice requests sent by the subscriber transports of the router.", []string{"stream"}, nil)
+	iceResponsesReceivedDesc = prometheus.NewDesc("rtclive_ice_responses_received_total",
+		"Ice responses received by the subscriber transports of the router.", []string{"stream"}, nil)
+	iceResponsesSentDesc = prometheus.NewDesc("rtclive_ice_responses_sent_total",
+		"Ice responses sent by the subscriber transports of the router.", []string{"stream"}, nil)
+)
+
+type iceStatsGetter interface {
+	GetICEStats() mediaserver.ICEStats
+}
+
+// metrics the prometheus metrics of the server
+type metrics struct {
+	registry    *prometheus.Registry
+	publishes   *prometheus.CounterVec
+	plays       prometheus.Counter
+	pullFailed  prometheus.Counter
+	ffRestarts  prometheus.Counter
+	apiFailures *prometheus.CounterVec
+	routes      map[string]string
+}
+
+func newMetrics(s *Server) *metrics {
+
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		publishes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rtclive_publishes_total",
+			Help: "Number of streams published.",
+		}, []string{"protocol"}),
+		plays: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rtclive_plays_total",
+			Help: "Number of subscribers created.",
+		}),
+		pullFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rtclive_pull_failures_total",
+			Help: "Number of ffmpeg pulls exited with error.",
+		}),
+		ffRestarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rtclive_ffmpeg_restarts_total",
+			Help: "Number of ffmpeg restarts after a failure.",
+		}),
+		apiFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rtclive_api_failures_total",
+			Help: "Number of failed api requests.",
+		}, []string{"path", "status"}),
+	}
+
+	m.registry.MustRegister(m.publishes, m.plays, m.pullFailed, m.ffRestarts, m.apiFailures)
+	m.registry.MustRegister(&serverCollector{server: s})
+	m.registry.MustRegister(prometheus.NewGoCollector())
+
+	s.events.Subscribe(m.onEvent)
+
+	return m
+}
+
+func (m *metrics) onEvent(event *Event) {
+
+	switch event.Type {
+	case EventStreamStart:
+		// the pulls, relays and egress channels restream a publish, they are not counted
+		switch event.Protocol {
+		case ProtocolPull, ProtocolRelay, ProtocolEgress:
+		default:
+			m.publishes.WithLabelValues(event.Protocol).Inc()
+		}
+	case EventViewerJoin:
+		m.plays.Inc()
+	case EventPullFailed:
+		m.pullFailed.Inc()
+	case EventPullRestart:
+		m.ffRestarts.Inc()
+	}
+}
+
+// setRoutes keep the path of each route by its method and handler, the failed requests are labeled
+// with the route they matched, it is called once all the routes are registered
+func (m *metrics) setRoutes(routes gin.RoutesInfo) {
+	m.routes = make(map[string]string)
+	for _, route := range routes {
+		m.routes[route.Method+" "+route.Handler] = route.Path
+	}
+}
+
+// middleware count the failed requests
+func (m *metrics) middleware(c *gin.Context) {
+
+	c.Next()
+
+	status := c.Writer.Status()
+	path, ok := m.routes[c.Request.Method+" "+c.HandlerName()]
+	if status < 400 || !ok {
+		return
+	}
+	m.apiFailures.WithLabelValues(path, strconv.Itoa(status)).Inc()
+}
+
+// handler serve the metrics
+func (m *metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// serverCollector read the gauges from the server state on each scrape
+type serverCollector struct {
+	server *Server
+}
+
+func (sc *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- routersDesc
+	ch <- rtmpChannelsDesc
+	ch <- subscribersDesc
+	ch <- ffmpegDesc
+	ch <- iceRequestsReceivedDesc
+	ch <- iceRequestsSentDesc
+	ch <- iceResponsesReceivedDesc
+	ch <- iceResponsesSentDesc
+}
+
+func (sc *serverCollector) Collect(ch chan<- prometheus.Metric) {
+
+	s := sc.server
+
+	s.RLock()
+	routers := make([]*router.MediaRouter, 0, len(s.routers))
+	for _, mediarouter := range s.routers {
+		routers = append(routers, mediarouter)
+	}
+	channels := len(s.rtmpChannels)
+	s.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(routersDesc, prometheus.GaugeValue, float64(len(routers)))
+	ch <- prometheus.MustNewConstMetric(rtmpChannelsDesc, prometheus.GaugeValue, float64(channels))
+
+	ffmpegs := 0
+
+	for _, mediarouter := range routers {
+
+		if _, ok := mediarouter.GetPublisher().(*router.FFPublisher); ok {
+			ffmpegs++
+		}
+
+		streamID := mediarouter.GetID()
+		subscribers := mediarouter.GetSubscribers()
+
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(len(subscribers)), streamID)
+
+		// the subscribers come and go, their ice stats are summed by stream so the series stay bounded
+		var total mediaserver.ICEStats
+		for _, subscriber := range subscribers {
+			getter, ok := subscriber.(iceStatsGetter)
+			if !ok {
+				continue
+			}
+			stats := getter.GetICEStats()
+			total.RequestsReceived += stats.RequestsReceived
+			total.RequestsSent += stats.RequestsSent
+			total.ResponsesReceived += stats.ResponsesReceived
+			total.ResponsesSent += stats.ResponsesSent
+		}
+		ch <- prometheus.MustNewConstMetric(iceRequestsReceivedDesc, prometheus.CounterValue, float64(total.RequestsReceived), streamID)
+		ch <- prometheus.MustNewConstMetric(iceRequestsSentDesc, prometheus.CounterValue, float64(total.RequestsSent), streamID)
+		ch <- prometheus.MustNewConstMetric(iceResponsesReceivedDesc, prometheus.CounterValue, float64(total.ResponsesReceived), streamID)
+		ch <- prometheus.MustNewConstMetric(iceResponsesSentDesc, prometheus.CounterValue, float64(total.ResponsesSent), streamID)
+	}
+
+	ch <- prometheus.MustNewConstMetric(ffmpegDesc, prometheus.GaugeValue, float64(ffmpegs))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func TestMetrics(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "metricstest"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	s.addChannel("rtmptest", &Channel{que: pubsub.NewQueue()})
+
+	s.events.Publish(&Event{Type: EventStreamStart, StreamID: streamID, Protocol: "whip"})
+	s.events.Publish(&Event{Type: EventStreamStart, StreamID: streamID, Protocol: ProtocolPull})
+	s.events.Publish(&Event{Type: EventPullFailed, StreamID: streamID})
+
+	resp, err := http.Post(serverHTTP.URL+"/api/unpublish", "application/json", strings.NewReader(`{"streamId":"unknown"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(serverHTTP.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics without the admin token should be unauthorized, got %d", resp.StatusCode)
+	}
+
+	request, _ := http.NewRequest("GET", serverHTTP.URL+"/metrics", nil)
+	request.Header.Set("Authorization", "Bearer admintoken")
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected := []string{
+		"rtclive_routers 1",
+		"rtclive_rtmp_channels 1",
+		`rtclive_subscribers{stream="metricstest"} 0`,
+		"rtclive_ffmpeg_processes 0",
+		`rtclive_publishes_total{protocol="whip"} 1`,
+		"rtclive_pull_failures_total 1",
+		`rtclive_api_failures_total{path="/api/unpublish",status="404"} 1`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics should contain %s", line)
+		}
+	}
+
+	if strings.Contains(string(body), `rtclive_publishes_total{protocol="pull"}`) {
+		t.Error("pulls should not be counted as publishes")
+	}
+}
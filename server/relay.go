@@ -0,0 +1,367 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imroc/req"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/router"
+)
+
+const (
+	relayTimeout    = 3 * time.Second
+	upstreamTimeout = 15 * time.Second
+)
+
+// ProtocolRelay the protocol of the edges relaying a stream
+const ProtocolRelay = "relay"
+
+// relay is called by an edge server, the edge sends its offer and we answer it
+// with a subscriber on the local router, so the edge can pull the stream over webrtc
+func (s *Server) relay(c *gin.Context) {
+
+	var data struct {
+		StreamURL string `json:"streamUrl"`
+		StreamID  string `json:"streamId" binding:"required"`
+		Sdp       string `json:"sdp" binding:"required"`
+	}
+
+	if err := c.ShouldBind(&data); err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if !s.cfg.Relay {
+		abortWithError(c, errRelayDisabled)
+		return
+	}
+
+	if err := s.authorizeRelay(c, streamID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+
+	// we only relay streams pushed to us, other nodes will pull the source themselves
+	if mediarouter == nil && s.getChannel(streamID) == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	if mediarouter == nil {
+		var err error
+		mediarouter, err = s.createRouter(streamID, data.StreamURL, "")
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	subscriber, err := mediarouter.CreateSubscriber(data.Sdp)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	s.setClientIP(subscriber, c)
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": map[string]string{
+			"sdp":          subscriber.GetAnswer(),
+			"subscriberId": subscriber.GetID(),
+		}})
+}
+
+// authorizeRelay check the relay request of an edge, it needs the cluster secret as a bearer Authorization header,
+// without a secret it is authorized as a play. the app and the bans apply to the relayed stream either way
+func (s *Server) authorizeRelay(c *gin.Context, streamID string) error {
+
+	if s.cfg.Cluster == nil || s.cfg.Cluster.Secret == "" {
+		return s.authorize(c, ActionPlay, streamID, "", ProtocolRelay)
+	}
+
+	if !s.isCluster(c) {
+		return errClusterSecret
+	}
+
+	if _, err := s.checkApp(ActionPlay, streamID); err != nil {
+		return err
+	}
+	return s.bans.check(streamID, s.clientIP(c.Request))
+}
+
+// isCluster the request has the cluster secret in the bearer Authorization header
+func (s *Server) isCluster(c *gin.Context) bool {
+
+	if s.cfg.Cluster == nil || s.cfg.Cluster.Secret == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Cluster.Secret)) == 1
+}
+
+// upstream the relay of an edge from an origin, the subscriber is the one of the edge on the origin
+type upstream struct {
+	origin       string
+	subscriberID string
+	publisher    *router.RTCPublisher
+}
+
+// relayFromOrigins probe the origins in order, and create a router whose publisher
+// is the single upstream transport from the first origin which has the stream
+func (s *Server) relayFromOrigins(streamID string, streamURL string, origins []string) (*router.MediaRouter, error) {
+
+	mediarouter := s.newRouter(streamID, s.getEndpoint(streamID), false)
+
+	index, up, err := s.connectOrigins(mediarouter, streamURL, origins, 0)
+	if err != nil {
+		s.removeEndpoint(streamID)
+		return nil, err
+	}
+
+	// another request relayed the stream meanwhile, ours is dropped with its subscriber on the origin
+	if existing, added := s.insertRouter(mediarouter); !added {
+		mediarouter.Stop()
+		s.unplayOrigin(streamID, up)
+		return existing, nil
+	}
+	s.closeOnIdle(mediarouter)
+
+	s.events.Publish(&Event{
+		Type:     EventStreamStart,
+		StreamID: streamID,
+		Protocol: ProtocolRelay,
+	})
+
+	go s.watchRelay(mediarouter, up, streamURL, origins, index)
+
+	return mediarouter, nil
+}
+
+// connectOrigins try the origins from start, return the index of the connected one
+func (s *Server) connectOrigins(mediarouter *router.MediaRouter, streamURL string, origins []string, start int) (int, *upstream, error) {
+
+	if len(origins) == 0 {
+		return -1, nil, errors.New("no origin to relay from")
+	}
+
+	var up *upstream
+	var err error
+	for i := 0; i < len(origins); i++ {
+		index := (start + i) % len(origins)
+		origin := origins[index]
+
+		if err = s.checkOrigin(origin); err != nil {
+			fmt.Printf("origin %s is not healthy: %s\n", origin, err)
+			continue
+		}
+
+		up, err = s.relayFromOrigin(mediarouter, streamURL, origin)
+		if err != nil {
+			fmt.Printf("relay %s from origin %s error: %s\n", mediarouter.GetID(), origin, err)
+			continue
+		}
+		return index, up, nil
+	}
+
+	return -1, nil, fmt.Errorf("can not relay %s from any origin, last error: %s", mediarouter.GetID(), err)
+}
+
+// checkOrigin health check the origin's http server
+func (s *Server) checkOrigin(origin string) error {
+
+	client := &http.Client{Timeout: s.clusterTimeout()}
+
+	resp, err := client.Get("http://" + origin + "/test")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// relayFromOrigin ask the origin's /api/relay for the stream, and make the upstream
+// transport the publisher of the router
+func (s *Server) relayFromOrigin(mediarouter *router.MediaRouter, streamURL string, origin string) (*upstream, error) {
+
+	streamID := mediarouter.GetID()
+	endpoint := s.getEndpoint(streamID)
+
+	offer := endpoint.CreateOffer(s.cfg.Capabilities["video"], s.cfg.Capabilities["audio"])
+
+	data := map[string]string{
+		"streamUrl": streamURL,
+		"streamId":  streamID,
+		"sdp":       offer.String(),
+	}
+
+	client := &http.Client{Timeout: s.clusterTimeout()}
+
+	resp, err := req.Post("http://"+origin+"/api/relay", s.clusterHeader(), req.BodyJSON(data), client)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		S ErrorCode `json:"s"`
+		E string    `json:"e"`
+		D struct {
+			Sdp          string `json:"sdp"`
+			SubscriberID string `json:"subscriberId"`
+		} `json:"d"`
+	}
+
+	if err = resp.ToJSON(&result); err != nil {
+		return nil, err
+	}
+
+	if result.S != CodeOK {
+		return nil, fmt.Errorf("origin %s relay error %d: %s", origin, result.S, result.E)
+	}
+
+	up := &upstream{
+		origin:       origin,
+		subscriberID: result.D.SubscriberID,
+	}
+
+	up.publisher, err = mediarouter.CreateRelayPublisher(offer.String(), result.D.Sdp)
+	if err != nil {
+		s.unplayOrigin(streamID, up)
+		return nil, err
+	}
+	return up, nil
+}
+
+// unplayOrigin stop the subscriber of the edge on the origin, so the origin does not keep sending the stream
+func (s *Server) unplayOrigin(streamID string, up *upstream) {
+
+	if up.subscriberID == "" {
+		return
+	}
+
+	data := map[string]string{
+		"streamId":     streamID,
+		"subscriberId": up.subscriberID,
+	}
+
+	client := &http.Client{Timeout: s.clusterTimeout()}
+
+	resp, err := req.Post("http://"+up.origin+"/api/unplay", s.clusterHeader(), req.BodyJSON(data), client)
+	if err != nil {
+		fmt.Printf("unplay %s from origin %s error: %s\n", streamID, up.origin, err)
+		return
+	}
+
+	var result struct {
+		S ErrorCode `json:"s"`
+		E string    `json:"e"`
+	}
+
+	if err = resp.ToJSON(&result); err != nil {
+		fmt.Printf("unplay %s from origin %s error: %s\n", streamID, up.origin, err)
+		return
+	}
+
+	if result.S != CodeOK {
+		fmt.Printf("unplay %s from origin %s error %d: %s\n", streamID, up.origin, result.S, result.E)
+	}
+}
+
+// clusterHeader the Authorization header of the requests to the origins
+func (s *Server) clusterHeader() req.Header {
+
+	header := req.Header{}
+	if s.cfg.Cluster != nil && s.cfg.Cluster.Secret != "" {
+		header["Authorization"] = "Bearer " + s.cfg.Cluster.Secret
+	}
+	return header
+}
+
+// watchRelay switch to the next origin when there is no ice traffic on the upstream transport,
+// the upstream sends stun keepalives so a healthy relay always gets responses from the origin.
+// the subscriber on the origin is unplayed on failover, and once the router stops or is taken over
+func (s *Server) watchRelay(mediarouter *router.MediaRouter, up *upstream, streamURL string, origins []string, index int) {
+
+	streamID := mediarouter.GetID()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	activity := &iceActivity{lastActive: time.Now()}
+
+	for now := range ticker.C {
+
+		// the router is closed on idle or stopped, or the stream has been taken over by a local publisher
+		if s.getRouter(streamID) != mediarouter || mediarouter.GetPublisher() != up.publisher {
+			s.unplayOrigin(streamID, up)
+			return
+		}
+
+		if !activity.dropped(up.publisher.GetTransport().GetICEStats(), now, s.upstreamTimeout()) {
+			continue
+		}
+
+		fmt.Printf("upstream of %s from origin %s dropped\n", streamID, up.origin)
+		s.unplayOrigin(streamID, up)
+
+		var err error
+		index, up, err = s.connectOrigins(mediarouter, streamURL, origins, index+1)
+		if err != nil {
+			fmt.Println(err)
+			s.closeStream(mediarouter, ProtocolRelay)
+			return
+		}
+
+		activity = &iceActivity{lastActive: time.Now()}
+	}
+}
+
+// iceActivity tell a transport dropped when its ice stats do not change for a while
+type iceActivity struct {
+	stats      mediaserver.ICEStats
+	lastActive time.Time
+}
+
+// dropped update the activity with the stats read at now, true if there was no ice traffic for the timeout
+func (a *iceActivity) dropped(stats mediaserver.ICEStats, now time.Time, timeout time.Duration) bool {
+
+	if stats.RequestsReceived != a.stats.RequestsReceived || stats.ResponsesReceived != a.stats.ResponsesReceived {
+		a.stats = stats
+		a.lastActive = now
+		return false
+	}
+
+	return now.Sub(a.lastActive) >= timeout
+}
+
+func (s *Server) clusterTimeout() time.Duration {
+	if s.cfg.Cluster != nil {
+		return time.Duration(s.cfg.Cluster.Timeout) * time.Second
+	}
+	return relayTimeout
+}
+
+func (s *Server) upstreamTimeout() time.Duration {
+	if s.cfg.Cluster != nil {
+		return time.Duration(s.cfg.Cluster.UpstreamTimeout) * time.Second
+	}
+	return upstreamTimeout
+}
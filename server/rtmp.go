@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func (s *Server) startRtmp() {
+
+	s.rtmpServer = &rtmp.Server{
+		Addr: fmt.Sprintf("%s:%d", s.cfg.Rtmp.Host, s.cfg.Rtmp.Port),
+	}
+
+	s.rtmpServer.HandlePlay = s.handleRtmpPlay
+	s.rtmpServer.HandlePublish = s.handleRtmpPublish
+
+	err := s.rtmpServer.ListenAndServe()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *Server) handleRtmpPlay(conn *rtmp.Conn) {
+
+	key, err := rtmpStreamKey(conn.URL)
+	if err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+
+	streamID := key.String()
+
+	fmt.Printf("playing stream %s in app %s\n", key.Stream, key.App)
+
+	if err := s.authenticateRtmp(conn, ActionPlay, streamID); err != nil {
+		fmt.Printf("rtmp play %s denied: %s\n", streamID, err)
+		conn.Close()
+		return
+	}
+
+	ch := s.getChannel(streamID)
+
+	if ch != nil {
+		cursor := ch.cursor()
+		streams, err := cursor.Streams()
+		if err != nil {
+			fmt.Println(err)
+			conn.Close()
+			return
+		}
+		conn.WriteHeader(streams)
+		for {
+			packet, err := cursor.ReadPacket()
+			if err != nil {
+				break
+			}
+			err = conn.WritePacket(packet)
+			if err != nil {
+				break
+			}
+		}
+	}
+	conn.Close()
+}
+
+func (s *Server) handleRtmpPublish(conn *rtmp.Conn) {
+
+	key, err := rtmpStreamKey(conn.URL)
+	if err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+
+	streamID := key.String()
+
+	fmt.Printf("publishing stream %s in app %s\n", key.Stream, key.App)
+
+	if err := s.authenticateRtmp(conn, ActionPublish, streamID); err != nil {
+		fmt.Printf("rtmp publish %s denied: %s\n", streamID, err)
+		conn.Close()
+		return
+	}
+
+	// refuse the duplicate push before reading it
+	if s.cfg.Publish.Duplicate == config.DuplicateReject && s.getChannel(streamID) != nil {
+		fmt.Printf("rtmp publish %s rejected: %s\n", streamID, errStreamPublished)
+		conn.Close()
+		return
+	}
+
+	streams, err := conn.Streams()
+	if err != nil {
+		fmt.Println(err)
+		conn.Close()
+		return
+	}
+
+	ch := &Channel{}
+	ch.conn = conn
+	ch.created = time.Now()
+	ch.que = pubsub.NewQueue()
+	ch.setGopCache(s.cfg.App(key.Vhost, key.App).GopCache, streams)
+	ch.setStreams(streams)
+	ch.que.WriteHeader(streams)
+
+	replaced, active, err := s.claimChannel(streamID, ch)
+	if err != nil {
+		fmt.Printf("rtmp publish %s rejected: %s\n", streamID, err)
+		ch.que.Close()
+		conn.Close()
+		return
+	}
+
+	switch {
+	case replaced != nil:
+		fmt.Printf("rtmp publish %s takes over the stream\n", streamID)
+		s.moveChannel(streamID, replaced, ch)
+		replaced.conn.Close()
+	case active:
+		s.events.Publish(&Event{
+			Type:     EventStreamStart,
+			StreamID: streamID,
+			Protocol: "rtmp",
+		})
+		for _, target := range s.cfg.Forward.Targets(key.App, key.Stream) {
+			s.startForward(ch, target)
+		}
+		s.startHLS(streamID, ch)
+	default:
+		fmt.Printf("rtmp publish %s waits as a backup\n", streamID)
+	}
+
+	// a backup push is read too, so it is ready to take over
+	for {
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			break
+		}
+		ch.que.WritePacket(pkt)
+	}
+
+	next, owned := s.releaseChannel(streamID, ch)
+	if next != nil {
+		fmt.Printf("backup rtmp publish of %s takes over the stream\n", streamID)
+		s.moveChannel(streamID, ch, next)
+	} else {
+		s.stopForwards(ch)
+	}
+	ch.que.Close()
+
+	if owned && next == nil {
+		s.stopHLS(streamID)
+		s.events.Publish(&Event{
+			Type:     EventStreamStop,
+			StreamID: streamID,
+			Protocol: "rtmp",
+		})
+	}
+}
+
+// claimChannel add the push to the stream by the duplicate policy, the replaced push is returned
+// on takeover, and active is false for a backup push
+func (s *Server) claimChannel(streamID string, channel *Channel) (replaced *Channel, active bool, err error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	current := s.rtmpChannels[streamID]
+	if current == nil {
+		s.rtmpChannels[streamID] = channel
+		return nil, true, nil
+	}
+
+	switch s.cfg.Publish.Duplicate {
+	case config.DuplicateTakeover:
+		// the local channel of an egress can not be kicked
+		if current.conn == nil {
+			return nil, false, errStreamPublished
+		}
+		s.rtmpChannels[streamID] = channel
+		return current, true, nil
+	case config.DuplicateBackup:
+		s.rtmpBackups[streamID] = append(s.rtmpBackups[streamID], channel)
+		return nil, false, nil
+	}
+
+	return nil, false, errStreamPublished
+}
+
+// releaseChannel remove the ended push from the stream, owned is true if it was the active push,
+// then the first backup becomes the active push and is returned
+func (s *Server) releaseChannel(streamID string, channel *Channel) (next *Channel, owned bool) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rtmpChannels[streamID] != channel {
+		s.removeBackup(streamID, channel)
+		return nil, false
+	}
+
+	backups := s.rtmpBackups[streamID]
+	if len(backups) == 0 {
+		delete(s.rtmpChannels, streamID)
+		return nil, true
+	}
+
+	s.rtmpChannels[streamID] = backups[0]
+	s.setBackups(streamID, backups[1:])
+	return backups[0], true
+}
+
+// removeBackup remove the backup push, false if it is not a backup, must be called with the lock held
+func (s *Server) removeBackup(streamID string, channel *Channel) bool {
+
+	backups := s.rtmpBackups[streamID]
+	for i, backup := range backups {
+		if backup == channel {
+			s.setBackups(streamID, append(backups[:i:i], backups[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+// setBackups must be called with the lock held
+func (s *Server) setBackups(streamID string, backups []*Channel) {
+	if len(backups) == 0 {
+		delete(s.rtmpBackups, streamID)
+		return
+	}
+	s.rtmpBackups[streamID] = backups
+}
+
+func (s *Server) hasBackups(streamID string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.rtmpBackups[streamID]) > 0
+}
+
+// removeBackups remove the backup pushes of the stream
+func (s *Server) removeBackups(streamID string) []*Channel {
+	s.Lock()
+	defer s.Unlock()
+	backups := s.rtmpBackups[streamID]
+	delete(s.rtmpBackups, streamID)
+	return backups
+}
+
+// moveChannel move the forwards, the hls and the router of the replaced push to the new active push
+func (s *Server) moveChannel(streamID string, from *Channel, to *Channel) {
+
+	for _, forward := range from.getForwards() {
+		from.removeForward(forward.GetID())
+		forward.Stop()
+		s.startForward(to, forward.url)
+	}
+
+	s.startHLS(streamID, to)
+
+	s.switchChannel(streamID)
+}
+
+// authenticateRtmp check the token in the rtmp url query
+func (s *Server) authenticateRtmp(conn *rtmp.Conn, action string, streamID string) error {
+	return s.authenticate(&AuthRequest{
+		Action:   action,
+		StreamID: streamID,
+		Token:    conn.URL.Query().Get("token"),
+		ClientIP: rtmpClientIP(conn),
+		Protocol: "rtmp",
+	})
+}
+
+func rtmpClientIP(conn *rtmp.Conn) string {
+	host, _, err := net.SplitHostPort(conn.NetConn().RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func testChannel() *Channel {
+	return &Channel{conn: &rtmp.Conn{}, que: pubsub.NewQueue(), created: time.Now()}
+}
+
+func TestClaimChannel(t *testing.T) {
+
+	s := New(testConfig(t))
+	streamID := "claimtest"
+
+	first, second, third := testChannel(), testChannel(), testChannel()
+
+	if _, active, err := s.claimChannel(streamID, first); err != nil || !active {
+		t.Fatalf("the first push should be active, got %v %v", active, err)
+	}
+
+	s.cfg.Publish.Duplicate = config.DuplicateReject
+	if _, _, err := s.claimChannel(streamID, second); err != errStreamPublished {
+		t.Errorf("reject should refuse the second push, got %v", err)
+	}
+
+	s.cfg.Publish.Duplicate = config.DuplicateTakeover
+	replaced, active, err := s.claimChannel(streamID, second)
+	if err != nil || !active || replaced != first || s.getChannel(streamID) != second {
+		t.Errorf("takeover should replace the first push, got %v %v", active, err)
+	}
+
+	// the replaced push does not remove the stream when it ends
+	if next, owned := s.releaseChannel(streamID, first); next != nil || owned || s.getChannel(streamID) != second {
+		t.Error("the replaced push should not own the stream")
+	}
+
+	s.cfg.Publish.Duplicate = config.DuplicateBackup
+	if _, active, err := s.claimChannel(streamID, third); err != nil || active {
+		t.Errorf("the third push should be a backup, got %v %v", active, err)
+	}
+
+	next, owned := s.releaseChannel(streamID, second)
+	if !owned || next != third || s.getChannel(streamID) != third || s.hasBackups(streamID) {
+		t.Error("the backup should take over when the active push ends")
+	}
+
+	if next, owned := s.releaseChannel(streamID, third); next != nil || !owned || s.getChannel(streamID) != nil {
+		t.Error("the last push should remove the stream")
+	}
+
+	// the local channel of an egress is not kicked
+	s.cfg.Publish.Duplicate = config.DuplicateTakeover
+	s.addChannel(streamID, &Channel{que: pubsub.NewQueue()})
+	if _, _, err := s.claimChannel(streamID, first); err != errStreamPublished {
+		t.Errorf("takeover of an egress channel should be refused, got %v", err)
+	}
+}
+
+func TestMoveChannel(t *testing.T) {
+
+	defer fakeDial(func(target string) (forwardConn, error) {
+		return nil, errors.New("connection refused")
+	})()
+
+	s := New(testConfig(t))
+	streamID := "movetest"
+
+	from, to := testChannel(), testChannel()
+	s.addChannel(streamID, from)
+	forward := s.startForward(from, "rtmp://127.0.0.1/live/movetest")
+
+	s.addChannel(streamID, to)
+	s.moveChannel(streamID, from, to)
+
+	if len(from.getForwards()) != 0 {
+		t.Error("the forwards should be removed from the replaced push")
+	}
+
+	forwards := to.getForwards()
+	if len(forwards) != 1 || forwards[0].url != "rtmp://127.0.0.1/live/movetest" {
+		t.Fatal("the forwards should be restarted on the new push")
+	}
+	forwards[0].Stop()
+
+	if !forward.isStopped() {
+		t.Error("the forward of the replaced push should be stopped")
+	}
+}
+
+type testCodec av.CodecType
+
+func (c testCodec) Type() av.CodecType { return av.CodecType(c) }
+
+// testDemuxer read the packets, then EOF
+type testDemuxer struct {
+	streams []av.CodecData
+	packets []av.Packet
+}
+
+func (d *testDemuxer) Streams() ([]av.CodecData, error) {
+	return d.streams, nil
+}
+
+func (d *testDemuxer) ReadPacket() (av.Packet, error) {
+	if len(d.packets) == 0 {
+		return av.Packet{}, io.EOF
+	}
+	packet := d.packets[0]
+	d.packets = d.packets[1:]
+	return packet, nil
+}
+
+func TestKeyframeCursor(t *testing.T) {
+
+	cursor := &keyframeCursor{Demuxer: &testDemuxer{
+		streams: []av.CodecData{testCodec(av.H264), testCodec(av.AAC)},
+		packets: []av.Packet{
+			{Idx: 0, Time: 0},
+			{Idx: 1, Time: 1},
+			{Idx: 0, Time: 2, IsKeyFrame: true},
+			{Idx: 0, Time: 3},
+			{Idx: 1, Time: 4},
+		},
+	}}
+
+	var times []time.Duration
+	for {
+		packet, err := cursor.ReadPacket()
+		if err != nil {
+			break
+		}
+		times = append(times, packet.Time)
+	}
+
+	// the video before the keyframe is skipped, the audio is kept
+	if len(times) != 4 || times[0] != 1 || times[1] != 2 || times[2] != 3 || times[3] != 4 {
+		t.Errorf("cursor read %v", times)
+	}
+}
@@ -2,24 +2,118 @@ package server
 
 import (
 	"fmt"
-	"log"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	mediaserver "github.com/notedit/media-server-go"
 	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtclive/hls"
 	"github.com/notedit/rtclive/router"
 	"github.com/notedit/rtmp-lib"
 	"github.com/notedit/rtmp-lib/av"
 	"github.com/notedit/rtmp-lib/pubsub"
 )
 
+// ProtocolPull the protocol of the stream events of the streams pulled with ffmpeg or bridged from rtmp
+const ProtocolPull = "pull"
+
 type Channel struct {
-	que *pubsub.Queue
+	que      *pubsub.Queue
+	conn     *rtmp.Conn
+	created  time.Time
+	streams  []av.CodecData
+	gop      bool
+	forwards map[string]*Forward
+	sync.RWMutex
+}
+
+func (ch *Channel) setStreams(streams []av.CodecData) {
+	ch.Lock()
+	defer ch.Unlock()
+	ch.streams = streams
+}
+
+func (ch *Channel) getStreams() []av.CodecData {
+	ch.RLock()
+	defer ch.RUnlock()
+	return ch.streams
+}
+
+// setGopCache cache the last gop of the streams with video, it is called before the header is written
+func (ch *Channel) setGopCache(enabled bool, streams []av.CodecData) {
+
+	gop := false
+	for _, stream := range streams {
+		if enabled && stream.Type().IsVideo() {
+			gop = true
+		}
+	}
+
+	ch.Lock()
+	defer ch.Unlock()
+	ch.gop = gop
+
+	// the queue keeps two gops, so the last keyframe is always buffered,
+	// without video nothing is buffered
+	if gop {
+		ch.que.SetMaxGopCount(2)
+	} else {
+		ch.que.SetMaxGopCount(0)
+	}
+}
+
+// cursor a new reader of the channel, it starts at the last keyframe when the gop is cached
+func (ch *Channel) cursor() router.Demuxer {
+
+	ch.RLock()
+	defer ch.RUnlock()
+
+	if !ch.gop {
+		return ch.que.Latest()
+	}
+	return &keyframeCursor{Demuxer: ch.que.DelayedGopCount(1)}
+}
+
+// keyframeCursor skip the video packets before the first keyframe
+type keyframeCursor struct {
+	router.Demuxer
+	videos  map[int8]bool
+	started bool
+}
+
+func (c *keyframeCursor) ReadPacket() (av.Packet, error) {
+
+	for {
+		packet, err := c.Demuxer.ReadPacket()
+		if err != nil || c.started {
+			return packet, err
+		}
+
+		if c.videos == nil {
+			streams, err := c.Demuxer.Streams()
+			if err != nil {
+				return packet, err
+			}
+			c.videos = make(map[int8]bool)
+			for i, stream := range streams {
+				c.videos[int8(i)] = stream.Type().IsVideo()
+			}
+		}
+
+		if c.videos[packet.Idx] {
+			if !packet.IsKeyFrame {
+				continue
+			}
+			c.started = true
+		}
+		return packet, nil
+	}
 }
 
 type Server struct {
@@ -29,10 +123,20 @@ type Server struct {
 	cfg *config.Config
 
 	rtmpChannels map[string]*Channel
+	rtmpBackups  map[string][]*Channel
 	rtmpServer   *rtmp.Server
+	packagers    map[string]*hls.Packager
 
 	endpoints map[string]*mediaserver.Endpoint
 	routers   map[string]*router.MediaRouter
+	egresses  map[string]*router.Egress
+
+	authenticator  Authenticator
+	internalSecret string
+
+	events  *EventBus
+	metrics *metrics
+	bans    *BanList
 }
 
 func New(cfg *config.Config) *Server {
@@ -42,27 +146,87 @@ func New(cfg *config.Config) *Server {
 
 	gin.SetMode(gin.ReleaseMode)
 	httpServer := gin.Default()
-	httpServer.Use(cors.Default())
+	// stream ids in the paths are escaped, live%2Ftest is the stream test of the app live
+	httpServer.UseRawPath = true
+	httpServer.UnescapePathValues = true
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AllowHeaders = append(corsConfig.AllowHeaders, "Authorization")
+	corsConfig.ExposeHeaders = []string{"Location"}
+	httpServer.Use(cors.New(corsConfig))
 
 	server.httpServer = httpServer
 	server.endpoints = make(map[string]*mediaserver.Endpoint)
 	server.routers = make(map[string]*router.MediaRouter)
 	server.rtmpChannels = make(map[string]*Channel)
-	return server
-}
+	server.rtmpBackups = make(map[string][]*Channel)
+	server.packagers = make(map[string]*hls.Packager)
+	server.egresses = make(map[string]*router.Egress)
+	server.authenticator = newAuthenticator(cfg)
+	server.internalSecret = newInternalSecret()
+	server.events = NewEventBus()
+	server.bans = NewBanList()
+
+	if cfg.Webhook != nil {
+		dispatcher := NewWebhookDispatcher(cfg.Webhook.URL, cfg.Webhook.Queue, cfg.Webhook.Retries,
+			time.Duration(cfg.Webhook.Timeout)*time.Second)
+		server.events.Subscribe(dispatcher.Dispatch)
+	}
 
-// ListenAndServe  start to listen and serve
-func (s *Server) ListenAndServe() {
+	server.events.Subscribe(server.stopEgressOnStop)
+
+	server.metrics = newMetrics(server)
+	httpServer.Use(server.metrics.middleware)
+
+	httpServer.POST("/api/publish", server.publish)
+	httpServer.POST("/api/unpublish", server.unpublish)
+
+	httpServer.GET("/test", server.test)
+	httpServer.GET("/metrics", server.adminAuth, server.metrics.handler())
+
+	httpServer.POST("/api/play", server.play)
+	httpServer.POST("/api/unplay", server.unplay)
+
+	httpServer.POST("/api/relay", server.relay)
+
+	httpServer.POST("/api/egress/start", server.startEgress)
+	httpServer.POST("/api/egress/stop", server.stopEgress)
+	httpServer.GET("/api/egress", server.adminAuth, server.listEgresses)
+	httpServer.GET("/api/egress/:id", server.adminAuth, server.getEgressStatus)
+
+	httpServer.GET("/api/streams", server.adminAuth, server.listStreams)
+	httpServer.GET("/api/streams/:id", server.adminAuth, server.getStream)
+	httpServer.GET("/api/streams/:id/subscribers", server.adminAuth, server.listSubscribers)
+	httpServer.GET("/api/streams/:id/forwards", server.listForwards)
+
+	httpServer.POST("/api/forward/add", server.addForward)
+	httpServer.POST("/api/forward/remove", server.removeForward)
+
+	admin := httpServer.Group("/api/admin", server.adminAuth)
+	admin.POST("/stop", server.adminStop)
+	admin.POST("/kick", server.adminKick)
+	admin.POST("/ban", server.adminBan)
+	admin.POST("/unban", server.adminUnban)
+	admin.GET("/bans", server.adminBans)
 
-	//s.httpServer.POST("/api/publish", s.publish)
-	//s.httpServer.POST("/api/unpublish", s.unpublish)
+	httpServer.POST("/whip/:stream", server.whipPublish)
+	httpServer.PATCH("/whip/:stream/:id", server.whipPatch)
+	httpServer.DELETE("/whip/:stream/:id", server.whipDelete)
 
-	s.httpServer.GET("/test", s.test)
+	httpServer.GET("/live/:app/:stream", server.playFLV)
+	httpServer.GET("/hls/:app/:stream/:file", server.playHLS)
 
-	s.httpServer.POST("/api/play", s.play)
-	s.httpServer.POST("/api/unplay", s.unplay)
+	httpServer.POST("/whep/:stream", server.whepPlay)
+	httpServer.PATCH("/whep/:stream/:id", server.whepPatch)
+	httpServer.DELETE("/whep/:stream/:id", server.whepDelete)
 
-	s.httpServer.POST("/api/relay", s.relay)
+	server.metrics.setRoutes(httpServer.Routes())
+
+	return server
+}
+
+// ListenAndServe  start to listen and serve
+func (s *Server) ListenAndServe() {
 
 	address := ":" + strconv.Itoa(s.cfg.Server.Port)
 
@@ -75,68 +239,68 @@ func (s *Server) ListenAndServe() {
 	s.httpServer.Run(":" + strconv.Itoa(s.cfg.Server.Port))
 }
 
+// ServeHTTP let the server be used as a http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.httpServer.ServeHTTP(w, r)
+}
+
 func (s *Server) play(c *gin.Context) {
 
 	var data struct {
 		StreamURL string `json:"streamUrl"`
-		StreamID  string `json:"streamId"`
-		Sdp       string `json:"sdp"`
+		StreamID  string `json:"streamId" binding:"required"`
+		Sdp       string `json:"sdp" binding:"required"`
+		Token     string `json:"token"`
+		Profile   string `json:"profile"`
 	}
 
 	if err := c.ShouldBind(&data); err != nil {
-		c.JSON(200, gin.H{"s": 10001, "e": err})
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
 		return
 	}
 
-	parsedURL, err := url.Parse(data.StreamURL)
+	streamID, err := parseStreamID(data.StreamID)
 	if err != nil {
-		c.JSON(200, gin.H{"s": 10004, "e": "stream url is invalid"})
+		abortWithError(c, err)
 		return
 	}
 
-	mediarouter := s.getRouter(data.StreamID)
-
-	if mediarouter == nil {
-
-		var relayStreamURL string
-		// this is a rtmp push stream, we relay it from local
-		if s.getChannel(data.StreamID) != nil {
-			streaminfo := strings.Split(parsedURL.Path, "/")
-			if len(streaminfo) <= 2 {
-				fmt.Println("rtmp url does not match, rtmp url should like rtmp://host:port/app/stream")
-				return
-			}
-			streamID := streaminfo[len(streaminfo)-1]
-			appName := streaminfo[len(streaminfo)-2]
-			relayStreamURL = fmt.Sprintf("rtmp://localhost:%d/%s/%s", s.cfg.Rtmp.Port, appName, streamID)
-		} else {
-			relayStreamURL = data.StreamURL
-		}
-
-		endpoint := s.getEndpoint(data.StreamID)
-		mediarouter = router.NewMediaRouter(data.StreamID, endpoint, s.cfg.Capabilities, true)
-		publisher := mediarouter.CreateFFPublisher(data.StreamID, relayStreamURL)
-		s.addRouter(mediarouter)
+	if err := s.authorize(c, ActionPlay, streamID, data.Token, "webrtc"); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-		done := publisher.Start()
+	created := s.getRouter(streamID) == nil
 
-		go func() {
-			err := <-done
-			if err != nil {
-				fmt.Printf("publisher done error %s", err)
-			}
-			mediarouter.Stop()
-			s.removeRouter(mediarouter.GetID())
-		}()
+	mediarouter, err := s.findRouter(streamID, data.StreamURL)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
+	if mediarouter == nil {
+		mediarouter, err = s.createRouter(streamID, data.StreamURL, data.Profile)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 	}
 
-	subscriber := mediarouter.CreateSubscriber(data.Sdp)
+	subscriber, err := mediarouter.CreateSubscriber(data.Sdp)
+	if err != nil {
+		// do not leave a router nobody can play
+		if created {
+			s.closeStream(mediarouter, pullProtocol(mediarouter))
+		}
+		abortWithError(c, err)
+		return
+	}
+	s.setClientIP(subscriber, c)
 
 	answer := subscriber.GetAnswer()
 
 	c.JSON(200, gin.H{
-		"s": 10000,
+		"s": CodeOK,
 		"d": map[string]string{
 			"sdp":          answer,
 			"subscriberId": subscriber.GetID(),
@@ -144,58 +308,333 @@ func (s *Server) play(c *gin.Context) {
 
 }
 
+// findRouter find the router of the stream, pull it from the origins if the stream is not on this server
+func (s *Server) findRouter(streamID string, streamURL string) (*router.MediaRouter, error) {
+
+	mediarouter := s.getRouter(streamID)
+
+	if mediarouter != nil || s.getChannel(streamID) != nil {
+		return mediarouter, nil
+	}
+
+	if s.cfg.Cluster != nil && len(s.cfg.Cluster.Origins) > 0 {
+		mediarouter, err := s.relayFromOrigins(streamID, streamURL, s.cfg.Cluster.Origins)
+		if err == nil {
+			return mediarouter, nil
+		}
+		// with a stream url the stream is pulled from its source instead
+		if streamURL == "" {
+			return nil, NewError(CodeUpstreamFailed, err.Error())
+		}
+		fmt.Println(err)
+	}
+
+	return nil, nil
+}
+
+// createRouter create a router which pulls the stream with ffmpeg, with the profile
+// or the profile matching the stream url, a local rtmp push is bridged when it can be
+func (s *Server) createRouter(streamID string, streamURL string, profile string) (*router.MediaRouter, error) {
+
+	if streamURL == "" && s.getChannel(streamID) == nil {
+		return nil, errStreamNotFound
+	}
+
+	mediarouter := s.newRouter(streamID, s.getEndpoint(streamID), true)
+
+	publisher, err := s.newPullPublisher(mediarouter, streamURL, profile)
+	if err != nil {
+		s.removeEndpoint(streamID)
+		return nil, err
+	}
+
+	// the publisher has its tracks once it is started, before any subscriber can find the router
+	done := publisher.Start()
+
+	mediarouter.SwitchPublisher(publisher)
+
+	// another request created the router of the stream meanwhile, ours is dropped
+	if existing, added := s.insertRouter(mediarouter); !added {
+		mediarouter.Stop()
+		return existing, nil
+	}
+	s.closeOnIdle(mediarouter)
+
+	s.events.Publish(&Event{
+		Type:     EventStreamStart,
+		StreamID: streamID,
+		Protocol: ProtocolPull,
+	})
+
+	s.waitPublisher(mediarouter, publisher, done)
+
+	return mediarouter, nil
+}
+
+// newPullPublisher create the publisher which pulls the stream into the router, the bridge of the local
+// rtmp push, or ffmpeg pulling the local rtmp push or the stream url
+func (s *Server) newPullPublisher(mediarouter *router.MediaRouter, streamURL string, profile string) (pullPublisher, error) {
+
+	streamID := mediarouter.GetID()
+
+	if publisher := s.newBridgePublisher(streamID, profile); publisher != nil {
+		return publisher, nil
+	}
+
+	pipeline, err := s.pipeline(profile, streamURL)
+	if err != nil {
+		return nil, err
+	}
+
+	relayStreamURL := streamURL
+	// this is a rtmp push stream, we relay it from local
+	if s.getChannel(streamID) != nil {
+		key, err := ParseStreamKey(streamID)
+		if err != nil {
+			return nil, err
+		}
+		relayStreamURL = key.rtmpURL(s.cfg.Rtmp.Port, s.internalToken(streamID))
+	} else if _, err := url.Parse(streamURL); err != nil {
+		return nil, NewError(CodeInvalidStreamURL, "stream url is invalid")
+	}
+
+	publisher := router.NewFFPublisher(streamID, relayStreamURL, s.cfg.Capabilities)
+	publisher.SetPipeline(pipeline)
+	publisher.SetProbe(func() *router.Probe {
+		return s.probe(streamID, relayStreamURL)
+	})
+	publisher.SetStopTimeout(time.Duration(s.cfg.FFmpeg.StopTimeout) * time.Second)
+	publisher.SetRestart(s.cfg.FFmpeg.Restarts, func() bool {
+		return mediarouter.GetPublisher() == publisher && mediarouter.GetSubscribersCount() > 0
+	}, func(err error) {
+		s.events.Publish(&Event{
+			Type:     EventPullRestart,
+			StreamID: streamID,
+			Error:    err.Error(),
+		})
+	})
+
+	return publisher, nil
+}
+
+// pullPublisher a publisher pulling the stream, Start returns its done channel
+type pullPublisher interface {
+	router.Publisher
+	Start() <-chan error
+}
+
+// newBridgePublisher the in process bridge of the local rtmp push, nil if the stream can not be bridged
+func (s *Server) newBridgePublisher(streamID string, profile string) pullPublisher {
+
+	if s.cfg.Rtmp == nil || !s.cfg.Rtmp.Bridge || profile != "" {
+		return nil
+	}
+
+	channel := s.getChannel(streamID)
+	if channel == nil {
+		return nil
+	}
+
+	streams := channel.getStreams()
+	if !router.BridgeSupported(streams) {
+		return nil
+	}
+
+	publisher, err := router.NewRTMPPublisher(streamID, channel.cursor(), streams, s.cfg.Capabilities)
+	if err != nil {
+		fmt.Printf("can not bridge %s, fallback to ffmpeg: %s\n", streamID, err)
+		return nil
+	}
+	return publisher
+}
+
+// switchChannel pull the new rtmp push of the stream into its router, the subscribers are kept
+func (s *Server) switchChannel(streamID string) {
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		return
+	}
+
+	// a webrtc publish or a relay is not pulled from the rtmp push
+	switch mediarouter.GetPublisher().(type) {
+	case *router.RTMPPublisher, *router.FFPublisher:
+	default:
+		return
+	}
+
+	publisher, err := s.newPullPublisher(mediarouter, "", "")
+	if err != nil {
+		fmt.Printf("can not switch stream %s to the new rtmp push: %s\n", streamID, err)
+		return
+	}
+
+	fmt.Printf("stream %s switched to the new rtmp push\n", streamID)
+
+	done := publisher.Start()
+	mediarouter.SwitchPublisher(publisher)
+	s.waitPublisher(mediarouter, publisher, done)
+}
+
+// waitPublisher close the router once its pulling publisher is done
+func (s *Server) waitPublisher(mediarouter *router.MediaRouter, publisher router.Publisher, done <-chan error) {
+
+	go func() {
+		err := <-done
+		if err != nil {
+			fmt.Printf("publisher done error %s\n", err)
+			s.events.Publish(&Event{
+				Type:     EventPullFailed,
+				StreamID: mediarouter.GetID(),
+				Error:    err.Error(),
+			})
+		}
+		// the stream has been taken over by another publisher
+		if mediarouter.GetPublisher() != publisher {
+			return
+		}
+		s.closeStream(mediarouter, ProtocolPull)
+	}()
+}
+
 func (s *Server) publish(c *gin.Context) {
 
 	var data struct {
 		StreamURL string `json:"streamUrl"`
-		StreamID  string `json:"streamId"`
-		Sdp       string `json:"sdp"`
+		StreamID  string `json:"streamId" binding:"required"`
+		Sdp       string `json:"sdp" binding:"required"`
+		Token     string `json:"token"`
 	}
 
 	if err := c.ShouldBind(&data); err != nil {
-		c.JSON(200, gin.H{"s": 10001, "e": err})
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
 		return
 	}
 
-	capabilities := s.cfg.Capabilities
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	endpoint := s.getEndpoint(data.StreamID)
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, "webrtc"); err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	mediarouter := router.NewMediaRouter(data.StreamID, endpoint, capabilities, true)
-	publisher := mediarouter.CreatePublisher(data.Sdp)
-	s.addRouter(mediarouter)
+	publisher, err := s.createPublisher(streamID, data.Sdp, "webrtc")
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	publisher.SetClientIP(s.clientIP(c.Request))
 
 	answer := publisher.GetAnswer()
 
 	c.JSON(200, gin.H{
-		"s": 10000,
+		"s": CodeOK,
 		"d": map[string]string{
 			"sdp": answer,
 		}})
 
 }
 
+// createPublisher create a webrtc publisher for the stream, an existing stream is rejected or taken over by policy
+func (s *Server) createPublisher(streamID string, sdpStr string, protocol string) (*router.RTCPublisher, error) {
+
+	// the lookup and the insert are under the lock, concurrent publishes of a stream do not both create a router
+	s.Lock()
+	publisher, created, err := s.attachPublisher(streamID, sdpStr, protocol)
+	s.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream of the old publisher stops, the new one starts with the same subscribers
+	if !created {
+		s.events.Publish(&Event{
+			Type:     EventStreamStop,
+			StreamID: streamID,
+			Protocol: protocol,
+		})
+	}
+
+	s.events.Publish(&Event{
+		Type:     EventStreamStart,
+		StreamID: streamID,
+		Protocol: protocol,
+	})
+
+	return publisher, nil
+}
+
+// attachPublisher create the publisher on the router of the stream, true if the router is created for it,
+// must be called with the lock held
+func (s *Server) attachPublisher(streamID string, sdpStr string, protocol string) (*router.RTCPublisher, bool, error) {
+
+	if mediarouter := s.routers[streamID]; mediarouter != nil {
+		if s.cfg.Publish.Duplicate != config.DuplicateTakeover {
+			return nil, false, errStreamPublished
+		}
+		// the subscribers are attached to the new publisher, and the old one is stopped
+		publisher, err := mediarouter.CreatePublisher(sdpStr)
+		if err != nil {
+			return nil, false, err
+		}
+		// a published stream is not closed when it has no subscribers
+		mediarouter.SetIdleTimeout(0, nil)
+		go s.watchPublisher(mediarouter, publisher, protocol)
+		return publisher, false, nil
+	}
+
+	mediarouter := s.newRouter(streamID, s.endpoint(streamID), true)
+	publisher, err := mediarouter.CreatePublisher(sdpStr)
+	if err != nil {
+		s.endpoints[streamID].Stop()
+		delete(s.endpoints, streamID)
+		return nil, false, err
+	}
+	s.routers[streamID] = mediarouter
+	go s.watchPublisher(mediarouter, publisher, protocol)
+
+	return publisher, true, nil
+}
+
 func (s *Server) unpublish(c *gin.Context) {
 
 	var data struct {
 		StreamURL string `json:"streamUrl"`
-		StreamID  string `json:"streamId"`
+		StreamID  string `json:"streamId" binding:"required"`
+		Token     string `json:"token"`
 	}
 
 	if err := c.ShouldBind(&data); err != nil {
-		c.JSON(200, gin.H{"s": 10001, "e": err})
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
 		return
 	}
 
-	mediarouter := s.getRouter(data.StreamID)
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-	if mediarouter != nil {
-		mediarouter.Stop()
-		s.removeRouter(mediarouter.GetID())
+	if err := s.authorize(c, ActionPublish, streamID, data.Token, "webrtc"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
 	}
 
+	s.closeStream(mediarouter, "webrtc")
+
 	c.JSON(200, gin.H{
-		"s": 10000,
+		"s": CodeOK,
 		"d": map[string]string{},
 	})
 }
@@ -204,23 +643,46 @@ func (s *Server) unplay(c *gin.Context) {
 
 	var data struct {
 		StreamURL    string `json:"streamUrl"`
-		StreamID     string `json:"streamId"`
-		SubscriberID string `json:"subscriberId"`
+		StreamID     string `json:"streamId" binding:"required"`
+		SubscriberID string `json:"subscriberId" binding:"required"`
+		Token        string `json:"token"`
 	}
 
 	if err := c.ShouldBind(&data); err != nil {
-		c.JSON(200, gin.H{"s": 10001, "e": err})
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	streamID, err := parseStreamID(data.StreamID)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
-	mediarouter := s.getRouter(data.StreamID)
+	// the edges unplay their relays with the cluster secret
+	if !s.isCluster(c) {
+		if err := s.authorize(c, ActionPlay, streamID, data.Token, "webrtc"); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	mediarouter := s.getRouter(streamID)
 
-	if mediarouter != nil {
-		mediarouter.StopSubscriber(data.SubscriberID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
 	}
 
+	if mediarouter.GetSubscriber(data.SubscriberID) == nil {
+		abortWithError(c, errSubscriberNotFound)
+		return
+	}
+
+	mediarouter.StopSubscriber(data.SubscriberID)
+
 	c.JSON(200, gin.H{
-		"s": 10000,
+		"s": CodeOK,
 		"d": map[string]string{},
 	})
 }
@@ -229,105 +691,168 @@ func (s *Server) test(c *gin.Context) {
 	c.String(200, "hello world")
 }
 
-func (s *Server) relay(c *gin.Context) {
-
+// newRouter create a router on the stream's endpoint, its subscriber events go to the event bus
+// and its subscribers are stopped on ice timeout
+func (s *Server) newRouter(streamID string, endpoint *mediaserver.Endpoint, origin bool) *router.MediaRouter {
+	mediarouter := router.NewMediaRouter(streamID, endpoint, s.cfg.Capabilities, origin)
+	mediarouter.SetListener(&routerListener{events: s.events})
+	if s.cfg.Media.ICETimeout > 0 {
+		mediarouter.SetICETimeout(time.Duration(s.cfg.Media.ICETimeout) * time.Second)
+	}
+	return mediarouter
 }
 
-func (s *Server) startRtmp() {
+// pipeline the ffmpeg pipeline of the profile, or of the first rule matching the stream url, or of the default profile
+func (s *Server) pipeline(name string, streamURL string) (*router.Pipeline, error) {
+
+	if name == "" {
+		name = s.cfg.FFmpeg.Profile
+		for _, rule := range s.cfg.FFmpeg.Rules {
+			if rule.Pattern.MatchString(streamURL) {
+				name = rule.Profile
+				break
+			}
+		}
+	}
 
-	s.rtmpServer = &rtmp.Server{
-		Addr: fmt.Sprintf("%s:%d", s.cfg.Rtmp.Host, s.cfg.Rtmp.Port),
+	profile, ok := s.cfg.FFmpeg.Profiles[name]
+	if !ok {
+		return nil, NewError(CodeBadRequest, "ffmpeg profile "+name+" is not defined")
 	}
 
-	s.rtmpServer.HandlePlay = func(conn *rtmp.Conn) {
+	return &router.Pipeline{
+		Input:          profile.Input,
+		Video:          profile.Video != config.MediaNone,
+		VideoTranscode: profile.Video == config.VideoX264,
+		Bitrate:        profile.Bitrate,
+		Preset:         profile.Preset,
+		Bsfs:           profile.Bsfs,
+		Audio:          profile.Audio != config.MediaNone,
+		AudioTranscode: profile.Audio == config.AudioOpus,
+	}, nil
+}
 
-		streaminfo := strings.Split(conn.URL.Path, "/")
+// probe the codecs of the source, from the rtmp channel or with ffprobe, nil if probing is disabled or fails
+func (s *Server) probe(streamID string, pullURL string) *router.Probe {
 
-		if len(streaminfo) <= 2 {
-			fmt.Println("rtmp url does not match, rtmp url should like rtmp://host:port/app/stream")
-			conn.Close()
-			return
+	if channel := s.getChannel(streamID); channel != nil {
+		if streams := channel.getStreams(); len(streams) > 0 {
+			return codecProbe(streams)
 		}
+	}
 
-		streamID := streaminfo[len(streaminfo)-1]
-		appName := streaminfo[len(streaminfo)-2]
+	if s.cfg.FFmpeg.ProbeTimeout <= 0 {
+		return nil
+	}
 
-		fmt.Printf("publishing stream %s in app %s\n", streamID, appName)
+	probe, err := router.ProbeStream(pullURL, time.Duration(s.cfg.FFmpeg.ProbeTimeout)*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return probe
+}
 
-		ch := s.getChannel(streamID)
+// codecProbe the codecs of the rtmp streams, named as ffprobe does
+func codecProbe(streams []av.CodecData) *router.Probe {
 
-		if ch != nil {
-			cursor := ch.que.Latest()
-			streams, err := cursor.Streams()
-			if err != nil {
-				panic(err)
-			}
-			conn.WriteHeader(streams)
-			for {
-				packet, err := cursor.ReadPacket()
-				if err != nil {
-					break
-				}
-				err = conn.WritePacket(packet)
-				if err != nil {
-					break
-				}
-			}
+	probe := &router.Probe{}
+
+	for _, stream := range streams {
+		name := strings.ToLower(stream.Type().String())
+		if stream.Type().IsVideo() && probe.Video == "" {
+			probe.Video = name
+		}
+		if stream.Type().IsAudio() && probe.Audio == "" {
+			probe.Audio = name
 		}
-		conn.Close()
 	}
+	return probe
+}
 
-	s.rtmpServer.HandlePublish = func(conn *rtmp.Conn) {
+// closeOnIdle close the pulled router once it has no subscribers for the idle timeout
+func (s *Server) closeOnIdle(mediarouter *router.MediaRouter) {
 
-		streaminfo := strings.Split(conn.URL.Path, "/")
+	if s.cfg.Media.IdleTimeout <= 0 {
+		return
+	}
 
-		if len(streaminfo) <= 2 {
-			fmt.Println("rtmp url does not match, rtmp url should like rtmp://host:port/app/stream")
-			conn.Close()
+	mediarouter.SetIdleTimeout(time.Duration(s.cfg.Media.IdleTimeout)*time.Second, func(idle *router.MediaRouter) {
+		if s.getRouter(idle.GetID()) != idle {
 			return
 		}
+		fmt.Printf("stream %s has no subscribers, close it\n", idle.GetID())
+		s.closeStream(idle, pullProtocol(idle))
+	})
+}
 
-		streamID := streaminfo[len(streaminfo)-1]
-		appName := streaminfo[len(streaminfo)-2]
+// closeStream close the router and send stream.stop
+func (s *Server) closeStream(mediarouter *router.MediaRouter, protocol string) {
 
-		fmt.Printf("publishing stream %s in app %s\n", streamID, appName)
+	s.closeRouter(mediarouter)
 
-		ch := &Channel{}
-		ch.que = pubsub.NewQueue()
-		ch.que.SetMaxGopCount(0)
+	s.events.Publish(&Event{
+		Type:     EventStreamStop,
+		StreamID: mediarouter.GetID(),
+		Protocol: protocol,
+	})
+}
 
-		s.addChannel(streamID, ch)
-
-		var streams []av.CodecData
-		var err error
-
-		if streams, err = conn.Streams(); err != nil {
-			fmt.Println(err)
-		} else {
-			ch.que.WriteHeader(streams)
-			for {
-				var pkt av.Packet
-				if pkt, err = conn.ReadPacket(); err != nil {
-					break
-				}
-				ch.que.WritePacket(pkt)
-			}
-		}
-		s.removeChannel(streamID)
-		ch.que.Close()
+// pullProtocol the protocol of the stream events of a pulled router, relayed from the origins or pulled here
+func pullProtocol(mediarouter *router.MediaRouter) string {
+	if mediarouter.IsOrgin() {
+		return ProtocolPull
 	}
+	return ProtocolRelay
+}
 
-	err := s.rtmpServer.ListenAndServe()
+// watchPublisher close the stream of a webrtc publish once there is no ice traffic on its transport for the ice timeout
+func (s *Server) watchPublisher(mediarouter *router.MediaRouter, publisher *router.RTCPublisher, protocol string) {
 
-	if err != nil {
-		log.Fatal(err)
+	if s.cfg.Media.ICETimeout <= 0 {
+		return
 	}
+	timeout := time.Duration(s.cfg.Media.ICETimeout) * time.Second
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	activity := &iceActivity{lastActive: time.Now()}
+
+	for now := range ticker.C {
+
+		// the stream has been closed or taken over
+		if s.getRouter(mediarouter.GetID()) != mediarouter || mediarouter.GetPublisher() != publisher {
+			return
+		}
+
+		if !activity.dropped(publisher.GetTransport().GetICEStats(), now, timeout) {
+			continue
+		}
+
+		fmt.Printf("publisher of %s has no ice traffic in %s, close it\n", mediarouter.GetID(), timeout)
+		s.closeStream(mediarouter, protocol)
+		return
+	}
+}
+
+// closeRouter stop the router and release its endpoint
+func (s *Server) closeRouter(mediarouter *router.MediaRouter) {
+	mediarouter.Stop()
+	s.removeRouter(mediarouter.GetID())
+	s.removeEndpoint(mediarouter.GetID())
 }
 
 func (s *Server) getEndpoint(streamID string) *mediaserver.Endpoint {
 	defer s.Unlock()
 	s.Lock()
 
+	return s.endpoint(streamID)
+}
+
+// endpoint the endpoint of the stream, created on first use, must be called with the lock held
+func (s *Server) endpoint(streamID string) *mediaserver.Endpoint {
+
 	if s.endpoints[streamID] != nil {
 		return s.endpoints[streamID]
 	}
@@ -338,10 +863,18 @@ func (s *Server) getEndpoint(streamID string) *mediaserver.Endpoint {
 	return endpoint
 }
 
+// removeEndpoint stop the endpoint of the stream, it is kept while the stream has a router
 func (s *Server) removeEndpoint(streamID string) {
 	defer s.Unlock()
 	s.Lock()
 
+	if s.routers[streamID] != nil {
+		return
+	}
+
+	if endpoint := s.endpoints[streamID]; endpoint != nil {
+		endpoint.Stop()
+	}
 	delete(s.endpoints, streamID)
 }
 
@@ -357,6 +890,17 @@ func (s *Server) addRouter(router *router.MediaRouter) {
 	s.routers[router.GetID()] = router
 }
 
+// insertRouter add the router unless the stream already has one, the router of the stream is returned
+func (s *Server) insertRouter(mediarouter *router.MediaRouter) (*router.MediaRouter, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if existing := s.routers[mediarouter.GetID()]; existing != nil {
+		return existing, false
+	}
+	s.routers[mediarouter.GetID()] = mediarouter
+	return mediarouter, true
+}
+
 func (s *Server) removeRouter(routerID string) {
 	s.Lock()
 	defer s.Unlock()
@@ -375,8 +919,11 @@ func (s *Server) getChannel(streamID string) *Channel {
 	return s.rtmpChannels[streamID]
 }
 
-func (s *Server) removeChannel(streamID string) {
+// removeChannel remove the channel of the stream, unless it has been replaced by another one
+func (s *Server) removeChannel(streamID string, channel *Channel) {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.rtmpChannels, streamID)
+	if s.rtmpChannels[streamID] == channel {
+		delete(s.rtmpChannels, streamID)
+	}
 }
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtclive/router"
+)
+
+type testPublisher struct {
+	id string
+}
+
+func (p *testPublisher) GetID() string                                   { return p.id }
+func (p *testPublisher) GetAnswer() string                               { return "" }
+func (p *testPublisher) GetVideoTrack() *mediaserver.IncomingStreamTrack { return nil }
+func (p *testPublisher) GetAudioTrack() *mediaserver.IncomingStreamTrack { return nil }
+func (p *testPublisher) Stop()                                           {}
+
+func testConfig(t *testing.T) *config.Config {
+
+	cfg, err := config.LoadConfig("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func testOffer(cfg *config.Config) string {
+	endpoint := mediaserver.NewEndpoint("127.0.0.1")
+	return endpoint.CreateOffer(cfg.Capabilities["video"], cfg.Capabilities["audio"]).String()
+}
+
+func postJSON(t *testing.T, address string, data interface{}, result interface{}) int {
+
+	body, _ := json.Marshal(data)
+	resp, err := http.Post(address, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestRelayFromOrigin(t *testing.T) {
+
+	origin := New(extendConfig(t, "\ncluster:\n  secret: clustersecret\n"))
+	originHTTP := httptest.NewServer(origin)
+	defer originHTTP.Close()
+
+	streamID := "relaytest"
+
+	mediarouter := router.NewMediaRouter(streamID, origin.getEndpoint(streamID), origin.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	origin.addRouter(mediarouter)
+
+	originURL, _ := url.Parse(originHTTP.URL)
+
+	// the edge relays from the origins of its config only, with the cluster secret
+	edgeCfg := extendConfig(t, "\ncluster:\n  secret: clustersecret\n  origins:\n    - "+originURL.Host+"\n")
+	edgeCfg.Relay = false
+	edge := New(edgeCfg)
+	edgeHTTP := httptest.NewServer(edge)
+	defer edgeHTTP.Close()
+
+	var result struct {
+		S ErrorCode `json:"s"`
+		D struct {
+			Sdp          string `json:"sdp"`
+			SubscriberID string `json:"subscriberId"`
+		} `json:"d"`
+	}
+
+	postJSON(t, edgeHTTP.URL+"/api/play", map[string]string{
+		"streamUrl": "rtmp://127.0.0.1/live/" + streamID,
+		"streamId":  streamID,
+		"sdp":       testOffer(edgeCfg),
+	}, &result)
+
+	if result.S != CodeOK || result.D.Sdp == "" {
+		t.Fatalf("play from edge failed %+v", result)
+	}
+
+	edgeRouter := edge.getRouter(streamID)
+	if edgeRouter == nil {
+		t.Fatal("edge should have a relay router")
+	}
+	if edgeRouter.IsOrgin() {
+		t.Error("edge router should not be origin")
+	}
+	if edgeRouter.GetSubscribersCount() != 1 {
+		t.Error("edge router should have one subscriber")
+	}
+
+	// the origin only serves the edge transport
+	if mediarouter.GetSubscribersCount() != 1 {
+		t.Error("origin router should have one relay subscriber")
+	}
+
+	// a second player on the edge should reuse the upstream transport
+	postJSON(t, edgeHTTP.URL+"/api/play", map[string]string{
+		"streamId": streamID,
+		"sdp":      testOffer(edgeCfg),
+	}, &result)
+
+	if result.S != CodeOK {
+		t.Fatalf("second play from edge failed %+v", result)
+	}
+
+	if mediarouter.GetSubscribersCount() != 1 {
+		t.Error("origin router should still have one relay subscriber")
+	}
+}
+
+func TestRelayDisabled(t *testing.T) {
+
+	cfg := testConfig(t)
+	cfg.Relay = false
+	origin := New(cfg)
+	originHTTP := httptest.NewServer(origin)
+	defer originHTTP.Close()
+
+	var result struct {
+		S ErrorCode `json:"s"`
+	}
+
+	postJSON(t, originHTTP.URL+"/api/relay", map[string]string{
+		"streamId": "relaytest",
+		"sdp":      testOffer(cfg),
+	}, &result)
+
+	if result.S != CodeRelayDisabled {
+		t.Errorf("relay should be rejected, got %d", result.S)
+	}
+}
+
+func TestRelayUnauthorized(t *testing.T) {
+
+	origin := New(extendConfig(t, "\ncluster:\n  secret: clustersecret\n"))
+	originHTTP := httptest.NewServer(origin)
+	defer originHTTP.Close()
+
+	for _, auth := range []string{"", "Bearer wrongsecret"} {
+		body := bytes.NewReader([]byte(`{"streamId":"relaytest","sdp":"v=0"}`))
+		req, _ := http.NewRequest("POST", originHTTP.URL+"/api/relay", body)
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("relay with %q should be unauthorized, got %d", auth, resp.StatusCode)
+		}
+	}
+
+	// without a secret the relay is a play, it needs a token when auth is enabled
+	plain := New(testConfig(t))
+	plain.SetAuthenticator(NewTokenAuth("secret"))
+	plainHTTP := httptest.NewServer(plain)
+	defer plainHTTP.Close()
+
+	var result Error
+	status := postJSON(t, plainHTTP.URL+"/api/relay", map[string]string{"streamId": "relaytest", "sdp": "v=0"}, &result)
+	if status != http.StatusUnauthorized {
+		t.Errorf("relay without the token should be unauthorized, got %d", status)
+	}
+}
+
+func TestRelaySkipUnhealthyOrigin(t *testing.T) {
+
+	origin := New(testConfig(t))
+	originHTTP := httptest.NewServer(origin)
+	defer originHTTP.Close()
+
+	deadHTTP := httptest.NewServer(http.NotFoundHandler())
+	deadHTTP.Close()
+
+	streamID := "relaytest"
+
+	mediarouter := router.NewMediaRouter(streamID, origin.getEndpoint(streamID), origin.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	origin.addRouter(mediarouter)
+
+	edge := New(testConfig(t))
+
+	deadURL, _ := url.Parse(deadHTTP.URL)
+	originURL, _ := url.Parse(originHTTP.URL)
+
+	edgeRouter, err := edge.relayFromOrigins(streamID, "", []string{deadURL.Host, originURL.Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edge.getRouter(streamID) != edgeRouter {
+		t.Error("edge router should be added")
+	}
+
+	if mediarouter.GetSubscribersCount() != 1 {
+		t.Error("healthy origin should have one relay subscriber")
+	}
+
+	if _, err := edge.relayFromOrigins("notexist", "", []string{deadURL.Host, originURL.Host}); err == nil {
+		t.Error("relay a stream no origin has should fail")
+	}
+
+	// the relay subscriber on the origin is unplayed once the edge router stops
+	edge.closeStream(edgeRouter, ProtocolRelay)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for mediarouter.GetSubscribersCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if mediarouter.GetSubscribersCount() != 0 {
+		t.Error("the origin should not keep the relay subscriber of a stopped edge router")
+	}
+}
+
+func TestUnplayRelay(t *testing.T) {
+
+	origin := New(extendConfig(t, "\ncluster:\n  secret: clustersecret\n"))
+	origin.SetAuthenticator(NewTokenAuth("secret"))
+	originHTTP := httptest.NewServer(origin)
+	defer originHTTP.Close()
+
+	streamID := "unplaytest"
+	mediarouter := router.NewMediaRouter(streamID, origin.getEndpoint(streamID), origin.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	origin.addRouter(mediarouter)
+
+	for auth, expected := range map[string]int{
+		"":                     http.StatusUnauthorized,
+		"Bearer wrongsecret":   http.StatusUnauthorized,
+		"Bearer clustersecret": http.StatusNotFound,
+	} {
+		body := bytes.NewReader([]byte(`{"streamId":"unplaytest","subscriberId":"relay"}`))
+		req, _ := http.NewRequest("POST", originHTTP.URL+"/api/unplay", body)
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// the edge passes the auth with the cluster secret, the subscriber is already gone
+		if resp.StatusCode != expected {
+			t.Errorf("unplay with %q should be %d, got %d", auth, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestRelayNoOrigin(t *testing.T) {
+
+	deadHTTP := httptest.NewServer(http.NotFoundHandler())
+	deadHTTP.Close()
+	deadURL, _ := url.Parse(deadHTTP.URL)
+
+	edge := New(extendConfig(t, "\ncluster:\n  origins:\n    - "+deadURL.Host+"\n"))
+	edgeHTTP := httptest.NewServer(edge)
+	defer edgeHTTP.Close()
+
+	var result Error
+	status := postJSON(t, edgeHTTP.URL+"/api/play", map[string]string{"streamId": "relaytest", "sdp": "v=0"}, &result)
+	if status != http.StatusBadGateway || result.Code != CodeUpstreamFailed {
+		t.Errorf("play with no origin to relay from should fail, got %d/%d", status, result.Code)
+	}
+	if edge.getRouter("relaytest") != nil {
+		t.Error("the failed relay should not leave a router")
+	}
+}
+
+func TestIceActivity(t *testing.T) {
+
+	start := time.Now()
+	activity := &iceActivity{lastActive: start}
+	timeout := 15 * time.Second
+
+	stats := mediaserver.ICEStats{RequestsReceived: 1}
+	if activity.dropped(stats, start.Add(10*time.Second), timeout) {
+		t.Error("new ice requests should keep the upstream")
+	}
+
+	if activity.dropped(stats, start.Add(20*time.Second), timeout) {
+		t.Error("the upstream should be kept before the timeout")
+	}
+
+	stats.ResponsesReceived = 1
+	if activity.dropped(stats, start.Add(30*time.Second), timeout) {
+		t.Error("new ice responses should keep the upstream")
+	}
+
+	if !activity.dropped(stats, start.Add(45*time.Second), timeout) {
+		t.Error("the upstream without ice traffic for the timeout should be dropped")
+	}
+}
+
+func TestIceActivityHealthyRelay(t *testing.T) {
+
+	start := time.Now()
+	activity := &iceActivity{lastActive: start}
+	timeout := 15 * time.Second
+
+	// the upstream of an edge sends the stun keepalives, it only gets responses from the origin
+	var stats mediaserver.ICEStats
+	for i := 1; i <= 60; i++ {
+		stats.ResponsesReceived++
+		if activity.dropped(stats, start.Add(time.Duration(i)*time.Second), timeout) {
+			t.Fatalf("a healthy relay should not be failed over, dropped after %ds", i)
+		}
+	}
+
+	if !activity.dropped(stats, start.Add(75*time.Second), timeout) {
+		t.Error("the relay without responses for the timeout should be failed over")
+	}
+}
+
+func TestPublishDuplicateReject(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "publishtest"
+
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	var result struct {
+		S ErrorCode `json:"s"`
+	}
+
+	postJSON(t, serverHTTP.URL+"/api/publish", map[string]string{
+		"streamId": streamID,
+		"sdp":      testOffer(s.cfg),
+	}, &result)
+
+	if result.S != CodeStreamPublished {
+		t.Errorf("duplicate publish should be rejected, got %d", result.S)
+	}
+
+	if s.getRouter(streamID) != mediarouter {
+		t.Error("the router should not be replaced")
+	}
+}
+
+func TestPublishTakeover(t *testing.T) {
+
+	s := New(testConfig(t))
+	s.cfg.Publish.Duplicate = config.DuplicateTakeover
+
+	streamID := "publishtest"
+
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	subscriber, err := mediarouter.CreateSubscriber(testOffer(s.cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*Event
+	s.events.Subscribe(func(event *Event) {
+		events = append(events, event)
+	})
+
+	publisher, err := s.createPublisher(streamID, testOffer(s.cfg), "webrtc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.getRouter(streamID) != mediarouter || mediarouter.GetPublisher() != publisher {
+		t.Error("the new publisher should take over the router")
+	}
+
+	if subscriber.(*router.RTCSubscriber).GetPublisherID() != publisher.GetID() {
+		t.Error("the subscribers should be attached to the new publisher")
+	}
+
+	if len(events) != 2 || events[0].Type != EventStreamStop || events[1].Type != EventStreamStart {
+		t.Errorf("takeover should send stream.stop and stream.start, got %+v", events)
+	}
+}
+
+func TestPullEndEvent(t *testing.T) {
+
+	s := New(testConfig(t))
+
+	stopped := make(chan *Event, 1)
+	s.events.Subscribe(func(event *Event) {
+		stopped <- event
+	})
+
+	streamID := "pulltest"
+
+	publisher := &testPublisher{id: streamID}
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(publisher)
+	s.addRouter(mediarouter)
+
+	done := make(chan error)
+	s.waitPublisher(mediarouter, publisher, done)
+	close(done)
+
+	select {
+	case event := <-stopped:
+		if event.Type != EventStreamStop || event.Protocol != ProtocolPull {
+			t.Errorf("the pull end should send stream.stop, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pull end should send stream.stop")
+	}
+
+	if s.getRouter(streamID) != nil {
+		t.Error("the router should be closed when the pull ends")
+	}
+}
+
+func TestCreateRouterExisting(t *testing.T) {
+
+	cfg := testConfig(t)
+	cfg.FFmpeg.ProbeTimeout = -1
+	s := New(cfg)
+
+	streamID := "createtest"
+
+	// the router another play created while we started the pull
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	created, err := s.createRouter(streamID, "rtmp://127.0.0.1/live/"+streamID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created != mediarouter || s.getRouter(streamID) != mediarouter {
+		t.Error("the existing router of the stream should be kept")
+	}
+
+	s.removeEndpoint(streamID)
+	s.Lock()
+	_, ok := s.endpoints[streamID]
+	s.Unlock()
+	if !ok {
+		t.Error("the endpoint of a stream with a router should be kept")
+	}
+}
+
+func TestUnpublish(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "publishtest"
+
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	var result struct {
+		S ErrorCode `json:"s"`
+	}
+
+	postJSON(t, serverHTTP.URL+"/api/unpublish", map[string]string{
+		"streamId": streamID,
+	}, &result)
+
+	if result.S != CodeOK {
+		t.Errorf("unpublish failed, got %d", result.S)
+	}
+
+	if s.getRouter(streamID) != nil {
+		t.Error("the router should be removed")
+	}
+
+	if s.endpoints[streamID] != nil {
+		t.Error("the endpoint should be removed")
+	}
+}
+
+func TestPlayInvalidSdp(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "playtest"
+
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	var result struct {
+		S ErrorCode `json:"s"`
+	}
+
+	postJSON(t, serverHTTP.URL+"/api/play", map[string]string{
+		"streamId": streamID,
+		"sdp":      "invalid sdp",
+	}, &result)
+
+	if result.S != CodeSdpFailed {
+		t.Errorf("invalid sdp should fail with %d, got %d", CodeSdpFailed, result.S)
+	}
+
+	if mediarouter.GetSubscribersCount() != 0 {
+		t.Error("should not add subscriber")
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultVhost the vhost of the streams which do not name one
+	DefaultVhost = "__defaultVhost__"
+	// DefaultApp the app of the streams which do not name one
+	DefaultApp = "live"
+)
+
+var (
+	errInvalidStreamID = NewError(CodeBadRequest, "stream id should be stream, app/stream or vhost/app/stream")
+	errInvalidRtmpPath = NewError(CodeInvalidStreamURL, "rtmp url does not match, rtmp url should like rtmp://host:port/app/stream")
+	errPublishDenied   = NewError(CodeAppDenied, "publish is not allowed in the app")
+	errPlayDenied      = NewError(CodeAppDenied, "play is not allowed in the app")
+)
+
+// StreamKey identify a stream by its vhost, app and stream name
+type StreamKey struct {
+	Vhost  string
+	App    string
+	Stream string
+}
+
+// ParseStreamKey parse a stream id, stream, app/stream or vhost/app/stream, the missing parts are the defaults
+func ParseStreamKey(streamID string) (StreamKey, error) {
+
+	key := StreamKey{Vhost: DefaultVhost, App: DefaultApp}
+
+	parts := strings.Split(streamID, "/")
+	for _, part := range parts {
+		if part == "" {
+			return key, errInvalidStreamID
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		key.Stream = parts[0]
+	case 2:
+		key.App, key.Stream = parts[0], parts[1]
+	case 3:
+		key.Vhost, key.App, key.Stream = parts[0], parts[1], parts[2]
+	default:
+		return key, errInvalidStreamID
+	}
+
+	return key, nil
+}
+
+// rtmpStreamKey the key of a rtmp url, rtmp://host:port/app/stream, the vhost is the vhost query
+func rtmpStreamKey(u *url.URL) (StreamKey, error) {
+
+	parts := strings.Split(u.Path, "/")
+	if len(parts) <= 2 || parts[len(parts)-1] == "" || parts[len(parts)-2] == "" {
+		return StreamKey{}, errInvalidRtmpPath
+	}
+
+	key := StreamKey{
+		Vhost:  u.Query().Get("vhost"),
+		App:    parts[len(parts)-2],
+		Stream: parts[len(parts)-1],
+	}
+	if key.Vhost == "" {
+		key.Vhost = DefaultVhost
+	}
+	return key, nil
+}
+
+// String the stream id of the key, a stream of the default app and vhost keeps its bare name
+func (k StreamKey) String() string {
+
+	if k.Vhost != DefaultVhost {
+		return k.Vhost + "/" + k.App + "/" + k.Stream
+	}
+	if k.App != DefaultApp {
+		return k.App + "/" + k.Stream
+	}
+	return k.Stream
+}
+
+// rtmpURL the url of the stream on the local rtmp server
+func (k StreamKey) rtmpURL(port int, token string) string {
+
+	rtmpURL := fmt.Sprintf("rtmp://localhost:%d/%s/%s?token=%s", port, k.App, k.Stream, url.QueryEscape(token))
+	if k.Vhost != DefaultVhost {
+		rtmpURL += "&vhost=" + url.QueryEscape(k.Vhost)
+	}
+	return rtmpURL
+}
+
+// parseStreamID the canonical stream id of an api stream id
+func parseStreamID(id string) (string, error) {
+
+	key, err := ParseStreamKey(id)
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// checkApp check the action is allowed in the app of the stream, auth is false if the app skips authentication
+func (s *Server) checkApp(action string, streamID string) (auth bool, err error) {
+
+	key, err := ParseStreamKey(streamID)
+	if err != nil {
+		return false, err
+	}
+
+	app := s.cfg.App(key.Vhost, key.App)
+
+	if action == ActionPublish && !app.Publish {
+		return false, errPublishDenied
+	}
+	if action == ActionPlay && !app.Play {
+		return false, errPlayDenied
+	}
+	return app.Auth, nil
+}
+
+// streamParam the canonical stream id of the path param, the error is replied if it is invalid
+func streamParam(c *gin.Context, name string) (string, bool) {
+
+	streamID, err := parseStreamID(c.Param(name))
+	if err != nil {
+		abortWithError(c, err)
+		return "", false
+	}
+	return streamID, true
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/config"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func TestParseStreamKey(t *testing.T) {
+
+	cases := []struct {
+		id     string
+		key    StreamKey
+		string string
+	}{
+		{"foo", StreamKey{DefaultVhost, DefaultApp, "foo"}, "foo"},
+		{"live/foo", StreamKey{DefaultVhost, DefaultApp, "foo"}, "foo"},
+		{"test/foo", StreamKey{DefaultVhost, "test", "foo"}, "test/foo"},
+		{"__defaultVhost__/test/foo", StreamKey{DefaultVhost, "test", "foo"}, "test/foo"},
+		{"example.com/live/foo", StreamKey{"example.com", DefaultApp, "foo"}, "example.com/live/foo"},
+	}
+
+	for _, c := range cases {
+		key, err := ParseStreamKey(c.id)
+		if err != nil {
+			t.Errorf("parse %s error %s", c.id, err)
+			continue
+		}
+		if key != c.key || key.String() != c.string {
+			t.Errorf("parse %s = %+v %s, want %+v %s", c.id, key, key.String(), c.key, c.string)
+		}
+	}
+
+	for _, id := range []string{"", "/foo", "live/", "a//b", "a/b/c/d"} {
+		if _, err := ParseStreamKey(id); err != errInvalidStreamID {
+			t.Errorf("parse %q should be invalid, got %v", id, err)
+		}
+	}
+}
+
+func TestRtmpStreamKey(t *testing.T) {
+
+	cases := []struct {
+		url string
+		id  string
+	}{
+		{"rtmp://127.0.0.1/live/foo", "foo"},
+		{"rtmp://127.0.0.1/test/foo?token=abc", "test/foo"},
+		{"rtmp://127.0.0.1/live/foo?vhost=example.com", "example.com/live/foo"},
+	}
+
+	for _, c := range cases {
+		parsed, _ := url.Parse(c.url)
+		key, err := rtmpStreamKey(parsed)
+		if err != nil {
+			t.Errorf("key of %s error %s", c.url, err)
+			continue
+		}
+		if key.String() != c.id {
+			t.Errorf("key of %s = %s, want %s", c.url, key.String(), c.id)
+		}
+	}
+
+	parsed, _ := url.Parse("rtmp://127.0.0.1/foo")
+	if _, err := rtmpStreamKey(parsed); err != errInvalidRtmpPath {
+		t.Errorf("rtmp url without app should be invalid, got %v", err)
+	}
+
+	key := StreamKey{"example.com", "test", "foo"}
+	if got := key.rtmpURL(1935, "token"); got != "rtmp://localhost:1935/test/foo?token=token&vhost=example.com" {
+		t.Errorf("rtmp url = %s", got)
+	}
+}
+
+// extendConfig the test config with the sections appended
+func extendConfig(t *testing.T, sections string) *config.Config {
+
+	data, err := ioutil.ReadFile("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(data)
+	file.WriteString(sections)
+	file.Close()
+
+	cfg, err := config.LoadConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestStreamKeyApps(t *testing.T) {
+
+	s := New(extendConfig(t, "\nadmin:\n  token: admintoken\n\napps:\n"+`
+  closed:
+    publish: false
+    play: false
+  open:
+    auth: false
+`))
+	s.SetAuthenticator(NewTokenAuth("secret"))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	// the same stream name in two apps are two streams
+	s.addChannel("foo", &Channel{que: pubsub.NewQueue(), created: time.Now()})
+	s.addChannel("test/foo", &Channel{que: pubsub.NewQueue(), created: time.Now()})
+
+	var info struct {
+		S ErrorCode   `json:"s"`
+		D *StreamInfo `json:"d"`
+	}
+
+	for _, id := range []string{"foo", "live%2Ffoo", "test%2Ffoo"} {
+		if status := getAdmin(t, serverHTTP.URL+"/api/streams/"+id, "admintoken", &info); status != 200 {
+			t.Errorf("stream %s should be found, got %d", id, status)
+		}
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams/other%2Ffoo", "admintoken", &info); status != 404 {
+		t.Errorf("stream other/foo should be not found, got %d", status)
+	}
+
+	var result Error
+
+	if status := postJSON(t, serverHTTP.URL+"/api/publish", map[string]string{"streamId": "closed/foo", "sdp": "v=0"}, &result); status != http.StatusForbidden || result.Code != CodeAppDenied {
+		t.Errorf("publish in a closed app should be denied, got %d/%d", status, result.Code)
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/play", map[string]string{"streamId": "closed/foo", "sdp": "v=0"}, &result); status != http.StatusForbidden || result.Code != CodeAppDenied {
+		t.Errorf("play in a closed app should be denied, got %d/%d", status, result.Code)
+	}
+
+	if status := postJSON(t, serverHTTP.URL+"/api/play", map[string]string{"streamId": "live/foo2", "sdp": "v=0"}, &result); status != http.StatusUnauthorized {
+		t.Errorf("play without token should be unauthorized, got %d/%d", status, result.Code)
+	}
+
+	// authorized, but there is no such stream
+	if status := postJSON(t, serverHTTP.URL+"/api/play", map[string]string{"streamId": "open/foo", "sdp": "v=0"}, &result); status != http.StatusNotFound {
+		t.Errorf("play in an app without auth should pass auth, got %d/%d", status, result.Code)
+	}
+
+	// tokens are signed for the canonical stream id
+	token := GenerateToken("secret", ActionPlay, "foo2", time.Now().Add(time.Minute))
+	if status := postJSON(t, serverHTTP.URL+"/api/play", map[string]string{"streamId": "live/foo2", "sdp": "v=0", "token": token}, &result); status != http.StatusNotFound {
+		t.Errorf("play with token should pass auth, got %d/%d", status, result.Code)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// publisher types
+const (
+	PublisherRTC    = "rtc"
+	PublisherRelay  = "relay"
+	PublisherFFmpeg = "ffmpeg"
+	PublisherRTMP   = "rtmp"
+)
+
+// StreamInfo is a live stream, from a media router, a rtmp channel, or both
+type StreamInfo struct {
+	ID          string    `json:"id"`
+	Publisher   string    `json:"publisher,omitempty"`
+	PublisherID string    `json:"publisherId,omitempty"`
+	Origin      bool      `json:"origin"`
+	Uptime      int64     `json:"uptime"`
+	Subscribers int       `json:"subscribers"`
+	Rtmp        *RtmpInfo `json:"rtmp,omitempty"`
+}
+
+// RtmpInfo is the rtmp push of the stream
+type RtmpInfo struct {
+	Uptime int64       `json:"uptime"`
+	Codecs []CodecInfo `json:"codecs"`
+}
+
+// CodecInfo is a codec of the rtmp push
+type CodecInfo struct {
+	Type       string `json:"type"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+}
+
+// SubscriberInfo is a subscriber of the stream with its latest ice stats
+type SubscriberInfo struct {
+	ID       string    `json:"id"`
+	ICEStats *ICEStats `json:"iceStats,omitempty"`
+}
+
+// ICEStats the ice stats of the subscriber transport
+type ICEStats struct {
+	RequestsSent      int64 `json:"requestsSent"`
+	RequestsReceived  int64 `json:"requestsReceived"`
+	ResponsesSent     int64 `json:"responsesSent"`
+	ResponsesReceived int64 `json:"responsesReceived"`
+}
+
+func (s *Server) listStreams(c *gin.Context) {
+
+	s.RLock()
+	ids := make(map[string]bool)
+	for id := range s.routers {
+		ids[id] = true
+	}
+	for id := range s.rtmpChannels {
+		ids[id] = true
+	}
+	s.RUnlock()
+
+	streams := make([]*StreamInfo, 0, len(ids))
+	for id := range ids {
+		if info := s.streamInfo(id); info != nil {
+			streams = append(streams, info)
+		}
+	}
+
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].ID < streams[j].ID
+	})
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": streams,
+	})
+}
+
+func (s *Server) getStream(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "id")
+	if !ok {
+		return
+	}
+
+	info := s.streamInfo(streamID)
+	if info == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": info,
+	})
+}
+
+func (s *Server) listSubscribers(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "id")
+	if !ok {
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	subscribers := make([]*SubscriberInfo, 0)
+	for id, subscriber := range mediarouter.GetSubscribers() {
+		info := &SubscriberInfo{ID: id}
+		if getter, ok := subscriber.(iceStatsGetter); ok {
+			stats := getter.GetICEStats()
+			info.ICEStats = &ICEStats{
+				RequestsSent:      stats.RequestsSent,
+				RequestsReceived:  stats.RequestsReceived,
+				ResponsesSent:     stats.ResponsesSent,
+				ResponsesReceived: stats.ResponsesReceived,
+			}
+		}
+		subscribers = append(subscribers, info)
+	}
+
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].ID < subscribers[j].ID
+	})
+
+	c.JSON(200, gin.H{
+		"s": CodeOK,
+		"d": subscribers,
+	})
+}
+
+// streamInfo describe the stream, nil if the stream does not exist
+func (s *Server) streamInfo(streamID string) *StreamInfo {
+
+	mediarouter := s.getRouter(streamID)
+	channel := s.getChannel(streamID)
+
+	if mediarouter == nil && channel == nil {
+		return nil
+	}
+
+	info := &StreamInfo{ID: streamID}
+
+	if mediarouter != nil {
+		info.Origin = mediarouter.IsOrgin()
+		info.Uptime = uptime(mediarouter.GetCreateTime())
+		info.Subscribers = mediarouter.GetSubscribersCount()
+
+		if publisher := mediarouter.GetPublisher(); publisher != nil {
+			info.Publisher = publisherType(publisher)
+			info.PublisherID = publisher.GetID()
+		}
+	}
+
+	if channel != nil {
+		info.Rtmp = &RtmpInfo{
+			Uptime: uptime(channel.created),
+			Codecs: codecInfos(channel.getStreams()),
+		}
+		if mediarouter == nil {
+			info.Uptime = info.Rtmp.Uptime
+		}
+	}
+
+	return info
+}
+
+func publisherType(publisher router.Publisher) string {
+
+	switch p := publisher.(type) {
+	case *router.FFPublisher:
+		return PublisherFFmpeg
+	case *router.RTMPPublisher:
+		return PublisherRTMP
+	case *router.RTCPublisher:
+		if p.IsRelay() {
+			return PublisherRelay
+		}
+		return PublisherRTC
+	}
+	return ""
+}
+
+func codecInfos(streams []av.CodecData) []CodecInfo {
+
+	codecs := make([]CodecInfo, 0, len(streams))
+
+	for _, stream := range streams {
+		codec := CodecInfo{Type: stream.Type().String()}
+		switch data := stream.(type) {
+		case av.VideoCodecData:
+			codec.Width = data.Width()
+			codec.Height = data.Height()
+		case av.AudioCodecData:
+			codec.SampleRate = data.SampleRate()
+			codec.Channels = data.ChannelLayout().Count()
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+// uptime in seconds
+func uptime(since time.Time) int64 {
+	return int64(time.Since(since) / time.Second)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/rtmp-lib/pubsub"
+)
+
+func getJSON(t *testing.T, address string, result interface{}) int {
+
+	resp, err := http.Get(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestListStreams(t *testing.T) {
+
+	s := New(testAdminConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "streamstest"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: "publisher"})
+	s.addRouter(mediarouter)
+
+	s.addChannel("rtmptest", &Channel{que: pubsub.NewQueue(), created: time.Now().Add(-time.Minute)})
+
+	var list struct {
+		S ErrorCode     `json:"s"`
+		D []*StreamInfo `json:"d"`
+	}
+
+	var result Error
+
+	for _, path := range []string{"/api/streams", "/api/streams/" + streamID, "/api/streams/" + streamID + "/subscribers"} {
+		if status := getJSON(t, serverHTTP.URL+path, &result); status != http.StatusUnauthorized {
+			t.Errorf("%s without the admin token should be unauthorized, got %d", path, status)
+		}
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams", "admintoken", &list); status != 200 || list.S != CodeOK {
+		t.Fatalf("list streams should succeed, got %d/%d", status, list.S)
+	}
+
+	if len(list.D) != 2 || list.D[0].ID != "rtmptest" || list.D[1].ID != streamID {
+		t.Fatalf("should list the router and the rtmp channel, got %+v", list.D)
+	}
+
+	if list.D[0].Rtmp == nil || list.D[0].Uptime < 60 {
+		t.Errorf("rtmp stream should have rtmp info and uptime, got %+v", list.D[0])
+	}
+
+	if !list.D[1].Origin || list.D[1].PublisherID != "publisher" || list.D[1].Subscribers != 0 {
+		t.Errorf("wrong stream info %+v", list.D[1])
+	}
+
+	var stream struct {
+		S ErrorCode   `json:"s"`
+		D *StreamInfo `json:"d"`
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams/"+streamID, "admintoken", &stream); status != 200 || stream.D.ID != streamID {
+		t.Errorf("get stream should succeed, got %d", status)
+	}
+
+	var subscribers struct {
+		S ErrorCode         `json:"s"`
+		D []*SubscriberInfo `json:"d"`
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams/"+streamID+"/subscribers", "admintoken", &subscribers); status != 200 || len(subscribers.D) != 0 {
+		t.Errorf("list subscribers should succeed, got %d %+v", status, subscribers.D)
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams/unknown", "admintoken", &result); status != 404 || result.Code != CodeStreamNotFound {
+		t.Errorf("unknown stream should be 404, got %d/%d", status, result.Code)
+	}
+
+	if status := getAdmin(t, serverHTTP.URL+"/api/streams/rtmptest/subscribers", "admintoken", &result); status != 404 {
+		t.Errorf("rtmp only stream has no subscribers, got %d", status)
+	}
+}
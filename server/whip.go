@@ -0,0 +1,320 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/rtclive/router"
+	"github.com/notedit/sdp"
+)
+
+const (
+	sdpContentType     = "application/sdp"
+	trickleContentType = "application/trickle-ice-sdpfrag"
+)
+
+// whipPublish WHIP ingest, the body is the sdp offer and the answer is returned
+// with the publisher resource url in Location
+func (s *Server) whipPublish(c *gin.Context) {
+
+	offer, ok := readSdpBody(c, sdpContentType)
+	if !ok {
+		return
+	}
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, "", "whip"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	publisher, err := s.createPublisher(streamID, offer, "whip")
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	publisher.SetClientIP(s.clientIP(c.Request))
+
+	c.Header("Location", resourceURL("whip", streamID, publisher.GetID()))
+	c.Data(http.StatusCreated, sdpContentType, []byte(publisher.GetAnswer()))
+}
+
+// whipPatch trickle ice candidates to the publisher
+func (s *Server) whipPatch(c *gin.Context) {
+
+	frag, ok := readSdpBody(c, trickleContentType)
+	if !ok {
+		return
+	}
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, "", "whip"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	publisher := whipPublisher(mediarouter, c.Param("id"))
+	if publisher == nil {
+		abortWithError(c, errPublisherNotFound)
+		return
+	}
+
+	addCandidates(c, publisher.GetTransport(), frag)
+}
+
+// whipDelete stop the publisher and tear down the stream
+func (s *Server) whipDelete(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	if err := s.authorize(c, ActionPublish, streamID, "", "whip"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// the pull and rtmp publishers have the stream id as their id, only a whip publish can be deleted
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil || whipPublisher(mediarouter, c.Param("id")) == nil {
+		abortWithError(c, errPublisherNotFound)
+		return
+	}
+
+	s.closeStream(mediarouter, "whip")
+
+	c.Status(http.StatusOK)
+}
+
+// whepPlay WHEP playback, the body is the sdp offer and the answer is returned
+// with the subscriber resource url in Location
+func (s *Server) whepPlay(c *gin.Context) {
+
+	offer, ok := readSdpBody(c, sdpContentType)
+	if !ok {
+		return
+	}
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	streamURL := c.Query("streamUrl")
+
+	if err := s.authorize(c, ActionPlay, streamID, "", "whep"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	created := s.getRouter(streamID) == nil
+
+	mediarouter, err := s.findRouter(streamID, streamURL)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if mediarouter == nil {
+		mediarouter, err = s.createRouter(streamID, streamURL, c.Query("profile"))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	subscriber, err := mediarouter.CreateSubscriber(offer)
+	if err != nil {
+		if created {
+			s.closeStream(mediarouter, pullProtocol(mediarouter))
+		}
+		abortWithError(c, err)
+		return
+	}
+	s.setClientIP(subscriber, c)
+
+	c.Header("Location", resourceURL("whep", streamID, subscriber.GetID()))
+	c.Data(http.StatusCreated, sdpContentType, []byte(subscriber.GetAnswer()))
+}
+
+// whepPatch trickle ice candidates to the subscriber
+func (s *Server) whepPatch(c *gin.Context) {
+
+	frag, ok := readSdpBody(c, trickleContentType)
+	if !ok {
+		return
+	}
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	if err := s.authorize(c, ActionPlay, streamID, "", "whep"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil {
+		abortWithError(c, errStreamNotFound)
+		return
+	}
+
+	subscriber := whepSubscriber(mediarouter, c.Param("id"))
+	if subscriber == nil {
+		abortWithError(c, errSubscriberNotFound)
+		return
+	}
+
+	addCandidates(c, subscriber.GetTransport(), frag)
+}
+
+// whepDelete stop the subscriber
+func (s *Server) whepDelete(c *gin.Context) {
+
+	streamID, ok := streamParam(c, "stream")
+	if !ok {
+		return
+	}
+
+	if err := s.authorize(c, ActionPlay, streamID, "", "whep"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mediarouter := s.getRouter(streamID)
+	if mediarouter == nil || whepSubscriber(mediarouter, c.Param("id")) == nil {
+		abortWithError(c, errSubscriberNotFound)
+		return
+	}
+
+	mediarouter.StopSubscriber(c.Param("id"))
+
+	c.Status(http.StatusOK)
+}
+
+// whipPublisher the webrtc publisher of the router with the resource id, nil for a relay, pull or rtmp publisher
+func whipPublisher(mediarouter *router.MediaRouter, id string) *router.RTCPublisher {
+
+	publisher, ok := mediarouter.GetPublisher().(*router.RTCPublisher)
+	if !ok || publisher.IsRelay() || publisher.GetID() != id {
+		return nil
+	}
+	return publisher
+}
+
+// whepSubscriber the webrtc subscriber of the router with the resource id
+func whepSubscriber(mediarouter *router.MediaRouter, id string) *router.RTCSubscriber {
+
+	subscriber, _ := mediarouter.GetSubscriber(id).(*router.RTCSubscriber)
+	return subscriber
+}
+
+func readSdpBody(c *gin.Context, contentType string) (string, bool) {
+
+	if c.ContentType() != contentType {
+		abortWithError(c, NewError(CodeUnsupportedMediaType, "content type should be "+contentType))
+		return "", false
+	}
+
+	body, err := c.GetRawData()
+	if err != nil || len(body) == 0 {
+		abortWithError(c, NewError(CodeBadRequest, "body can not be empty"))
+		return "", false
+	}
+
+	return string(body), true
+}
+
+func resourceURL(kind string, streamID string, resourceID string) string {
+	return "/" + kind + "/" + url.PathEscape(streamID) + "/" + url.PathEscape(resourceID)
+}
+
+func addCandidates(c *gin.Context, transport *mediaserver.Transport, frag string) {
+
+	candidates, err := parseCandidates(frag)
+	if err != nil {
+		abortWithError(c, NewError(CodeBadRequest, err.Error()))
+		return
+	}
+
+	for _, candidate := range candidates {
+		transport.AddRemoteCandidate(candidate)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseCandidates parse the a=candidate lines of a trickle ice sdp fragment
+func parseCandidates(frag string) ([]*sdp.CandidateInfo, error) {
+
+	candidates := []*sdp.CandidateInfo{}
+
+	for _, line := range strings.Split(frag, "\n") {
+
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "a=candidate:"))
+		if len(fields) < 8 || fields[6] != "typ" {
+			return nil, fmt.Errorf("invalid candidate %s", line)
+		}
+
+		componentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid candidate component %s", line)
+		}
+
+		priority, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid candidate priority %s", line)
+		}
+
+		port, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid candidate port %s", line)
+		}
+
+		var relAddr string
+		var relPort int
+		for i := 8; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "raddr":
+				relAddr = fields[i+1]
+			case "rport":
+				relPort, err = strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid candidate rport %s", line)
+				}
+			}
+		}
+
+		candidate := sdp.NewCandidateInfo(fields[0], componentID, fields[2], priority, fields[4], port, fields[7], relAddr, relPort)
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/router"
+)
+
+func TestParseCandidates(t *testing.T) {
+
+	frag := "a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=audio 9 RTP/AVP 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0 ufrag EsAw network-id 1\r\n" +
+		"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ srflx raddr 192.0.2.1 rport 61764 generation 0\r\n" +
+		"a=end-of-candidates\r\n"
+
+	candidates, err := parseCandidates(frag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(candidates) != 2 {
+		t.Errorf("should parse 2 candidates, got %d", len(candidates))
+	}
+
+	if _, err := parseCandidates("a=candidate:1387637174 1 udp 2122260223 192.0.2.1\r\n"); err == nil {
+		t.Error("truncated candidate should fail")
+	}
+
+	if _, err := parseCandidates("a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ srflx raddr 192.0.2.1 rport x\r\n"); err == nil {
+		t.Error("invalid rport should fail")
+	}
+}
+
+func TestWhipErrors(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	resp, err := http.Post(serverHTTP.URL+"/whip/whiptest", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("whip should only accept sdp, got %d", resp.StatusCode)
+	}
+
+	streamID := "whiptest"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: "publisher"})
+	s.addRouter(mediarouter)
+
+	resp, err = http.Post(serverHTTP.URL+"/whip/whiptest", sdpContentType, strings.NewReader(testOffer(s.cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate whip publish should conflict, got %d", resp.StatusCode)
+	}
+
+	request, _ := http.NewRequest("DELETE", serverHTTP.URL+"/whip/whiptest/other", nil)
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete other publisher should be not found, got %d", resp.StatusCode)
+	}
+
+	// only a whip publish can be deleted through its resource
+	request, _ = http.NewRequest("DELETE", serverHTTP.URL+"/whip/whiptest/publisher", nil)
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound || s.getRouter(streamID) == nil {
+		t.Errorf("delete of a publisher which is not whip should be not found, got %d", resp.StatusCode)
+	}
+}
+
+func TestWhipUnauthorized(t *testing.T) {
+
+	s := New(testConfig(t))
+	s.SetAuthenticator(NewTokenAuth("secret"))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	streamID := "whipauth"
+	mediarouter := router.NewMediaRouter(streamID, s.getEndpoint(streamID), s.cfg.Capabilities, true)
+	mediarouter.SetPublisher(&testPublisher{id: streamID})
+	s.addRouter(mediarouter)
+
+	requests := []struct {
+		method      string
+		path        string
+		contentType string
+	}{
+		{"PATCH", "/whip/whipauth/" + streamID, trickleContentType},
+		{"DELETE", "/whip/whipauth/" + streamID, ""},
+		{"PATCH", "/whep/whipauth/subscriber", trickleContentType},
+		{"DELETE", "/whep/whipauth/subscriber", ""},
+	}
+
+	for _, r := range requests {
+		request, _ := http.NewRequest(r.method, serverHTTP.URL+r.path, strings.NewReader("a=end-of-candidates\r\n"))
+		if r.contentType != "" {
+			request.Header.Set("Content-Type", r.contentType)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without token should be unauthorized, got %d", r.method, r.path, resp.StatusCode)
+		}
+	}
+
+	token := GenerateToken("secret", ActionPublish, streamID, time.Now().Add(time.Minute))
+
+	request, _ := http.NewRequest("DELETE", serverHTTP.URL+"/whip/whipauth/"+streamID, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// authorized, but the publisher is not a whip publish
+	if resp.StatusCode != http.StatusNotFound || s.getRouter(streamID) == nil {
+		t.Errorf("delete of a publisher which is not whip should be not found, got %d", resp.StatusCode)
+	}
+}
+
+func TestWhepNotFound(t *testing.T) {
+
+	s := New(testConfig(t))
+	serverHTTP := httptest.NewServer(s)
+	defer serverHTTP.Close()
+
+	resp, err := http.Post(serverHTTP.URL+"/whep/wheptest", sdpContentType, strings.NewReader(testOffer(s.cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("whep of unknown stream should be not found, got %d", resp.StatusCode)
+	}
+}
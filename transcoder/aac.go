@@ -0,0 +1,105 @@
+package transcoder
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/notedit/rtclive/codec"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+var (
+	errAACConfig = errors.New("transcoder: aac config is invalid")
+	errADTSFrame = errors.New("transcoder: invalid adts frame")
+)
+
+// aac samples per frame
+const aacFrameSamples = 1024
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func init() {
+	Register(av.AAC, NewAACToOpus)
+}
+
+// NewAACToOpus transcode aac to 48khz stereo opus with ffmpeg
+func NewAACToOpus(stream av.CodecData) (Transcoder, error) {
+
+	aac, ok := stream.(codec.AACCodecData)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	config := aac.MPEG4AudioConfigBytes()
+	if len(config) < 2 {
+		return nil, errAACConfig
+	}
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer",
+		"-f", "aac", "-i", "pipe:0",
+		"-vn", "-acodec", "libopus", "-ar", "48000", "-ac", "2",
+		"-frame_duration", "20",
+		"-page_duration", "20000",
+		"-flush_packets", "1",
+		"-f", "ogg", "pipe:1",
+	}
+
+	encode := func(packet av.Packet) []byte {
+		return append(codec.ADTSHeader(config, len(packet.Data)), packet.Data...)
+	}
+
+	return newPipeTranscoder(args, encode, func(reader io.Reader) frameReader {
+		return &opusFrameReader{ogg: newOggReader(reader)}
+	})
+}
+
+// adtsReader read the raw aac frames of an adts stream
+type adtsReader struct {
+	reader *bufio.Reader
+}
+
+func newADTSReader(reader io.Reader) *adtsReader {
+	return &adtsReader{reader: bufio.NewReader(reader)}
+}
+
+// ReadFrame read a raw aac frame without its adts header
+func (r *adtsReader) ReadFrame() ([]byte, time.Duration, error) {
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, 0, err
+	}
+
+	if header[0] != 0xff || header[1]&0xf0 != 0xf0 {
+		return nil, 0, errADTSFrame
+	}
+
+	frequencyIndex := int(header[2]>>2) & 0x0f
+	if frequencyIndex >= len(aacSampleRates) {
+		return nil, 0, errADTSFrame
+	}
+
+	headerSize := 7
+	// protection absent is not set, a crc follows the header
+	if header[1]&0x01 == 0 {
+		headerSize = 9
+	}
+
+	length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	if length < headerSize {
+		return nil, 0, errADTSFrame
+	}
+
+	frame := make([]byte, length-7)
+	if _, err := io.ReadFull(r.reader, frame); err != nil {
+		return nil, 0, err
+	}
+
+	duration := time.Duration(aacFrameSamples) * time.Second / time.Duration(aacSampleRates[frequencyIndex])
+
+	return frame[headerSize-7:], duration, nil
+}
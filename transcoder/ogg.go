@@ -0,0 +1,143 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errOggPage = errors.New("transcoder: invalid ogg page")
+
+// oggReader read the packets of a single stream ogg
+type oggReader struct {
+	reader  *bufio.Reader
+	packets [][]byte
+	partial []byte
+}
+
+func newOggReader(reader io.Reader) *oggReader {
+	return &oggReader{reader: bufio.NewReader(reader)}
+}
+
+// ReadPacket read the next packet, packets continued across pages are joined
+func (r *oggReader) ReadPacket() ([]byte, error) {
+
+	for len(r.packets) == 0 {
+		if err := r.readPage(); err != nil {
+			return nil, err
+		}
+	}
+
+	packet := r.packets[0]
+	r.packets = r.packets[1:]
+	return packet, nil
+}
+
+func (r *oggReader) readPage() error {
+
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return errOggPage
+	}
+
+	// a page not continuing a packet drops the partial one
+	if header[5]&0x01 == 0 {
+		r.partial = nil
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r.reader, segments); err != nil {
+		return err
+	}
+
+	size := 0
+	for _, segment := range segments {
+		size += int(segment)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return err
+	}
+
+	// a packet ends with a segment shorter than 255
+	for _, segment := range segments {
+		r.partial = append(r.partial, body[:segment]...)
+		body = body[segment:]
+		if segment < 255 {
+			r.packets = append(r.packets, r.partial)
+			r.partial = nil
+		}
+	}
+
+	return nil
+}
+
+// oggWriter write each packet of a single stream ogg in its own page
+type oggWriter struct {
+	serial   uint32
+	sequence uint32
+	started  bool
+}
+
+// page the ogg page of the packet, granule is the position after it
+func (w *oggWriter) page(packet []byte, granule uint64) []byte {
+
+	var segments []byte
+	size := len(packet)
+	for size >= 255 {
+		segments = append(segments, 255)
+		size -= 255
+	}
+	segments = append(segments, byte(size))
+
+	page := make([]byte, 27, 27+len(segments)+len(packet))
+	copy(page, "OggS")
+	if !w.started {
+		// beginning of stream
+		page[5] = 0x02
+		w.started = true
+	}
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(len(segments))
+	page = append(page, segments...)
+	page = append(page, packet...)
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	w.sequence++
+
+	return page
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+// oggCRC the checksum of a page whose checksum field is zero
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,127 @@
+package transcoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// OpusToAACConfig the mpeg4 audio config of the aac NewOpusToAAC outputs, lc 48khz stereo
+var OpusToAACConfig = []byte{0x11, 0x90}
+
+// NewOpusToAAC transcode 48khz stereo opus to aac with ffmpeg, the packets are opus frames
+func NewOpusToAAC() (Transcoder, error) {
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer",
+		"-f", "ogg", "-i", "pipe:0",
+		"-vn", "-acodec", "aac", "-ar", "48000", "-ac", "2",
+		"-flush_packets", "1",
+		"-f", "adts", "pipe:1",
+	}
+
+	writer := &oggWriter{serial: 1}
+	var granule uint64
+
+	encode := func(packet av.Packet) []byte {
+
+		var data []byte
+		if !writer.started {
+			data = append(data, writer.page(opusHead(), 0)...)
+			data = append(data, writer.page(opusTags(), 0)...)
+		}
+
+		granule += uint64(opusDuration(packet.Data) * 48000 / time.Second)
+
+		return append(data, writer.page(packet.Data, granule)...)
+	}
+
+	return newPipeTranscoder(args, encode, func(reader io.Reader) frameReader {
+		return newADTSReader(reader)
+	})
+}
+
+// opusFrameReader read the opus frames of an ogg opus stream
+type opusFrameReader struct {
+	ogg *oggReader
+}
+
+// ReadFrame read an opus frame, the headers are skipped
+func (r *opusFrameReader) ReadFrame() ([]byte, time.Duration, error) {
+
+	for {
+		packet, err := r.ogg.ReadPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if isOpusHeader(packet) {
+			continue
+		}
+
+		return packet, opusDuration(packet), nil
+	}
+}
+
+// opusHead the id header of a 48khz stereo ogg opus stream, RFC 7845 5.1
+func opusHead() []byte {
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = 2
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	return head
+}
+
+// opusTags the comment header, RFC 7845 5.2
+func opusTags() []byte {
+
+	vendor := "rtclive"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	return tags
+}
+
+// isOpusHeader the id and comment headers of an ogg opus stream
+func isOpusHeader(packet []byte) bool {
+	return bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags"))
+}
+
+// opusDuration the duration of an opus packet from its toc, RFC 6716 3.1
+func opusDuration(packet []byte) time.Duration {
+
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+
+	var frame time.Duration
+	switch {
+	case config < 12:
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return time.Duration(packet[1]&0x3f) * frame
+	}
+}
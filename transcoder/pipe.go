@@ -0,0 +1,138 @@
+package transcoder
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+var ffmpegPath = "ffmpeg"
+
+// ffmpeg has this long to quit after its stdin is closed
+const pipeStopTimeout = 5 * time.Second
+
+// frameReader read the frames ffmpeg outputs, with their duration
+type frameReader interface {
+	ReadFrame() ([]byte, time.Duration, error)
+}
+
+// pipeTranscoder write the packets framed by encode to ffmpeg's stdin, and read the frames from its stdout
+type pipeTranscoder struct {
+	encode  func(packet av.Packet) []byte
+	frames  frameReader
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *io.PipeReader
+	exited  chan struct{}
+
+	sync.Mutex
+	started bool
+	base    time.Duration
+	next    time.Duration
+	closed  bool
+}
+
+func newPipeTranscoder(args []string, encode func(packet av.Packet) []byte, newReader func(reader io.Reader) frameReader) (*pipeTranscoder, error) {
+
+	command := exec.Command(ffmpegPath, args...)
+
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// the frames are read from an io.Pipe, so Wait does not close them before they are read
+	stdout, writer := io.Pipe()
+	command.Stdout = writer
+
+	if err := command.Start(); err != nil {
+		stdin.Close()
+		writer.Close()
+		stdout.Close()
+		return nil, fmt.Errorf("Failed Start FFMPEG with %s", err)
+	}
+
+	transcoder := &pipeTranscoder{
+		encode:  encode,
+		frames:  newReader(stdout),
+		command: command,
+		stdin:   stdin,
+		stdout:  stdout,
+		exited:  make(chan struct{}),
+	}
+
+	go func() {
+		command.Wait()
+		writer.Close()
+		close(transcoder.exited)
+	}()
+
+	return transcoder, nil
+}
+
+// WritePacket write a packet, the first one is the time base of the frames
+func (t *pipeTranscoder) WritePacket(packet av.Packet) error {
+
+	t.Lock()
+	if !t.started {
+		t.started = true
+		t.base = packet.Time
+	}
+	t.Unlock()
+
+	_, err := t.stdin.Write(t.encode(packet))
+	return err
+}
+
+// ReadFrame read a transcoded frame, its time is counted from the first packet
+func (t *pipeTranscoder) ReadFrame() (*Frame, error) {
+
+	data, duration, err := t.frames.ReadFrame()
+	if err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	frame := &Frame{
+		Data:     data,
+		Time:     t.base + t.next,
+		Duration: duration,
+	}
+	t.next += duration
+
+	return frame, nil
+}
+
+// Close close ffmpeg's stdin and wait for it to quit, it is killed after the timeout.
+// The frames not read yet are dropped
+func (t *pipeTranscoder) Close() error {
+
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.Unlock()
+
+	t.stdin.Close()
+	t.stdout.Close()
+
+	select {
+	case <-t.exited:
+	case <-time.After(pipeStopTimeout):
+		t.command.Process.Kill()
+		<-t.exited
+	}
+
+	return nil
+}
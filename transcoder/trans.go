@@ -1 +1,57 @@
 package transcoder
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// ErrUnsupported no transcoder is registered for the codec
+var ErrUnsupported = errors.New("transcoder: codec is not supported")
+
+// Frame is a transcoded frame, Time is relative to the stream like av.Packet
+type Frame struct {
+	Data     []byte
+	Time     time.Duration
+	Duration time.Duration
+}
+
+// Transcoder transcode the packets of one stream of the source
+type Transcoder interface {
+	// WritePacket write a packet of the source codec
+	WritePacket(packet av.Packet) error
+	// ReadFrame read the next transcoded frame, io.EOF once the transcoder is closed
+	ReadFrame() (*Frame, error)
+	Close() error
+}
+
+// Factory create a transcoder of the source codec
+type Factory func(codec av.CodecData) (Transcoder, error)
+
+var (
+	factoryLock sync.RWMutex
+	factories   = map[av.CodecType]Factory{}
+)
+
+// Register set the factory of the codec type, it replaces the one registered before
+func Register(codecType av.CodecType, factory Factory) {
+	factoryLock.Lock()
+	defer factoryLock.Unlock()
+	factories[codecType] = factory
+}
+
+// New create a transcoder of the codec with the registered factory
+func New(codec av.CodecData) (Transcoder, error) {
+
+	factoryLock.RLock()
+	factory := factories[codec.Type()]
+	factoryLock.RUnlock()
+
+	if factory == nil {
+		return nil, ErrUnsupported
+	}
+
+	return factory(codec)
+}
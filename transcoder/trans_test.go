@@ -0,0 +1,381 @@
+package transcoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtclive/codec"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// aac lc, 44100hz, stereo
+var aacConfig = []byte{0x12, 0x10}
+
+type testAACCodec struct{}
+
+func (testAACCodec) Type() av.CodecType { return av.AAC }
+
+func (testAACCodec) MPEG4AudioConfigBytes() []byte { return aacConfig }
+
+// readADTS split an adts stream into its raw frames
+func readADTS(t *testing.T, data []byte) [][]byte {
+
+	var frames [][]byte
+	for len(data) >= 7 {
+		length := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if length < 7 || length > len(data) {
+			t.Fatalf("invalid adts frame length %d", length)
+		}
+		frames = append(frames, data[7:length])
+		data = data[length:]
+	}
+	return frames
+}
+
+func fakeFFmpeg(t *testing.T, script string) func() {
+
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := ffmpegPath
+	ffmpegPath = path
+	return func() {
+		ffmpegPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestADTSHeader(t *testing.T) {
+
+	fixture, err := ioutil.ReadFile("testdata/silence.aac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := readADTS(t, fixture)
+	if len(frames) != 10 {
+		t.Fatalf("frames = %d, want 10", len(frames))
+	}
+
+	var adts []byte
+	for _, frame := range frames {
+		adts = append(adts, codec.ADTSHeader(aacConfig, len(frame))...)
+		adts = append(adts, frame...)
+	}
+
+	if !bytes.Equal(adts, fixture) {
+		t.Errorf("adts = %x, want %x", adts, fixture)
+	}
+}
+
+func TestOggReader(t *testing.T) {
+
+	fixture, err := ioutil.ReadFile("testdata/silence.opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newOggReader(bytes.NewReader(fixture))
+
+	var packets [][]byte
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+
+	if len(packets) != 12 {
+		t.Fatalf("packets = %d, want 12", len(packets))
+	}
+	if !isOpusHeader(packets[0]) || !isOpusHeader(packets[1]) {
+		t.Error("the first packets should be the opus headers")
+	}
+	for _, packet := range packets[2:] {
+		if !bytes.Equal(packet, []byte{0xf8, 0xff, 0xfe}) {
+			t.Errorf("packet = %x", packet)
+		}
+	}
+
+	// a packet of 300 bytes continued on the next page
+	large := bytes.Repeat([]byte{0xfc}, 300)
+	var data []byte
+	data = append(data, "OggS\x00\x00"...)
+	data = append(data, make([]byte, 20)...)
+	data = append(data, 1, 255)
+	data = append(data, large[:255]...)
+	data = append(data, "OggS\x00\x01"...)
+	data = append(data, make([]byte, 20)...)
+	data = append(data, 1, 45)
+	data = append(data, large[255:]...)
+
+	packet, err := newOggReader(bytes.NewReader(data)).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, large) {
+		t.Errorf("continued packet size = %d, want 300", len(packet))
+	}
+}
+
+func TestOpusDuration(t *testing.T) {
+
+	cases := []struct {
+		packet   []byte
+		duration time.Duration
+	}{
+		{[]byte{0xf8}, 20 * time.Millisecond},
+		{[]byte{0xe0}, 2500 * time.Microsecond},
+		{[]byte{0x08}, 20 * time.Millisecond},
+		{[]byte{0x18}, 60 * time.Millisecond},
+		{[]byte{0x78}, 20 * time.Millisecond},
+		{[]byte{0xf9}, 40 * time.Millisecond},
+		{[]byte{0xfb, 0x03}, 60 * time.Millisecond},
+		{nil, 0},
+	}
+
+	for _, c := range cases {
+		if got := opusDuration(c.packet); got != c.duration {
+			t.Errorf("opusDuration(%x) = %s, want %s", c.packet, got, c.duration)
+		}
+	}
+}
+
+func TestAACToOpus(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transcoder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opus, err := filepath.Abs("testdata/silence.opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input.aac")
+
+	defer fakeFFmpeg(t, "cat '"+opus+"'; cat > '"+input+"'")()
+
+	fixture, err := ioutil.ReadFile("testdata/silence.aac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transcoder, err := New(testAACCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, frame := range readADTS(t, fixture) {
+		packet := av.Packet{
+			Time: time.Second + time.Duration(i)*1024*time.Second/44100,
+			Data: frame,
+		}
+		if err := transcoder.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		frame, err := transcoder.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Second + time.Duration(i)*20*time.Millisecond; frame.Time != want {
+			t.Errorf("frame %d time = %s, want %s", i, frame.Time, want)
+		}
+		if frame.Duration != 20*time.Millisecond {
+			t.Errorf("frame %d duration = %s", i, frame.Duration)
+		}
+	}
+
+	transcoder.Close()
+
+	if _, err := transcoder.ReadFrame(); err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+
+	written, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, fixture) {
+		t.Errorf("ffmpeg input = %x, want %x", written, fixture)
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+
+	if _, err := New(testVideoCodec{}); err != ErrUnsupported {
+		t.Errorf("New(h264) = %v, want ErrUnsupported", err)
+	}
+}
+
+type testVideoCodec struct{}
+
+func (testVideoCodec) Type() av.CodecType { return av.H264 }
+
+func TestOggWriter(t *testing.T) {
+
+	fixture, err := ioutil.ReadFile("testdata/silence.opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum of the first page of the fixture
+	page := append([]byte(nil), fixture[:28+19]...)
+	want := binary.LittleEndian.Uint32(page[22:])
+	binary.LittleEndian.PutUint32(page[22:], 0)
+	if got := oggCRC(page); got != want {
+		t.Errorf("crc = %x, want %x", got, want)
+	}
+
+	writer := &oggWriter{serial: 1}
+	large := bytes.Repeat([]byte{0xfc}, 600)
+
+	var data []byte
+	data = append(data, writer.page(opusHead(), 0)...)
+	data = append(data, writer.page([]byte{0xf8, 0xff, 0xfe}, 960)...)
+	data = append(data, writer.page(large, 1920)...)
+
+	if data[5] != 0x02 {
+		t.Error("the first page should begin the stream")
+	}
+
+	reader := newOggReader(bytes.NewReader(data))
+	for _, want := range [][]byte{opusHead(), {0xf8, 0xff, 0xfe}, large} {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Errorf("packet size = %d, want %d", len(packet), len(want))
+		}
+	}
+}
+
+func TestADTSReader(t *testing.T) {
+
+	fixture, err := ioutil.ReadFile("testdata/silence.aac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := readADTS(t, fixture)
+	reader := newADTSReader(bytes.NewReader(fixture))
+
+	for i := range want {
+		frame, duration, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, want[i]) {
+			t.Errorf("frame %d = %x, want %x", i, frame, want[i])
+		}
+		if duration != 1024*time.Second/44100 {
+			t.Errorf("frame %d duration = %s", i, duration)
+		}
+	}
+
+	if _, _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("read at the end = %v, want EOF", err)
+	}
+
+	if _, _, err := newADTSReader(bytes.NewReader(make([]byte, 16))).ReadFrame(); err != errADTSFrame {
+		t.Errorf("read of garbage = %v, want errADTSFrame", err)
+	}
+}
+
+func TestOpusToAAC(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transcoder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aac, err := filepath.Abs("testdata/silence.aac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input.opus")
+
+	defer fakeFFmpeg(t, "cat '"+aac+"'; cat > '"+input+"'")()
+
+	transcoder, err := NewOpusToAAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	silence := []byte{0xf8, 0xff, 0xfe}
+	for i := 0; i < 5; i++ {
+		packet := av.Packet{
+			Time: time.Duration(i) * 20 * time.Millisecond,
+			Data: silence,
+		}
+		if err := transcoder.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		frame, err := transcoder.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Duration(i) * (1024 * time.Second / 44100); frame.Time != want {
+			t.Errorf("frame %d time = %s, want %s", i, frame.Time, want)
+		}
+	}
+
+	transcoder.Close()
+
+	written, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newOggReader(bytes.NewReader(written))
+	var packets [][]byte
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+
+	if len(packets) != 7 {
+		t.Fatalf("ffmpeg input packets = %d, want 7", len(packets))
+	}
+	if !bytes.HasPrefix(packets[0], []byte("OpusHead")) || !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+		t.Error("ffmpeg input should start with the opus headers")
+	}
+	for _, packet := range packets[2:] {
+		if !bytes.Equal(packet, silence) {
+			t.Errorf("packet = %x, want %x", packet, silence)
+		}
+	}
+}